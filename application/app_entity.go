@@ -23,6 +23,21 @@ type IController interface {
 	Middlewares() []func(next http.Handler) http.Handler
 }
 
+// IDevOnlyController marks controllers whose routes are only registered when the server runs in dev mode.
+type IDevOnlyController interface {
+	DevOnly() bool
+}
+
 type IService interface {
 	PostConstruct()
 }
+
+// IStoppableService is stopped once the server has shut down, it releases what PostConstruct started.
+type IStoppableService interface {
+	Stop()
+}
+
+// IRoutesAwareService is called once every controller has registered its routes, right before the server starts.
+type IRoutesAwareService interface {
+	RoutesRegistered(server *fuego.Server)
+}
@@ -1,6 +1,7 @@
 package application
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	appMiddleware "github.com/GolangSpring/gospring/application/app_middleware"
@@ -9,12 +10,18 @@ import (
 	"github.com/rs/zerolog/log"
 	"gopkg.in/natefinch/lumberjack.v2"
 	"io"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"reflect"
+	"syscall"
 	"time"
 )
 
+// shutdownTimeout bounds how long the requests in flight may take once a shutdown is asked
+const shutdownTimeout = 30 * time.Second
+
 type Application struct {
 	ContextCollection []*ApplicationContext
 	AppConfig         *Config
@@ -132,6 +139,10 @@ func MustNewApplication(config *Config) *Application {
 func (app *Application) registerControllerRoutes() {
 	for _, _context := range app.ContextCollection {
 		for _, _controller := range _context.Controllers {
+			if devOnly, ok := _controller.(IDevOnlyController); ok && devOnly.DevOnly() && app.AppConfig.ServerConfig.Mode != Development {
+				log.Info().Msgf("Skipping dev only routes for web: %s", reflect.TypeOf(_controller).String())
+				continue
+			}
 			log.Info().Msgf("Registering routes for web: %s", reflect.TypeOf(_controller).String())
 			_controller.Routes(app.Server)
 		}
@@ -161,6 +172,48 @@ func (app *Application) postConstructServices() {
 	}
 	log.Info().Msg("PostConstruct for all services completed")
 }
+
+func (app *Application) notifyRoutesRegistered() {
+	for _, _context := range app.ContextCollection {
+		for _, _service := range _context.Services {
+			if routesAware, ok := _service.(IRoutesAwareService); ok {
+				log.Info().Msgf("RoutesRegistered for service: %s", reflect.TypeOf(_service).String())
+				routesAware.RoutesRegistered(app.Server)
+			}
+		}
+	}
+}
+
+// shutdownOnSignal lets the requests in flight finish on SIGINT or SIGTERM, then stops the services.
+func (app *Application) shutdownOnSignal(stopped chan<- struct{}) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+
+	log.Info().Msg("Shutting down server...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := app.Server.Shutdown(shutdownCtx); err != nil {
+		log.Warn().Msgf("Failed to shut down server gracefully: %v", err)
+	}
+	app.stopServices()
+	close(stopped)
+}
+
+// stopServices stops the services in the reverse order of their construction.
+func (app *Application) stopServices() {
+	for contextIdx := len(app.ContextCollection) - 1; contextIdx >= 0; contextIdx-- {
+		services := app.ContextCollection[contextIdx].Services
+		for serviceIdx := len(services) - 1; serviceIdx >= 0; serviceIdx-- {
+			if stoppable, ok := services[serviceIdx].(IStoppableService); ok {
+				log.Info().Msgf("Stop for service: %s", reflect.TypeOf(services[serviceIdx]).String())
+				stoppable.Stop()
+			}
+		}
+	}
+	log.Info().Msg("All services stopped")
+}
+
 func (app *Application) registerAppMiddlewares() {
 	log.Info().Msg("Registering application middlewares")
 	fuego.Use(app.Server, appMiddleware.LoggingMiddleware)
@@ -195,10 +248,14 @@ func (app *Application) Run() {
 	app.postConstructServices()
 	app.registerControllerMiddlewares()
 	app.registerControllerRoutes()
+	app.notifyRoutesRegistered()
+
+	stopped := make(chan struct{})
+	go app.shutdownOnSignal(stopped)
 
 	err := app.Server.Run()
-	if err != nil {
+	if !errors.Is(err, http.ErrServerClosed) {
 		log.Fatal().Msgf("Failed to start server: %v", err)
 	}
-
+	<-stopped
 }
@@ -7,11 +7,15 @@ import (
 	securityService "github.com/GolangSpring/gospring/pkg/security/service"
 	"github.com/go-fuego/fuego"
 	"io"
+	"net"
 	"net/http"
 	"time"
 )
 
-const CookieKey = "token"
+const (
+	CookieKey              = "token"
+	TrustedDeviceCookieKey = "trusted_device"
+)
 
 func ReadRequestBody(request *http.Request) ([]byte, error) {
 	body := request.Body
@@ -38,6 +42,13 @@ func GetUserFromContext(c context.Context) (*securityService.UserClaims, error)
 	return user, nil
 }
 
+// GetTenantFromContext returns the tenant the request was authorized in, empty with the flat casbin
+// model or when no tenant was resolved.
+func GetTenantFromContext(c context.Context) string {
+	tenant, _ := c.Value("tenant").(string)
+	return tenant
+}
+
 func WriteTokenCookie[T any](c fuego.ContextWithBody[T], token string, expiration time.Duration) {
 	cookie := http.Cookie{
 		Name:     CookieKey,
@@ -49,3 +60,34 @@ func WriteTokenCookie[T any](c fuego.ContextWithBody[T], token string, expiratio
 
 	c.SetCookie(cookie)
 }
+
+func WriteTrustedDeviceCookie[T any](c fuego.ContextWithBody[T], deviceToken string, expiration time.Duration) {
+	cookie := http.Cookie{
+		Name:     TrustedDeviceCookieKey,
+		Value:    deviceToken,
+		Expires:  time.Now().Add(expiration),
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	}
+
+	c.SetCookie(cookie)
+}
+
+// ClientIp is the host part of the request remote address, deployments behind a proxy
+// should rewrite RemoteAddr from the forwarded headers before the security middlewares.
+func ClientIp(request *http.Request) string {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+	return host
+}
+
+func ReadTrustedDeviceCookie(request *http.Request) string {
+	cookie, err := request.Cookie(TrustedDeviceCookieKey)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
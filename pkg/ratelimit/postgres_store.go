@@ -0,0 +1,103 @@
+package ratelimit
+
+import (
+	"context"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+// RateLimitCounter persists the limiterState of a key for the postgres store.
+type RateLimitCounter struct {
+	LimitKey      string    `gorm:"type:varchar(255);primaryKey" json:"limit_key"`
+	Tokens        float64   `json:"tokens"`
+	WindowStart   time.Time `json:"window_start"`
+	Count         int       `json:"count"`
+	PreviousCount int       `json:"previous_count"`
+	// LastSeenAt is maintained by the limiter, not by gorm, a new row must start at the zero time
+	LastSeenAt time.Time `gorm:"index" json:"last_seen_at"`
+}
+
+func (counter *RateLimitCounter) state() *limiterState {
+	return &limiterState{
+		Tokens:        counter.Tokens,
+		WindowStart:   counter.WindowStart,
+		Count:         counter.Count,
+		PreviousCount: counter.PreviousCount,
+		UpdatedAt:     counter.LastSeenAt,
+	}
+}
+
+func (counter *RateLimitCounter) apply(state *limiterState) {
+	counter.Tokens = state.Tokens
+	counter.WindowStart = state.WindowStart
+	counter.Count = state.Count
+	counter.PreviousCount = state.PreviousCount
+	counter.LastSeenAt = state.UpdatedAt
+}
+
+var _ IRateLimitStore = (*PostgresStore)(nil)
+
+// PostgresStore shares counters between replicas, each request locks its counter rows
+// for the read-modify-write of the algorithms.
+type PostgresStore struct {
+	Engine *gorm.DB
+}
+
+func NewPostgresStore(engine *gorm.DB) *PostgresStore {
+	return &PostgresStore{
+		Engine: engine,
+	}
+}
+
+// Take locks the rows in key order, so concurrent requests matching the same rules cannot deadlock.
+func (store *PostgresStore) Take(ctx context.Context, limits []*Limit) ([]*Decision, error) {
+	var decisions []*Decision
+	err := store.Engine.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		keys := make([]string, len(limits))
+		created := make([]RateLimitCounter, len(limits))
+		for idx, limit := range limits {
+			keys[idx] = limit.Key
+			created[idx] = RateLimitCounter{LimitKey: limit.Key}
+		}
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&created).Error; err != nil {
+			return err
+		}
+		var locked []*RateLimitCounter
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("limit_key IN ?", keys).
+			Order("limit_key").
+			Find(&locked).Error
+		if err != nil {
+			return err
+		}
+
+		counters := make(map[string]*RateLimitCounter, len(locked))
+		for _, counter := range locked {
+			counters[counter.LimitKey] = counter
+		}
+		states := make([]*limiterState, len(limits))
+		for idx, limit := range limits {
+			states[idx] = counters[limit.Key].state()
+		}
+		decisions = takeAll(limits, states, time.Now())
+		if !decisions[len(decisions)-1].Allowed {
+			return nil
+		}
+		for idx, limit := range limits {
+			counter := counters[limit.Key]
+			counter.apply(states[idx])
+			if err := tx.Save(counter).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return decisions, err
+}
+
+func (store *PostgresStore) Cleanup(ctx context.Context, idleFor time.Duration) error {
+	return store.Engine.WithContext(ctx).
+		Where("last_seen_at < ?", time.Now().Add(-idleFor)).
+		Delete(&RateLimitCounter{}).Error
+}
@@ -0,0 +1,128 @@
+package ratelimit
+
+import (
+	"fmt"
+	"github.com/GolangSpring/gospring/application"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+type StoreKind string
+
+const (
+	StoreMemory   StoreKind = "memory"
+	StorePostgres StoreKind = "postgres"
+)
+
+type Algorithm string
+
+const (
+	AlgorithmTokenBucket   Algorithm = "token_bucket"
+	AlgorithmSlidingWindow Algorithm = "sliding_window"
+)
+
+type KeyKind string
+
+const (
+	KeyByIp     KeyKind = "ip"
+	KeyByUser   KeyKind = "user"
+	KeyByApiKey KeyKind = "api_key"
+	KeyByRoute  KeyKind = "route"
+)
+
+const DefaultApiKeyHeader = "X-API-Key"
+
+// Rule limits the requests whose path matches the Path regex and whose method is listed in Methods
+// (all methods when empty). Requests are counted per key: client ip, user id, api key, or one
+// shared counter for the whole route. Requests without a user or api key are counted per ip.
+type Rule struct {
+	Name         string    `yaml:"name" validate:"required"`
+	Path         string    `yaml:"path" validate:"required"`
+	Methods      []string  `yaml:"methods"`
+	Algorithm    Algorithm `yaml:"algorithm" validate:"omitempty,oneof=token_bucket sliding_window"`
+	Key          KeyKind   `yaml:"key" validate:"omitempty,oneof=ip user api_key route"`
+	ApiKeyHeader string    `yaml:"api_key_header"`
+	// Limit requests are allowed per PeriodSecond, a token bucket refills at that rate and holds up to Burst tokens
+	Limit        int `yaml:"limit" validate:"required,gt=0"`
+	PeriodSecond int `yaml:"period_second" validate:"required,gt=0"`
+	Burst        int `yaml:"burst"`
+
+	pathPattern *regexp.Regexp
+}
+
+func (rule *Rule) compile() error {
+	pattern, err := regexp.Compile(rule.Path)
+	if err != nil {
+		return fmt.Errorf("invalid path of rate limit rule %s: %w", rule.Name, err)
+	}
+	rule.pathPattern = pattern
+	return nil
+}
+
+func (rule *Rule) Matches(request *http.Request) bool {
+	if len(rule.Methods) > 0 && !slices.ContainsFunc(rule.Methods, func(method string) bool {
+		return strings.EqualFold(method, request.Method)
+	}) {
+		return false
+	}
+	return rule.pathPattern.MatchString(request.URL.Path)
+}
+
+func (rule *Rule) Period() time.Duration {
+	return time.Duration(rule.PeriodSecond) * time.Second
+}
+
+func (rule *Rule) GetAlgorithm() Algorithm {
+	if rule.Algorithm == "" {
+		return AlgorithmSlidingWindow
+	}
+	return rule.Algorithm
+}
+
+func (rule *Rule) GetKey() KeyKind {
+	if rule.Key == "" {
+		return KeyByIp
+	}
+	return rule.Key
+}
+
+func (rule *Rule) GetApiKeyHeader() string {
+	if rule.ApiKeyHeader == "" {
+		return DefaultApiKeyHeader
+	}
+	return rule.ApiKeyHeader
+}
+
+func (rule *Rule) GetBurst() int {
+	if rule.Burst <= 0 {
+		return rule.Limit
+	}
+	return rule.Burst
+}
+
+// Policy is the RateLimit-Policy header value of the rule, e.g. `100;w=60`.
+func (rule *Rule) Policy() string {
+	return fmt.Sprintf("%d;w=%d", rule.Limit, rule.PeriodSecond)
+}
+
+type RateLimitConfig struct {
+	RateLimit struct {
+		// Store keeps the counters, postgres shares them between replicas
+		Store StoreKind `yaml:"store" validate:"omitempty,oneof=memory postgres"`
+		Rules []*Rule   `yaml:"rules" validate:"dive"`
+	} `yaml:"rate_limit" validate:"required"`
+}
+
+func (config *RateLimitConfig) GetStore() StoreKind {
+	if config.RateLimit.Store == "" {
+		return StoreMemory
+	}
+	return config.RateLimit.Store
+}
+
+func MustNewRateLimitConfig(configPath string) *RateLimitConfig {
+	return application.MustNewConfigFromFile[RateLimitConfig](configPath)
+}
@@ -0,0 +1,53 @@
+package ratelimit
+
+import (
+	"github.com/GolangSpring/gospring/application"
+	"github.com/GolangSpring/gospring/pkg/postgres"
+	"github.com/rs/zerolog/log"
+	"slices"
+)
+
+var ContextName = "RateLimitApplicationContext"
+
+// MustNewRateLimitContext builds the limiter from the YAML rules and the rules declared by the
+// controllers of the given contexts. postgresContext is only needed for the postgres store.
+func MustNewRateLimitContext(config *RateLimitConfig, postgresContext *application.ApplicationContext, contexts ...*application.ApplicationContext) *application.ApplicationContext {
+	var store IRateLimitStore
+	switch config.GetStore() {
+	case StorePostgres:
+		if postgresContext == nil {
+			log.Fatal().Msg("Postgres rate limit store requires the Postgres context")
+		}
+		service, err := application.GetServiceFromContext[*postgres.PostgresEngineService](postgresContext)
+		if err != nil {
+			log.Fatal().Msgf("Failed to get Postgres engine service from context: %v", err)
+		}
+		if err := service.MigrateModels(RateLimitCounter{}); err != nil {
+			log.Fatal().Msgf("Failed to migrate models: %v", err)
+		}
+		store = NewPostgresStore(service.Engine)
+	default:
+		store = NewMemoryStore()
+	}
+
+	rateLimitService := NewRateLimitService(store)
+	rules := slices.Clone(config.RateLimit.Rules)
+	for _, _context := range contexts {
+		for _, controller := range _context.Controllers {
+			if limited, ok := controller.(IRateLimitedController); ok {
+				rules = append(rules, limited.RateLimits()...)
+			}
+		}
+	}
+	for _, rule := range rules {
+		if err := rateLimitService.RegisterRule(rule); err != nil {
+			log.Fatal().Msgf("Failed to register rate limit: %v", err)
+		}
+	}
+
+	return &application.ApplicationContext{
+		Name:        ContextName,
+		Services:    []application.IService{rateLimitService},
+		Controllers: []application.IController{NewRateLimitController(rateLimitService)},
+	}
+}
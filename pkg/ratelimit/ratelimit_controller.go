@@ -0,0 +1,66 @@
+package ratelimit
+
+import (
+	"github.com/GolangSpring/gospring/application"
+	"github.com/go-fuego/fuego"
+	"github.com/rs/zerolog/log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var _ application.IController = (*RateLimitController)(nil)
+
+// RateLimitController only contributes the limiter middleware. User keyed rules need the
+// user claims, so the rate limit context has to be injected after the security context.
+type RateLimitController struct {
+	RateLimitService IRateLimitService
+}
+
+func NewRateLimitController(rateLimitService IRateLimitService) *RateLimitController {
+	return &RateLimitController{
+		RateLimitService: rateLimitService,
+	}
+}
+
+func (controller *RateLimitController) Routes(server *fuego.Server) {}
+
+func (controller *RateLimitController) Middlewares() []func(next http.Handler) http.Handler {
+	return []func(next http.Handler) http.Handler{
+		controller.Middleware,
+	}
+}
+
+func ceilSeconds(duration time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(duration.Seconds())))
+}
+
+func (controller *RateLimitController) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		decision, rule, err := controller.RateLimitService.Allow(r)
+		if err != nil {
+			// A broken store must not take the API down with it
+			log.Error().Msgf("Rate limit failed, letting the request through: %v", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if decision == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		header := w.Header()
+		header.Set("RateLimit-Policy", rule.Policy())
+		header.Set("RateLimit-Limit", strconv.Itoa(decision.Limit))
+		header.Set("RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+		header.Set("RateLimit-Reset", ceilSeconds(decision.Reset))
+
+		if !decision.Allowed {
+			header.Set("Retry-After", ceilSeconds(decision.RetryAfter))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
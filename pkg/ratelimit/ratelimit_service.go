@@ -0,0 +1,152 @@
+package ratelimit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/GolangSpring/gospring/application"
+	"github.com/GolangSpring/gospring/helper"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"time"
+)
+
+const (
+	cleanupInterval = time.Minute
+	minimumIdleTime = 10 * time.Minute
+)
+
+// IRateLimitedController lets a controller declare limits for its own routes, they are
+// registered by MustNewRateLimitContext next to the rules from the YAML config.
+type IRateLimitedController interface {
+	RateLimits() []*Rule
+}
+
+type IRateLimitService interface {
+	RegisterRule(rule *Rule) error
+	Allow(request *http.Request) (*Decision, *Rule, error)
+}
+
+var _ application.IService = (*RateLimitService)(nil)
+var _ IRateLimitService = (*RateLimitService)(nil)
+
+type RateLimitService struct {
+	Store IRateLimitStore
+	Rules []*Rule
+
+	cancel context.CancelFunc
+}
+
+func NewRateLimitService(store IRateLimitStore) *RateLimitService {
+	return &RateLimitService{
+		Store: store,
+		Rules: []*Rule{},
+	}
+}
+
+func (service *RateLimitService) RegisterRule(rule *Rule) error {
+	if rule.Limit <= 0 || rule.PeriodSecond <= 0 {
+		return fmt.Errorf("rate limit rule %s needs a positive limit and period", rule.Name)
+	}
+	if err := rule.compile(); err != nil {
+		return err
+	}
+	log.Info().Msgf("Registering rate limit %s: %s per %s on %s", rule.Name, rule.Policy(), rule.GetKey(), rule.Path)
+	service.Rules = append(service.Rules, rule)
+	return nil
+}
+
+// PostConstruct starts dropping counters that have been idle for longer than any rule period.
+func (service *RateLimitService) PostConstruct() {
+	ctx, cancel := context.WithCancel(context.Background())
+	service.cancel = cancel
+
+	idleFor := minimumIdleTime
+	for _, rule := range service.Rules {
+		idleFor = max(idleFor, 2*rule.Period())
+	}
+
+	go func() {
+		ticker := time.NewTicker(cleanupInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := service.Store.Cleanup(ctx, idleFor); err != nil && ctx.Err() == nil {
+					log.Warn().Msgf("Failed to clean up rate limit counters: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+func (service *RateLimitService) Stop() {
+	if service.cancel != nil {
+		service.cancel()
+	}
+}
+
+func hashApiKey(apiKey string) string {
+	digest := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(digest[:16])
+}
+
+// requestKey identifies the counter of the request, requests lacking the user or api key fall back to the ip.
+func (service *RateLimitService) requestKey(rule *Rule, request *http.Request) string {
+	switch rule.GetKey() {
+	case KeyByRoute:
+		return rule.Name + ":route"
+	case KeyByUser:
+		if user, err := helper.GetUserFromContext(request.Context()); err == nil {
+			return fmt.Sprintf("%s:user:%d", rule.Name, user.ID)
+		}
+	case KeyByApiKey:
+		// Only a digest is stored, the counters must not leak the keys
+		if apiKey := request.Header.Get(rule.GetApiKeyHeader()); apiKey != "" {
+			return rule.Name + ":api_key:" + hashApiKey(apiKey)
+		}
+	}
+	return rule.Name + ":ip:" + helper.ClientIp(request)
+}
+
+// Allow checks the request against every matching rule and returns the refusing or else the most
+// restrictive decision, a nil decision means no rule applies. A refused request counts against no
+// rule, so it does not use up the quota of the rules that would have allowed it.
+func (service *RateLimitService) Allow(request *http.Request) (*Decision, *Rule, error) {
+	var rules []*Rule
+	var limits []*Limit
+	for _, rule := range service.Rules {
+		if !rule.Matches(request) {
+			continue
+		}
+		rules = append(rules, rule)
+		limits = append(limits, &Limit{
+			Key:       service.requestKey(rule, request),
+			Algorithm: rule.GetAlgorithm(),
+			Capacity:  rule.GetBurst(),
+			Limit:     rule.Limit,
+			Period:    rule.Period(),
+		})
+	}
+	if len(limits) == 0 {
+		return nil, nil, nil
+	}
+
+	decisions, err := service.Store.Take(request.Context(), limits)
+	if err != nil {
+		return nil, nil, err
+	}
+	if last := len(decisions) - 1; !decisions[last].Allowed {
+		return decisions[last], rules[last], nil
+	}
+	decision, decisionRule := decisions[0], rules[0]
+	for idx, ruleDecision := range decisions {
+		if ruleDecision.Remaining < decision.Remaining {
+			decision, decisionRule = ruleDecision, rules[idx]
+		}
+	}
+	return decision, decisionRule, nil
+}
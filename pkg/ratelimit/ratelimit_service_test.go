@@ -0,0 +1,73 @@
+package ratelimit
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestRateLimitService(t *testing.T, rules ...*Rule) *RateLimitService {
+	service := NewRateLimitService(NewMemoryStore())
+	for _, rule := range rules {
+		if err := service.RegisterRule(rule); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	return service
+}
+
+func TestAllowRefusedRequestCountsAgainstNoRule(t *testing.T) {
+	for _, algorithm := range []Algorithm{AlgorithmSlidingWindow, AlgorithmTokenBucket} {
+		t.Run(string(algorithm), func(t *testing.T) {
+			wide := &Rule{Name: "wide", Path: "^/api/", Algorithm: algorithm, Limit: 3, PeriodSecond: 60}
+			narrow := &Rule{Name: "narrow", Path: "^/api/login$", Algorithm: algorithm, Limit: 1, PeriodSecond: 60}
+			service := newTestRateLimitService(t, wide, narrow)
+
+			for attempt := 0; attempt < 3; attempt++ {
+				decision, rule, err := service.Allow(httptest.NewRequest("POST", "/api/login", nil))
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if allowed := attempt == 0; decision.Allowed != allowed || rule != narrow {
+					t.Fatalf("attempt %d: expected allowed %v by narrow, got %v by %s", attempt, allowed, decision.Allowed, rule.Name)
+				}
+			}
+
+			// Only the allowed login used up the quota of the wide rule
+			for attempt := 0; attempt < 2; attempt++ {
+				decision, _, err := service.Allow(httptest.NewRequest("GET", "/api/users", nil))
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if !decision.Allowed {
+					t.Fatalf("attempt %d: expected the wide rule to allow the request", attempt)
+				}
+			}
+			decision, _, err := service.Allow(httptest.NewRequest("GET", "/api/users", nil))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if decision.Allowed {
+				t.Fatal("expected the wide rule to be used up")
+			}
+		})
+	}
+}
+
+func TestAllowMostRestrictiveDecision(t *testing.T) {
+	wide := &Rule{Name: "wide", Path: "^/api/", Limit: 10, PeriodSecond: 60}
+	narrow := &Rule{Name: "narrow", Path: "^/api/login$", Limit: 5, PeriodSecond: 60}
+	service := newTestRateLimitService(t, wide, narrow)
+
+	decision, rule, err := service.Allow(httptest.NewRequest("POST", "/api/login", nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rule != narrow || decision.Remaining != 4 {
+		t.Fatalf("expected 4 remaining on narrow, got %d on %s", decision.Remaining, rule.Name)
+	}
+
+	decision, rule, err = service.Allow(httptest.NewRequest("GET", "/other", nil))
+	if err != nil || decision != nil || rule != nil {
+		t.Fatalf("expected no decision, got %v, %v, %v", decision, rule, err)
+	}
+}
@@ -0,0 +1,178 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// Decision is the outcome of counting one request against a rule.
+type Decision struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is the time until the quota is fully available again
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// Limit is the counter of one rule a request is checked against.
+type Limit struct {
+	Key       string
+	Algorithm Algorithm
+	// Capacity is the bucket size of the token bucket, the sliding window ignores it
+	Capacity int
+	Limit    int
+	Period   time.Duration
+}
+
+func (limit *Limit) take(state *limiterState, now time.Time) *Decision {
+	if limit.Algorithm == AlgorithmTokenBucket {
+		return state.takeToken(limit.Capacity, limit.Period, limit.Limit, now)
+	}
+	return state.slideWindow(limit.Limit, limit.Period, now)
+}
+
+type IRateLimitStore interface {
+	// Take checks the request against the limits in order and stops at the first one refusing it,
+	// the request only counts, against all of them, when every limit allows it.
+	Take(ctx context.Context, limits []*Limit) ([]*Decision, error)
+	Cleanup(ctx context.Context, idleFor time.Duration) error
+}
+
+// takeAll runs the limits on copies of their states, the states are only updated when every
+// limit allows the request. The decisions end at the first refusing limit.
+func takeAll(limits []*Limit, states []*limiterState, now time.Time) []*Decision {
+	decisions := make([]*Decision, 0, len(limits))
+	taken := make([]limiterState, len(limits))
+	for idx, limit := range limits {
+		taken[idx] = *states[idx]
+		decision := limit.take(&taken[idx], now)
+		decisions = append(decisions, decision)
+		if !decision.Allowed {
+			return decisions
+		}
+	}
+	for idx, state := range states {
+		*state = taken[idx]
+	}
+	return decisions
+}
+
+// limiterState is the counter kept for a key, shared by both algorithms and both stores.
+type limiterState struct {
+	Tokens        float64
+	WindowStart   time.Time
+	Count         int
+	PreviousCount int
+	UpdatedAt     time.Time
+}
+
+// takeToken refills limit tokens per refillPeriod up to capacity, then takes one if available.
+func (state *limiterState) takeToken(capacity int, refillPeriod time.Duration, limit int, now time.Time) *Decision {
+	ratePerSecond := float64(limit) / refillPeriod.Seconds()
+	if state.UpdatedAt.IsZero() {
+		state.Tokens = float64(capacity)
+	} else {
+		elapsed := now.Sub(state.UpdatedAt).Seconds()
+		state.Tokens = math.Min(float64(capacity), state.Tokens+elapsed*ratePerSecond)
+	}
+	state.UpdatedAt = now
+
+	decision := &Decision{Limit: capacity}
+	if state.Tokens >= 1 {
+		state.Tokens--
+		decision.Allowed = true
+	} else {
+		decision.RetryAfter = secondsDuration((1 - state.Tokens) / ratePerSecond)
+	}
+	decision.Remaining = int(math.Floor(state.Tokens))
+	decision.Reset = secondsDuration((float64(capacity) - state.Tokens) / ratePerSecond)
+	return decision
+}
+
+// slideWindow approximates a sliding window with the counts of the current and previous
+// fixed windows, weighting the previous one by how much of it still overlaps.
+func (state *limiterState) slideWindow(limit int, window time.Duration, now time.Time) *Decision {
+	currentStart := now.Truncate(window)
+	switch {
+	case state.WindowStart.Equal(currentStart):
+	case state.WindowStart.Add(window).Equal(currentStart):
+		state.PreviousCount, state.Count = state.Count, 0
+	default:
+		state.PreviousCount, state.Count = 0, 0
+	}
+	state.WindowStart = currentStart
+	state.UpdatedAt = now
+
+	elapsed := now.Sub(currentStart)
+	previousWeight := 1 - elapsed.Seconds()/window.Seconds()
+	estimated := float64(state.PreviousCount)*previousWeight + float64(state.Count)
+
+	decision := &Decision{Limit: limit, Reset: window - elapsed}
+	if estimated+1 <= float64(limit) {
+		state.Count++
+		estimated++
+		decision.Allowed = true
+	} else {
+		decision.RetryAfter = window - elapsed
+		if state.PreviousCount > 0 {
+			// Wait until enough of the previous window has slid out to make room for one request
+			excess := estimated + 1 - float64(limit)
+			retry := secondsDuration(excess / float64(state.PreviousCount) * window.Seconds())
+			decision.RetryAfter = min(decision.RetryAfter, retry)
+		}
+	}
+	decision.Remaining = max(0, limit-int(math.Ceil(estimated)))
+	return decision
+}
+
+func secondsDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+var _ IRateLimitStore = (*MemoryStore)(nil)
+
+// MemoryStore keeps counters in process, each replica then enforces its own limits.
+type MemoryStore struct {
+	states map[string]*limiterState
+	lock   sync.Mutex
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		states: map[string]*limiterState{},
+	}
+}
+
+func (store *MemoryStore) state(key string) *limiterState {
+	state, ok := store.states[key]
+	if !ok {
+		state = &limiterState{}
+		store.states[key] = state
+	}
+	return state
+}
+
+func (store *MemoryStore) Take(ctx context.Context, limits []*Limit) ([]*Decision, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	states := make([]*limiterState, len(limits))
+	for idx, limit := range limits {
+		states[idx] = store.state(limit.Key)
+	}
+	return takeAll(limits, states, time.Now()), nil
+}
+
+func (store *MemoryStore) Cleanup(ctx context.Context, idleFor time.Duration) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	threshold := time.Now().Add(-idleFor)
+	for key, state := range store.states {
+		if state.UpdatedAt.Before(threshold) {
+			delete(store.states, key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package controller
+
+import (
+	"github.com/GolangSpring/gospring/application"
+	"github.com/GolangSpring/gospring/helper"
+	"github.com/GolangSpring/gospring/pkg/ratelimit"
+	"github.com/GolangSpring/gospring/pkg/security/middleware"
+	"github.com/GolangSpring/gospring/pkg/security/service"
+	"github.com/go-fuego/fuego"
+	"net/http"
+	"regexp"
+)
+
+type ResetPasswordRequestBody struct {
+	Email string `json:"email" validate:"required"`
+}
+
+type TokenBody struct {
+	Token string `json:"token" validate:"required"`
+}
+
+type ResetPasswordConfirmBody struct {
+	Token             string `json:"token" validate:"required"`
+	OtpCode           string `json:"otp_code" validate:"required"`
+	NewPassword       string `json:"new_password" validate:"required"`
+	ConfirmedPassword string `json:"confirmed_password" validate:"required"`
+}
+
+type VerifyEmailBody struct {
+	Token   string `json:"token" validate:"required"`
+	OtpCode string `json:"otp_code" validate:"required"`
+}
+
+type PushVerificationBody struct {
+	UserID uint `json:"user_id" validate:"required"`
+}
+
+type TokenResponse struct {
+	Token string `json:"token"`
+}
+
+const (
+	RequestResetPasswordRoute = "/api-public/reset-password/request"
+	SendResetEmailRoute       = "/api-public/reset-password/send-email"
+	ConfirmResetPasswordRoute = "/api-public/reset-password/confirm"
+	VerifyEmailRoute          = "/api-public/verify-email"
+	SendVerificationRoute     = "/api-private/send-verification"
+)
+
+var _ application.IController = (*AccountController)(nil)
+var _ ratelimit.IRateLimitedController = (*AccountController)(nil)
+
+type AccountController struct {
+	UserVerificationService  *service.UserVerificationService
+	UserResetPasswordService *service.UserResetPasswordService
+	AdminRole                string
+}
+
+func NewAccountController(
+	userVerificationService *service.UserVerificationService,
+	userResetPasswordService *service.UserResetPasswordService,
+	adminRole string,
+) *AccountController {
+	return &AccountController{
+		UserVerificationService:  userVerificationService,
+		UserResetPasswordService: userResetPasswordService,
+		AdminRole:                adminRole,
+	}
+}
+
+// RateLimits caps the routes sending emails or checking codes, they only apply when the rate limit context is used.
+func (controller *AccountController) RateLimits() []*ratelimit.Rule {
+	return []*ratelimit.Rule{
+		{
+			Name:         "reset-password-email",
+			Path:         "^(" + regexp.QuoteMeta(RequestResetPasswordRoute) + "|" + regexp.QuoteMeta(SendResetEmailRoute) + ")$",
+			Methods:      []string{http.MethodPost},
+			Key:          ratelimit.KeyByIp,
+			Limit:        5,
+			PeriodSecond: 600,
+		},
+		{
+			// Each code allows service.MaxOtpAttempts guesses, this bounds how many codes can be tried
+			Name:         "otp-confirm",
+			Path:         "^(" + regexp.QuoteMeta(ConfirmResetPasswordRoute) + "|" + regexp.QuoteMeta(VerifyEmailRoute) + ")$",
+			Methods:      []string{http.MethodPost},
+			Key:          ratelimit.KeyByIp,
+			Limit:        10,
+			PeriodSecond: 600,
+		},
+		{
+			Name:         "verification-email",
+			Path:         "^" + regexp.QuoteMeta(SendVerificationRoute) + "$",
+			Methods:      []string{http.MethodPost},
+			Key:          ratelimit.KeyByUser,
+			Limit:        3,
+			PeriodSecond: 600,
+		},
+	}
+}
+
+func (controller *AccountController) Routes(server *fuego.Server) {
+	fuego.Post(server, RequestResetPasswordRoute, controller.RequestResetPassword, middleware.PublicRoute())
+	fuego.Post(server, SendResetEmailRoute, controller.SendResetPasswordEmail, middleware.PublicRoute())
+	fuego.Post(server, ConfirmResetPasswordRoute, controller.ConfirmResetPassword, middleware.PublicRoute())
+
+	fuego.Post(server, SendVerificationRoute, controller.SendVerification)
+	fuego.Post(server, VerifyEmailRoute, controller.VerifyEmail, middleware.PublicRoute())
+
+	fuego.Post(server, "/api-admin/push-verification", controller.PushVerification, middleware.RequireRoles(controller.AdminRole))
+}
+
+func (controller *AccountController) Middlewares() []func(next http.Handler) http.Handler {
+	return []func(next http.Handler) http.Handler{}
+}
+
+func (controller *AccountController) RequestResetPassword(c fuego.ContextWithBody[ResetPasswordRequestBody]) (*TokenResponse, error) {
+	body, err := c.Body()
+	if err != nil {
+		return nil, err
+	}
+	token := controller.UserResetPasswordService.IssueResetPasswordToken(body.Email)
+	return &TokenResponse{Token: token}, nil
+}
+
+func (controller *AccountController) SendResetPasswordEmail(c fuego.ContextWithBody[TokenBody]) (*TokenResponse, error) {
+	body, err := c.Body()
+	if err != nil {
+		return nil, err
+	}
+	token, err := controller.UserResetPasswordService.SendResetPasswordEmail(c.Request().Context(), body.Token)
+	if err != nil {
+		return nil, fuego.HTTPError{Detail: err.Error(), Status: http.StatusBadRequest}
+	}
+	return &TokenResponse{Token: token}, nil
+}
+
+func (controller *AccountController) ConfirmResetPassword(c fuego.ContextWithBody[ResetPasswordConfirmBody]) (*http.Response, error) {
+	body, err := c.Body()
+	if err != nil {
+		return nil, err
+	}
+	err = controller.UserResetPasswordService.ResetPassword(
+		c.Request().Context(),
+		body.Token,
+		body.OtpCode,
+		body.NewPassword,
+		body.ConfirmedPassword,
+	)
+	if err != nil {
+		return nil, newHttpError(err, http.StatusBadRequest)
+	}
+	return &http.Response{StatusCode: http.StatusNoContent}, nil
+}
+
+func (controller *AccountController) SendVerification(c fuego.ContextNoBody) (*TokenResponse, error) {
+	user, err := helper.GetUserFromContext(c.Request().Context())
+	if err != nil {
+		return nil, fuego.HTTPError{Detail: err.Error(), Status: http.StatusUnauthorized}
+	}
+	token, err := controller.UserVerificationService.StartVerification(c.Request().Context(), user.ID)
+	if err != nil {
+		return nil, fuego.HTTPError{Detail: err.Error(), Status: http.StatusBadRequest}
+	}
+	return &TokenResponse{Token: token}, nil
+}
+
+func (controller *AccountController) VerifyEmail(c fuego.ContextWithBody[VerifyEmailBody]) (*http.Response, error) {
+	body, err := c.Body()
+	if err != nil {
+		return nil, err
+	}
+	if err := controller.UserVerificationService.VerifyEmail(body.Token, body.OtpCode); err != nil {
+		return nil, fuego.HTTPError{Detail: err.Error(), Status: http.StatusBadRequest}
+	}
+	return &http.Response{StatusCode: http.StatusNoContent}, nil
+}
+
+func (controller *AccountController) PushVerification(c fuego.ContextWithBody[PushVerificationBody]) (*http.Response, error) {
+	body, err := c.Body()
+	if err != nil {
+		return nil, err
+	}
+	if err := controller.UserVerificationService.SendVerificationEmailByUserID(c.Request().Context(), body.UserID, true); err != nil {
+		return nil, fuego.HTTPError{Detail: err.Error(), Status: http.StatusBadRequest}
+	}
+	return &http.Response{StatusCode: http.StatusNoContent}, nil
+}
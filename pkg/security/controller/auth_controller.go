@@ -1,14 +1,17 @@
 package controller
 
 import (
-	"fmt"
+	"errors"
 	"github.com/GolangSpring/gospring/application"
 	"github.com/GolangSpring/gospring/helper"
 	"github.com/GolangSpring/gospring/pkg/security/middleware"
 	"github.com/GolangSpring/gospring/pkg/security/repository"
 	"github.com/GolangSpring/gospring/pkg/security/service"
 	"github.com/go-fuego/fuego"
+	"github.com/rs/zerolog/log"
+	"math"
 	"net/http"
+	"strconv"
 	"time"
 )
 
@@ -18,75 +21,145 @@ type LoginBody struct {
 	Password string `json:"password" validate:"required"`
 }
 
+// UserCredentials user names are printable ascii without spaces or "@", so they never read as an email.
 type UserCredentials struct {
-	UserName string `json:"user_name" validate:"required"`
-	Email    string `json:"email" validate:"required"`
+	UserName string `json:"user_name" validate:"required,min=3,max=32,printascii,excludesall=@ "`
+	Email    string `json:"email" validate:"required,email,max=100"`
 	Password string `json:"password" validate:"required"`
 }
 
+type LoginResponse struct {
+	Token              string            `json:"token,omitempty"`
+	MfaPending         bool              `json:"mfa_pending"`
+	MfaMethod          service.MfaMethod `json:"mfa_method,omitempty"`
+	MfaToken           string            `json:"mfa_token,omitempty"`
+	EnrollmentRequired bool              `json:"enrollment_required,omitempty"`
+}
+
+// RegisterResponse is the new user, with the token to submit alongside the emailed code when
+// the verification email was sent on registration.
+type RegisterResponse struct {
+	*repository.User
+	VerificationToken string `json:"verification_token,omitempty"`
+}
+
 type RoleAssignBody struct {
 	UserID uint     `json:"user_id" validate:"required"`
 	Roles  []string `json:"roles" validate:"required"`
 }
 
+// TenantRoleAssignBody replaces the roles of the user in the tenant of the path.
+type TenantRoleAssignBody struct {
+	UserID uint     `json:"user_id" validate:"required"`
+	Roles  []string `json:"roles" validate:"required"`
+}
+
 var _ application.IController = (*AuthController)(nil)
 
 type AuthController struct {
-	AuthService   service.IAuthService
-	CasbinService *service.CasbinService
+	AuthService             service.IAuthService
+	CasbinService           *service.CasbinService
+	UserVerificationService *service.UserVerificationService
+	AdminRole               string
 }
 
-func NewAuthController(authService service.IAuthService, casbinService *service.CasbinService) *AuthController {
+func NewAuthController(
+	authService service.IAuthService,
+	casbinService *service.CasbinService,
+	userVerificationService *service.UserVerificationService,
+	adminRole string,
+) *AuthController {
 	return &AuthController{
-		AuthService:   authService,
-		CasbinService: casbinService,
+		AuthService:             authService,
+		CasbinService:           casbinService,
+		UserVerificationService: userVerificationService,
+		AdminRole:               adminRole,
 	}
 }
 
 func (controller *AuthController) Routes(server *fuego.Server) {
-	fuego.Post(server, "/api-admin/assign-roles", controller.AssignRoles)
-	fuego.Get(server, "/api-admin/all-roles", controller.AllRoles)
+	adminOnly := middleware.RequireRoles(controller.AdminRole)
+	fuego.Post(server, "/api-admin/assign-roles", controller.AssignRoles, adminOnly)
+	fuego.Post(server, "/api-admin/tenants/{tenant}/assign-roles", controller.AssignTenantRoles, adminOnly)
+	fuego.Get(server, "/api-admin/all-roles", controller.AllRoles, adminOnly)
+	fuego.Post(server, "/api-admin/users/{id}/unlock", controller.UnlockUser, adminOnly)
 
 	fuego.Get(server, "/api-private/current-user", controller.CurrentUser)
 	fuego.Get(server, "/api-private/logout", controller.Logout)
 
-	fuego.Post(server, "/api-public/login", controller.Login)
-	fuego.Post(server, "/api-public/register", controller.RegisterUser)
+	fuego.Post(server, "/api-public/login", controller.Login, middleware.PublicRoute())
+	fuego.Post(server, "/api-public/register", controller.RegisterUser, middleware.PublicRoute())
 }
 
 func (controller *AuthController) Health(c fuego.ContextNoBody) (string, error) {
 
-	return fmt.Sprintf("%s, ok"), nil
+	return "ok", nil
 }
 
-func (controller *AuthController) Login(c fuego.ContextWithBody[LoginBody]) (*http.Response, error) {
+func (controller *AuthController) Login(c fuego.ContextWithBody[LoginBody]) (*LoginResponse, error) {
 	loginBody, err := c.Body()
 	if err != nil {
 		return nil, err
 	}
 	var loginErr error
-	var token string
+	var result *service.LoginResult
+	metadata := &service.LoginMetadata{
+		TrustedDeviceToken: helper.ReadTrustedDeviceCookie(c.Request()),
+		IpAddress:          helper.ClientIp(c.Request()),
+	}
 	if len(loginBody.Email) != 0 {
-		token, loginErr = controller.AuthService.LoginWithEmail(c.Request().Context(), loginBody.Email, loginBody.Password)
+		result, loginErr = controller.AuthService.LoginWithEmail(c.Request().Context(), loginBody.Email, loginBody.Password, metadata)
 	}
 	if len(loginBody.UserName) != 0 {
-		token, loginErr = controller.AuthService.LoginWithUserName(c.Request().Context(), loginBody.UserName, loginBody.Password)
+		result, loginErr = controller.AuthService.LoginWithUserName(c.Request().Context(), loginBody.UserName, loginBody.Password, metadata)
 	}
 
+	var throttleErr *service.LoginThrottleError
+	if errors.As(loginErr, &throttleErr) {
+		c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(throttleErr.RetryAfter.Seconds()))))
+		return nil, fuego.HTTPError{
+			Detail: throttleErr.Error(),
+			Status: http.StatusTooManyRequests,
+		}
+	}
+	var statusErr *service.AccountStatusError
+	if errors.As(loginErr, &statusErr) {
+		return nil, fuego.HTTPError{
+			Err:    loginErr,
+			Detail: statusErr.Error(),
+			Status: http.StatusForbidden,
+		}
+	}
 	if loginErr != nil {
 		return nil, fuego.HTTPError{
 			Detail: loginErr.Error(),
 			Status: http.StatusBadRequest,
 		}
 	}
+	if result == nil {
+		return nil, fuego.HTTPError{
+			Detail: "Either email or user_name is required",
+			Status: http.StatusBadRequest,
+		}
+	}
+
+	// The second factor is exchanged for the session token on /api-public/mfa/{method}/verify
+	if result.MfaPending {
+		return &LoginResponse{
+			MfaPending:         true,
+			MfaMethod:          result.MfaMethod,
+			MfaToken:           result.Token,
+			EnrollmentRequired: result.EnrollmentRequired,
+		}, nil
+	}
 
 	duration := time.Duration(24) * time.Hour
-	helper.WriteTokenCookie(c, token, duration)
+	helper.WriteTokenCookie(c, result.Token, duration)
 
-	return &http.Response{StatusCode: http.StatusNoContent, Status: token}, nil
+	return &LoginResponse{Token: result.Token}, nil
 }
 
-func (controller *AuthController) RegisterUser(c fuego.ContextWithBody[UserCredentials]) (any, error) {
+func (controller *AuthController) RegisterUser(c fuego.ContextWithBody[UserCredentials]) (*RegisterResponse, error) {
 	credentials, err := c.Body()
 	if err != nil {
 		return nil, err
@@ -94,12 +167,15 @@ func (controller *AuthController) RegisterUser(c fuego.ContextWithBody[UserCrede
 
 	user, err := controller.AuthService.RegisterUser(c.Request().Context(), credentials.UserName, credentials.Email, credentials.Password)
 	if err != nil {
-		return nil, fuego.HTTPError{
-			Detail: err.Error(),
-			Status: http.StatusBadRequest,
-		}
+		return nil, newHttpError(err, http.StatusBadRequest)
 	}
-	return user, nil
+
+	// The account exists either way, a failed email is sent again from /api-private/send-verification
+	token, err := controller.UserVerificationService.SendRegistrationVerification(c.Request().Context(), user.ID)
+	if err != nil {
+		log.Warn().Msgf("Failed to send verification email to new user %d: %v", user.ID, err)
+	}
+	return &RegisterResponse{User: user, VerificationToken: token}, nil
 }
 
 func (controller *AuthController) Middlewares() []func(next http.Handler) http.Handler {
@@ -129,6 +205,33 @@ func (controller *AuthController) AssignRoles(c fuego.ContextWithBody[RoleAssign
 	return user, nil
 }
 
+// AssignTenantRoles answers the roles of the user in every tenant once the tenant roles are replaced.
+func (controller *AuthController) AssignTenantRoles(c fuego.ContextWithBody[TenantRoleAssignBody]) (map[string][]string, error) {
+	rolesBody, err := c.Body()
+	if err != nil {
+		return nil, err
+	}
+	tenantRoles, err := controller.AuthService.AssignTenantRoles(c.Request().Context(), rolesBody.UserID, c.PathParam("tenant"), rolesBody.Roles)
+	if err != nil {
+		return nil, newHttpError(err, http.StatusBadRequest)
+	}
+	return tenantRoles, nil
+}
+
+func (controller *AuthController) UnlockUser(c fuego.ContextNoBody) (*http.Response, error) {
+	userID, err := parseUintPathParam(c.PathParam("id"))
+	if err != nil {
+		return nil, err
+	}
+	if err := controller.AuthService.UnlockUser(c.Request().Context(), userID); err != nil {
+		return nil, fuego.HTTPError{
+			Detail: err.Error(),
+			Status: http.StatusNotFound,
+		}
+	}
+	return &http.Response{StatusCode: http.StatusNoContent}, nil
+}
+
 func (controller *AuthController) Logout(c fuego.ContextNoBody) (*http.Response, error) {
 	helper.WriteTokenCookie(c, "", -1)
 	return &http.Response{StatusCode: http.StatusNoContent}, nil
@@ -1,29 +1,74 @@
 package controller
 
 import (
+	"errors"
 	"github.com/GolangSpring/gospring/application"
 	"github.com/GolangSpring/gospring/pkg/security/middleware"
 	"github.com/GolangSpring/gospring/pkg/security/service"
 	"github.com/go-fuego/fuego"
+	"github.com/go-fuego/fuego/option"
+	"github.com/rs/zerolog/log"
 
 	"net/http"
 )
 
+// maxPolicyImportBytes bounds the CSV accepted by the policy import
+const maxPolicyImportBytes = 1 << 20
+
+type PolicyUpdateBody struct {
+	Old service.Policy `json:"old" validate:"required"`
+	New service.Policy `json:"new" validate:"required"`
+}
+
+type RolePolicyUpdateBody struct {
+	Old service.RolePolicy `json:"old" validate:"required"`
+	New service.RolePolicy `json:"new" validate:"required"`
+}
+
+// PolicyCheckBody asks whether the subject, a role or "user:{id}", may do the action on the path,
+// within the tenant Domain with the domain model.
+type PolicyCheckBody struct {
+	Subject string `json:"subject" validate:"required"`
+	Domain  string `json:"domain"`
+	Object  string `json:"object" validate:"required"`
+	Action  string `json:"action" validate:"required"`
+}
+
 var _ application.IController = (*CasbinController)(nil)
 
 type CasbinController struct {
 	AuthService   service.IAuthService
 	CasbinService *service.CasbinService
+	// AdminRole is the role the admin bootstrap gives, the policy routes only allow it
+	AdminRole string
 }
 
-func NewCasbinController(casbinService *service.CasbinService, authService service.IAuthService) *CasbinController {
+func NewCasbinController(casbinService *service.CasbinService, authService service.IAuthService, adminRole string) *CasbinController {
 	return &CasbinController{
 		AuthService:   authService,
 		CasbinService: casbinService,
+		AdminRole:     adminRole,
 	}
 }
 
-func (controller *CasbinController) Routes(server *fuego.Server) {}
+func (controller *CasbinController) Routes(server *fuego.Server) {
+	adminOnly := middleware.RequireRoles(controller.AdminRole)
+	subjectFilter := option.Query("subject", "Only the policies of the subject")
+	fuego.Get(server, "/api-admin/casbin/policies", controller.AllPolicies, subjectFilter, adminOnly)
+	fuego.Post(server, "/api-admin/casbin/policies", controller.AddPolicy, adminOnly)
+	fuego.Put(server, "/api-admin/casbin/policies", controller.UpdatePolicy, adminOnly)
+	fuego.Delete(server, "/api-admin/casbin/policies", controller.RemovePolicy, adminOnly)
+
+	fuego.Get(server, "/api-admin/casbin/roles", controller.AllRolePolicies, subjectFilter, adminOnly)
+	fuego.Post(server, "/api-admin/casbin/roles", controller.AddRolePolicy, adminOnly)
+	fuego.Put(server, "/api-admin/casbin/roles", controller.UpdateRolePolicy, adminOnly)
+	fuego.Delete(server, "/api-admin/casbin/roles", controller.RemoveRolePolicy, adminOnly)
+
+	fuego.GetStd(server, "/api-admin/casbin/export", controller.ExportPolicies, adminOnly)
+	fuego.Post(server, "/api-admin/casbin/import", controller.ImportPolicies, adminOnly)
+	fuego.Post(server, "/api-admin/casbin/check", controller.CheckPermission, adminOnly)
+	fuego.Get(server, "/api-admin/casbin/routes", controller.RoutePermissions, adminOnly)
+}
 
 func (controller *CasbinController) Middlewares() []func(next http.Handler) http.Handler {
 	casbinMiddleware := middleware.CasbinMiddleware{
@@ -34,3 +79,139 @@ func (controller *CasbinController) Middlewares() []func(next http.Handler) http
 		casbinMiddleware.Middleware,
 	}
 }
+
+// newPolicyHttpError answers 400 for invalid policies, 409 for existing ones and 404 for missing ones.
+func newPolicyHttpError(err error) fuego.HTTPError {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, service.PolicyInvalid):
+		status = http.StatusBadRequest
+	case errors.Is(err, service.PolicyExists):
+		status = http.StatusConflict
+	case errors.Is(err, service.PolicyNotFound):
+		status = http.StatusNotFound
+	}
+	return fuego.HTTPError{Err: err, Detail: err.Error(), Status: status}
+}
+
+func (controller *CasbinController) RoutePermissions(c fuego.ContextNoBody) ([]*service.RoutePermission, error) {
+	permissions, err := controller.CasbinService.GetRoutePermissions()
+	if err != nil {
+		return nil, newPolicyHttpError(err)
+	}
+	return permissions, nil
+}
+
+func (controller *CasbinController) AllPolicies(c fuego.ContextNoBody) ([]*service.Policy, error) {
+	policies, err := controller.CasbinService.GetPolicies(c.QueryParam("subject"))
+	if err != nil {
+		return nil, newPolicyHttpError(err)
+	}
+	return policies, nil
+}
+
+func (controller *CasbinController) AddPolicy(c fuego.ContextWithBody[service.Policy]) (*service.Policy, error) {
+	body, err := c.Body()
+	if err != nil {
+		return nil, err
+	}
+	if err := controller.CasbinService.AddPolicy(&body); err != nil {
+		return nil, newPolicyHttpError(err)
+	}
+	c.SetStatus(http.StatusCreated)
+	return &body, nil
+}
+
+func (controller *CasbinController) UpdatePolicy(c fuego.ContextWithBody[PolicyUpdateBody]) (*service.Policy, error) {
+	body, err := c.Body()
+	if err != nil {
+		return nil, err
+	}
+	if err := controller.CasbinService.UpdatePolicy(&body.Old, &body.New); err != nil {
+		return nil, newPolicyHttpError(err)
+	}
+	return &body.New, nil
+}
+
+func (controller *CasbinController) RemovePolicy(c fuego.ContextWithBody[service.Policy]) (*http.Response, error) {
+	body, err := c.Body()
+	if err != nil {
+		return nil, err
+	}
+	if err := controller.CasbinService.RemovePolicy(&body); err != nil {
+		return nil, newPolicyHttpError(err)
+	}
+	return &http.Response{StatusCode: http.StatusNoContent}, nil
+}
+
+func (controller *CasbinController) AllRolePolicies(c fuego.ContextNoBody) ([]*service.RolePolicy, error) {
+	policies, err := controller.CasbinService.GetRolePolicies(c.QueryParam("subject"))
+	if err != nil {
+		return nil, newPolicyHttpError(err)
+	}
+	return policies, nil
+}
+
+func (controller *CasbinController) AddRolePolicy(c fuego.ContextWithBody[service.RolePolicy]) (*service.RolePolicy, error) {
+	body, err := c.Body()
+	if err != nil {
+		return nil, err
+	}
+	if err := controller.CasbinService.AddRolePolicy(&body); err != nil {
+		return nil, newPolicyHttpError(err)
+	}
+	c.SetStatus(http.StatusCreated)
+	return &body, nil
+}
+
+func (controller *CasbinController) UpdateRolePolicy(c fuego.ContextWithBody[RolePolicyUpdateBody]) (*service.RolePolicy, error) {
+	body, err := c.Body()
+	if err != nil {
+		return nil, err
+	}
+	if err := controller.CasbinService.UpdateRolePolicy(&body.Old, &body.New); err != nil {
+		return nil, newPolicyHttpError(err)
+	}
+	return &body.New, nil
+}
+
+func (controller *CasbinController) RemoveRolePolicy(c fuego.ContextWithBody[service.RolePolicy]) (*http.Response, error) {
+	body, err := c.Body()
+	if err != nil {
+		return nil, err
+	}
+	if err := controller.CasbinService.RemoveRolePolicy(&body); err != nil {
+		return nil, newPolicyHttpError(err)
+	}
+	return &http.Response{StatusCode: http.StatusNoContent}, nil
+}
+
+func (controller *CasbinController) ExportPolicies(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="policies.csv"`)
+	if err := controller.CasbinService.ExportCsv(w); err != nil {
+		log.Warn().Msgf("Failed to export casbin policies: %v", err)
+	}
+}
+
+// ImportPolicies reads a CSV request body in the export form and adds the policies not present yet.
+func (controller *CasbinController) ImportPolicies(c fuego.ContextNoBody) (*service.PolicyImportResult, error) {
+	body := http.MaxBytesReader(c.Response(), c.Request().Body, maxPolicyImportBytes)
+	result, err := controller.CasbinService.ImportCsv(body)
+	if err != nil {
+		return nil, newPolicyHttpError(err)
+	}
+	return result, nil
+}
+
+func (controller *CasbinController) CheckPermission(c fuego.ContextWithBody[PolicyCheckBody]) (*service.PolicyCheckResult, error) {
+	body, err := c.Body()
+	if err != nil {
+		return nil, err
+	}
+	result, err := controller.CasbinService.CheckPermission(body.Subject, body.Domain, body.Object, body.Action)
+	if err != nil {
+		return nil, newPolicyHttpError(err)
+	}
+	return result, nil
+}
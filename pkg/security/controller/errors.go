@@ -0,0 +1,50 @@
+package controller
+
+import (
+	"errors"
+	"github.com/GolangSpring/gospring/pkg/security/service"
+	"github.com/go-fuego/fuego"
+	"net/http"
+)
+
+// newHttpError wraps a service error, password policy and user attribute violations are listed one
+// per field in errors and duplicate users answer 409 naming the conflicting field.
+func newHttpError(err error, status int) fuego.HTTPError {
+	httpErr := fuego.HTTPError{Err: err, Detail: err.Error(), Status: status}
+
+	var existsErr *service.UserExistsError
+	if errors.As(err, &existsErr) {
+		httpErr.Title = "User already exists"
+		httpErr.Status = http.StatusConflict
+		httpErr.Errors = []fuego.ErrorItem{{
+			Name:   existsErr.Field,
+			Reason: existsErr.Field + " is already taken",
+		}}
+		return httpErr
+	}
+
+	var attributeErr *service.UserAttributeError
+	if errors.As(err, &attributeErr) {
+		httpErr.Title = "Invalid user attributes"
+		for _, violation := range attributeErr.Violations {
+			httpErr.Errors = append(httpErr.Errors, fuego.ErrorItem{
+				Name:   violation.Field,
+				Reason: violation.Message,
+			})
+		}
+		return httpErr
+	}
+
+	var policyErr *service.PasswordPolicyError
+	if errors.As(err, &policyErr) {
+		httpErr.Title = "Password policy violation"
+		for _, violation := range policyErr.Violations {
+			httpErr.Errors = append(httpErr.Errors, fuego.ErrorItem{
+				Name:   violation.Field,
+				Reason: violation.Message,
+				More:   map[string]any{"code": violation.Code},
+			})
+		}
+	}
+	return httpErr
+}
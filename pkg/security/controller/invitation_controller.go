@@ -0,0 +1,103 @@
+package controller
+
+import (
+	"errors"
+	"github.com/GolangSpring/gospring/application"
+	"github.com/GolangSpring/gospring/helper"
+	"github.com/GolangSpring/gospring/pkg/security/middleware"
+	"github.com/GolangSpring/gospring/pkg/security/repository"
+	"github.com/GolangSpring/gospring/pkg/security/service"
+	"github.com/go-fuego/fuego"
+	"net/http"
+	"strconv"
+)
+
+type InvitationBody struct {
+	Email  string   `json:"email" validate:"required,email,max=100"`
+	Roles  []string `json:"roles"`
+	Locale string   `json:"locale"`
+}
+
+type AcceptInvitationBody struct {
+	Token    string `json:"token" validate:"required"`
+	UserName string `json:"user_name" validate:"required,min=3,max=32,printascii,excludesall=@ "`
+	Password string `json:"password" validate:"required"`
+}
+
+const AcceptInvitationRoute = "/api-public/invitations/accept"
+
+var _ application.IController = (*InvitationController)(nil)
+
+type InvitationController struct {
+	InvitationService service.IInvitationService
+	AdminRole         string
+}
+
+func NewInvitationController(invitationService service.IInvitationService, adminRole string) *InvitationController {
+	return &InvitationController{
+		InvitationService: invitationService,
+		AdminRole:         adminRole,
+	}
+}
+
+func (controller *InvitationController) Routes(server *fuego.Server) {
+	adminOnly := middleware.RequireRoles(controller.AdminRole)
+	fuego.Post(server, "/api-admin/invitations", controller.Invite, adminOnly)
+	fuego.Get(server, "/api-admin/invitations", controller.AllInvitations, adminOnly)
+	fuego.Delete(server, "/api-admin/invitations/{id}", controller.RevokeInvitation, adminOnly)
+
+	fuego.Post(server, AcceptInvitationRoute, controller.AcceptInvitation, middleware.PublicRoute())
+}
+
+func (controller *InvitationController) Middlewares() []func(next http.Handler) http.Handler {
+	return []func(next http.Handler) http.Handler{}
+}
+
+func (controller *InvitationController) Invite(c fuego.ContextWithBody[InvitationBody]) (*repository.Invitation, error) {
+	body, err := c.Body()
+	if err != nil {
+		return nil, err
+	}
+	inviter, err := helper.GetUserFromContext(c.Request().Context())
+	if err != nil {
+		return nil, fuego.HTTPError{Detail: err.Error(), Status: http.StatusUnauthorized}
+	}
+	invitation, err := controller.InvitationService.Invite(c.Request().Context(), inviter.ID, body.Email, body.Roles, body.Locale)
+	if err != nil {
+		return nil, newHttpError(err, http.StatusBadRequest)
+	}
+	return invitation, nil
+}
+
+func (controller *InvitationController) AllInvitations(c fuego.ContextNoBody) ([]*repository.Invitation, error) {
+	return controller.InvitationService.FindAllInvitations(c.Request().Context())
+}
+
+func (controller *InvitationController) RevokeInvitation(c fuego.ContextNoBody) (*http.Response, error) {
+	invitationID, err := strconv.ParseUint(c.PathParam("id"), 10, 64)
+	if err != nil {
+		return nil, fuego.HTTPError{Detail: "Invalid invitation id", Status: http.StatusBadRequest}
+	}
+	err = controller.InvitationService.RevokeInvitation(c.Request().Context(), uint(invitationID))
+	switch {
+	case errors.Is(err, service.InvitationNotFound):
+		return nil, fuego.HTTPError{Err: err, Detail: err.Error(), Status: http.StatusNotFound}
+	case errors.Is(err, service.InvitationAlreadyAccepted):
+		return nil, fuego.HTTPError{Err: err, Detail: err.Error(), Status: http.StatusConflict}
+	case err != nil:
+		return nil, fuego.HTTPError{Err: err, Detail: err.Error(), Status: http.StatusInternalServerError}
+	}
+	return &http.Response{StatusCode: http.StatusNoContent}, nil
+}
+
+func (controller *InvitationController) AcceptInvitation(c fuego.ContextWithBody[AcceptInvitationBody]) (*repository.User, error) {
+	body, err := c.Body()
+	if err != nil {
+		return nil, err
+	}
+	user, err := controller.InvitationService.AcceptInvitation(c.Request().Context(), body.Token, body.UserName, body.Password)
+	if err != nil {
+		return nil, newHttpError(err, http.StatusBadRequest)
+	}
+	return user, nil
+}
@@ -0,0 +1,80 @@
+package controller
+
+import (
+	"github.com/GolangSpring/gospring/application"
+	"github.com/GolangSpring/gospring/pkg/security/middleware"
+	"github.com/GolangSpring/gospring/pkg/security/repository"
+	"github.com/GolangSpring/gospring/pkg/security/service"
+	"github.com/go-fuego/fuego"
+	"net/http"
+	"strconv"
+)
+
+const DefaultPageSize = 50
+
+var _ application.IController = (*MailOutboxController)(nil)
+
+type MailOutboxController struct {
+	MailQueueService service.IMailQueueService
+	AdminRole        string
+}
+
+func NewMailOutboxController(mailQueueService service.IMailQueueService, adminRole string) *MailOutboxController {
+	return &MailOutboxController{
+		MailQueueService: mailQueueService,
+		AdminRole:        adminRole,
+	}
+}
+
+func (controller *MailOutboxController) Routes(server *fuego.Server) {
+	adminOnly := middleware.RequireRoles(controller.AdminRole)
+	fuego.Get(server, "/api-admin/mail-outbox", controller.AllMails, adminOnly)
+	fuego.Get(server, "/api-admin/mail-outbox/{id}", controller.Mail, adminOnly)
+	fuego.Post(server, "/api-admin/mail-outbox/{id}/resend", controller.Resend, adminOnly)
+}
+
+func (controller *MailOutboxController) Middlewares() []func(next http.Handler) http.Handler {
+	return []func(next http.Handler) http.Handler{}
+}
+
+func parseUintPathParam(value string) (uint, error) {
+	parsed, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, fuego.HTTPError{Detail: "Invalid id", Status: http.StatusBadRequest}
+	}
+	return uint(parsed), nil
+}
+
+func (controller *MailOutboxController) AllMails(c fuego.ContextNoBody) ([]*repository.MailOutbox, error) {
+	status := repository.MailStatus(c.QueryParam("status"))
+	limit := c.QueryParamInt("limit")
+	if limit <= 0 {
+		limit = DefaultPageSize
+	}
+	offset := c.QueryParamInt("offset")
+	return controller.MailQueueService.FindMails(c.Request().Context(), status, limit, offset)
+}
+
+func (controller *MailOutboxController) Mail(c fuego.ContextNoBody) (*repository.MailOutbox, error) {
+	id, err := parseUintPathParam(c.PathParam("id"))
+	if err != nil {
+		return nil, err
+	}
+	mail, err := controller.MailQueueService.FindMail(c.Request().Context(), id)
+	if err != nil {
+		return nil, fuego.HTTPError{Detail: err.Error(), Status: http.StatusNotFound}
+	}
+	return mail, nil
+}
+
+func (controller *MailOutboxController) Resend(c fuego.ContextNoBody) (*repository.MailOutbox, error) {
+	id, err := parseUintPathParam(c.PathParam("id"))
+	if err != nil {
+		return nil, err
+	}
+	mail, err := controller.MailQueueService.Resend(c.Request().Context(), id)
+	if err != nil {
+		return nil, fuego.HTTPError{Detail: err.Error(), Status: http.StatusBadRequest}
+	}
+	return mail, nil
+}
@@ -0,0 +1,63 @@
+package controller
+
+import (
+	"github.com/GolangSpring/gospring/application"
+	"github.com/GolangSpring/gospring/pkg/security/middleware"
+	"github.com/GolangSpring/gospring/pkg/security/service"
+	"github.com/go-fuego/fuego"
+	"net/http"
+	"strconv"
+)
+
+var _ application.IController = (*MailViewerController)(nil)
+var _ application.IDevOnlyController = (*MailViewerController)(nil)
+
+// MailViewerController exposes the mails captured by the memory transport, it is only
+// registered when the server runs in dev mode.
+type MailViewerController struct {
+	MemoryTransport *service.MemoryTransport
+	AdminRole       string
+}
+
+func NewMailViewerController(memoryTransport *service.MemoryTransport, adminRole string) *MailViewerController {
+	return &MailViewerController{
+		MemoryTransport: memoryTransport,
+		AdminRole:       adminRole,
+	}
+}
+
+func (controller *MailViewerController) DevOnly() bool {
+	return true
+}
+
+func (controller *MailViewerController) Routes(server *fuego.Server) {
+	adminOnly := middleware.RequireRoles(controller.AdminRole)
+	fuego.Get(server, "/api-admin/dev/mails", controller.AllMails, adminOnly)
+	fuego.Get(server, "/api-admin/dev/mails/{id}", controller.Mail, adminOnly)
+	fuego.Delete(server, "/api-admin/dev/mails", controller.ClearMails, adminOnly)
+}
+
+func (controller *MailViewerController) Middlewares() []func(next http.Handler) http.Handler {
+	return []func(next http.Handler) http.Handler{}
+}
+
+func (controller *MailViewerController) AllMails(c fuego.ContextNoBody) ([]*service.CapturedMail, error) {
+	return controller.MemoryTransport.List(), nil
+}
+
+func (controller *MailViewerController) Mail(c fuego.ContextNoBody) (*service.CapturedMail, error) {
+	id, err := strconv.ParseUint(c.PathParam("id"), 10, 64)
+	if err != nil {
+		return nil, fuego.HTTPError{Detail: "Invalid id", Status: http.StatusBadRequest}
+	}
+	mail, err := controller.MemoryTransport.Get(id)
+	if err != nil {
+		return nil, fuego.HTTPError{Detail: err.Error(), Status: http.StatusNotFound}
+	}
+	return mail, nil
+}
+
+func (controller *MailViewerController) ClearMails(c fuego.ContextNoBody) (*http.Response, error) {
+	controller.MemoryTransport.Clear()
+	return &http.Response{StatusCode: http.StatusNoContent}, nil
+}
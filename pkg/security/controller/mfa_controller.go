@@ -0,0 +1,270 @@
+package controller
+
+import (
+	"errors"
+	"github.com/GolangSpring/gospring/application"
+	"github.com/GolangSpring/gospring/helper"
+	"github.com/GolangSpring/gospring/pkg/ratelimit"
+	"github.com/GolangSpring/gospring/pkg/security/middleware"
+	"github.com/GolangSpring/gospring/pkg/security/service"
+	"github.com/go-fuego/fuego"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+type TotpCodeBody struct {
+	Code string `json:"code" validate:"required"`
+}
+
+type MfaTokenBody struct {
+	MfaToken string `json:"mfa_token" validate:"required"`
+}
+
+type MfaVerifyBody struct {
+	MfaToken       string `json:"mfa_token" validate:"required"`
+	Code           string `json:"code" validate:"required"`
+	RememberDevice bool   `json:"remember_device"`
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+const MfaPublicRoutePrefix = "/api-public/mfa/"
+
+var _ application.IController = (*MfaController)(nil)
+var _ ratelimit.IRateLimitedController = (*MfaController)(nil)
+
+type MfaController struct {
+	AuthService service.IAuthService
+	UserService service.IUserService
+	TotpService service.ITotpService
+}
+
+func NewMfaController(authService service.IAuthService, userService service.IUserService, totpService service.ITotpService) *MfaController {
+	return &MfaController{
+		AuthService: authService,
+		UserService: userService,
+		TotpService: totpService,
+	}
+}
+
+// RateLimits caps the second factor checks of pending logins, they only apply when the rate limit context is used.
+func (controller *MfaController) RateLimits() []*ratelimit.Rule {
+	return []*ratelimit.Rule{
+		{
+			Name:         "mfa-verify",
+			Path:         "^" + regexp.QuoteMeta(MfaPublicRoutePrefix) + "[^/]+/verify$",
+			Methods:      []string{http.MethodPost},
+			Key:          ratelimit.KeyByIp,
+			Limit:        10,
+			PeriodSecond: 300,
+		},
+	}
+}
+
+func (controller *MfaController) Routes(server *fuego.Server) {
+	fuego.Post(server, "/api-private/mfa/totp/enroll", controller.BeginEnrollment)
+	fuego.Post(server, "/api-private/mfa/totp/confirm", controller.ConfirmEnrollment)
+	fuego.Post(server, "/api-private/mfa/totp/disable", controller.Disable)
+	fuego.Post(server, "/api-private/mfa/totp/recovery-codes", controller.RegenerateRecoveryCodes)
+
+	fuego.Post(server, "/api-public/mfa/totp/enroll", controller.BeginPendingEnrollment, middleware.PublicRoute())
+	fuego.Post(server, "/api-public/mfa/totp/confirm", controller.ConfirmPendingEnrollment, middleware.PublicRoute())
+	fuego.Post(server, "/api-public/mfa/totp/verify", controller.Verify, middleware.PublicRoute())
+
+	fuego.Post(server, "/api-private/mfa/email/enable", controller.EnableEmailOtp)
+	fuego.Post(server, "/api-private/mfa/email/disable", controller.DisableEmailOtp)
+
+	fuego.Post(server, "/api-public/mfa/email/verify", controller.VerifyEmailOtp, middleware.PublicRoute())
+	fuego.Post(server, "/api-public/mfa/email/resend", controller.ResendEmailOtp, middleware.PublicRoute())
+}
+
+func (controller *MfaController) Middlewares() []func(next http.Handler) http.Handler {
+	return []func(next http.Handler) http.Handler{}
+}
+
+func (controller *MfaController) BeginEnrollment(c fuego.ContextNoBody) (*service.TotpEnrollment, error) {
+	user, err := helper.GetUserFromContext(c.Request().Context())
+	if err != nil {
+		return nil, fuego.HTTPError{Detail: err.Error(), Status: http.StatusUnauthorized}
+	}
+	enrollment, err := controller.TotpService.BeginEnrollment(c.Request().Context(), user.ID)
+	if err != nil {
+		return nil, fuego.HTTPError{Detail: err.Error(), Status: http.StatusBadRequest}
+	}
+	return enrollment, nil
+}
+
+func (controller *MfaController) ConfirmEnrollment(c fuego.ContextWithBody[TotpCodeBody]) (*RecoveryCodesResponse, error) {
+	body, err := c.Body()
+	if err != nil {
+		return nil, err
+	}
+	user, err := helper.GetUserFromContext(c.Request().Context())
+	if err != nil {
+		return nil, fuego.HTTPError{Detail: err.Error(), Status: http.StatusUnauthorized}
+	}
+	recoveryCodes, err := controller.TotpService.ConfirmEnrollment(c.Request().Context(), user.ID, body.Code)
+	if err != nil {
+		return nil, fuego.HTTPError{Detail: err.Error(), Status: http.StatusBadRequest}
+	}
+	return &RecoveryCodesResponse{RecoveryCodes: recoveryCodes}, nil
+}
+
+func (controller *MfaController) Disable(c fuego.ContextWithBody[TotpCodeBody]) (*http.Response, error) {
+	body, err := c.Body()
+	if err != nil {
+		return nil, err
+	}
+	user, err := helper.GetUserFromContext(c.Request().Context())
+	if err != nil {
+		return nil, fuego.HTTPError{Detail: err.Error(), Status: http.StatusUnauthorized}
+	}
+	if err := controller.TotpService.Disable(c.Request().Context(), user.ID, body.Code); err != nil {
+		return nil, fuego.HTTPError{Detail: err.Error(), Status: http.StatusBadRequest}
+	}
+	return &http.Response{StatusCode: http.StatusNoContent}, nil
+}
+
+func (controller *MfaController) RegenerateRecoveryCodes(c fuego.ContextWithBody[TotpCodeBody]) (*RecoveryCodesResponse, error) {
+	body, err := c.Body()
+	if err != nil {
+		return nil, err
+	}
+	user, err := helper.GetUserFromContext(c.Request().Context())
+	if err != nil {
+		return nil, fuego.HTTPError{Detail: err.Error(), Status: http.StatusUnauthorized}
+	}
+	recoveryCodes, err := controller.TotpService.RegenerateRecoveryCodes(c.Request().Context(), user.ID, body.Code)
+	if err != nil {
+		return nil, fuego.HTTPError{Detail: err.Error(), Status: http.StatusBadRequest}
+	}
+	return &RecoveryCodesResponse{RecoveryCodes: recoveryCodes}, nil
+}
+
+func (controller *MfaController) BeginPendingEnrollment(c fuego.ContextWithBody[MfaTokenBody]) (*service.TotpEnrollment, error) {
+	body, err := c.Body()
+	if err != nil {
+		return nil, err
+	}
+	claims, err := controller.AuthService.ParseMfaPendingClaims(body.MfaToken)
+	if err != nil {
+		return nil, fuego.HTTPError{Detail: err.Error(), Status: http.StatusUnauthorized}
+	}
+	if claims.Method != service.MfaMethodTotp {
+		return nil, fuego.HTTPError{Detail: service.MfaMethodMismatch.Error(), Status: http.StatusBadRequest}
+	}
+	enrollment, err := controller.TotpService.BeginEnrollment(c.Request().Context(), claims.ID)
+	if err != nil {
+		return nil, fuego.HTTPError{Detail: err.Error(), Status: http.StatusBadRequest}
+	}
+	return enrollment, nil
+}
+
+func (controller *MfaController) ConfirmPendingEnrollment(c fuego.ContextWithBody[MfaVerifyBody]) (*RecoveryCodesResponse, error) {
+	body, err := c.Body()
+	if err != nil {
+		return nil, err
+	}
+	token, recoveryCodes, err := controller.TotpService.CompleteEnrollmentLogin(c.Request().Context(), body.MfaToken, body.Code)
+	if err != nil {
+		return nil, mfaLoginHttpError(err)
+	}
+	helper.WriteTokenCookie(c, token, time.Duration(24)*time.Hour)
+	return &RecoveryCodesResponse{RecoveryCodes: recoveryCodes}, nil
+}
+
+func (controller *MfaController) Verify(c fuego.ContextWithBody[MfaVerifyBody]) (*LoginResponse, error) {
+	body, err := c.Body()
+	if err != nil {
+		return nil, err
+	}
+	token, err := controller.TotpService.CompleteLogin(c.Request().Context(), body.MfaToken, body.Code)
+	if throttleErr := loginThrottleHttpError(c, err); throttleErr != nil {
+		return nil, throttleErr
+	}
+	if err != nil {
+		return nil, mfaLoginHttpError(err)
+	}
+	return controller.writeLoginCookies(c, body, token)
+}
+
+func (controller *MfaController) VerifyEmailOtp(c fuego.ContextWithBody[MfaVerifyBody]) (*LoginResponse, error) {
+	body, err := c.Body()
+	if err != nil {
+		return nil, err
+	}
+	token, err := controller.AuthService.CompleteEmailOtpLogin(c.Request().Context(), body.MfaToken, body.Code)
+	if throttleErr := loginThrottleHttpError(c, err); throttleErr != nil {
+		return nil, throttleErr
+	}
+	if err != nil {
+		return nil, mfaLoginHttpError(err)
+	}
+	return controller.writeLoginCookies(c, body, token)
+}
+
+func (controller *MfaController) ResendEmailOtp(c fuego.ContextWithBody[MfaTokenBody]) (*http.Response, error) {
+	body, err := c.Body()
+	if err != nil {
+		return nil, err
+	}
+	if err := controller.AuthService.ResendLoginOtpEmail(c.Request().Context(), body.MfaToken); err != nil {
+		return nil, fuego.HTTPError{Detail: err.Error(), Status: http.StatusBadRequest}
+	}
+	return &http.Response{StatusCode: http.StatusNoContent}, nil
+}
+
+func (controller *MfaController) EnableEmailOtp(c fuego.ContextNoBody) (*http.Response, error) {
+	return controller.setEmailOtp(c, true)
+}
+
+func (controller *MfaController) DisableEmailOtp(c fuego.ContextNoBody) (*http.Response, error) {
+	return controller.setEmailOtp(c, false)
+}
+
+func (controller *MfaController) setEmailOtp(c fuego.ContextNoBody, enabled bool) (*http.Response, error) {
+	user, err := helper.GetUserFromContext(c.Request().Context())
+	if err != nil {
+		return nil, fuego.HTTPError{Detail: err.Error(), Status: http.StatusUnauthorized}
+	}
+	if err := controller.UserService.UpdateUserEmailOtpByUserID(c.Request().Context(), user.ID, enabled); err != nil {
+		return nil, fuego.HTTPError{Detail: err.Error(), Status: http.StatusBadRequest}
+	}
+	return &http.Response{StatusCode: http.StatusNoContent}, nil
+}
+
+// writeLoginCookies sets the session cookie and, when asked for, the trusted device
+// cookie that lets the user skip the second factor on this device next time.
+// mfaLoginHttpError refuses accounts no longer active with 403 like the password step, other errors with 400.
+func mfaLoginHttpError(err error) error {
+	var statusErr *service.AccountStatusError
+	if errors.As(err, &statusErr) {
+		return fuego.HTTPError{Err: err, Detail: statusErr.Error(), Status: http.StatusForbidden}
+	}
+	return fuego.HTTPError{Detail: err.Error(), Status: http.StatusBadRequest}
+}
+
+func (controller *MfaController) writeLoginCookies(c fuego.ContextWithBody[MfaVerifyBody], body MfaVerifyBody, token string) (*LoginResponse, error) {
+	helper.WriteTokenCookie(c, token, time.Duration(24)*time.Hour)
+	if !body.RememberDevice {
+		return &LoginResponse{Token: token}, nil
+	}
+
+	claims, err := controller.AuthService.ParseMfaPendingClaims(body.MfaToken)
+	if err != nil {
+		return nil, fuego.HTTPError{Detail: err.Error(), Status: http.StatusBadRequest}
+	}
+	user, err := controller.UserService.FindByID(c.Request().Context(), claims.ID)
+	if err != nil {
+		return nil, fuego.HTTPError{Detail: err.Error(), Status: http.StatusBadRequest}
+	}
+	deviceToken, expiration, err := controller.AuthService.IssueTrustedDeviceToken(user)
+	if err != nil {
+		return nil, fuego.HTTPError{Detail: err.Error(), Status: http.StatusInternalServerError}
+	}
+	helper.WriteTrustedDeviceCookie(c, deviceToken, expiration)
+	return &LoginResponse{Token: token}, nil
+}
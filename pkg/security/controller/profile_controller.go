@@ -0,0 +1,280 @@
+package controller
+
+import (
+	"errors"
+	"github.com/GolangSpring/gospring/application"
+	"github.com/GolangSpring/gospring/helper"
+	"github.com/GolangSpring/gospring/pkg/ratelimit"
+	"github.com/GolangSpring/gospring/pkg/security/middleware"
+	"github.com/GolangSpring/gospring/pkg/security/repository"
+	"github.com/GolangSpring/gospring/pkg/security/service"
+	"github.com/go-fuego/fuego"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+)
+
+type UpdateNameBody struct {
+	UserName string `json:"user_name" validate:"required,min=3,max=32,printascii,excludesall=@ "`
+}
+
+type ChangePasswordBody struct {
+	CurrentPassword string `json:"current_password" validate:"required"`
+	NewPassword     string `json:"new_password" validate:"required"`
+}
+
+type EmailChangeBody struct {
+	Email string `json:"email" validate:"required,email,max=100"`
+}
+
+type EmailChangeConfirmBody struct {
+	Token   string `json:"token" validate:"required"`
+	OtpCode string `json:"otp_code" validate:"required"`
+}
+
+type PasswordBody struct {
+	Password string `json:"password" validate:"required"`
+}
+
+const (
+	EmailChangeRoute = "/api-private/me/email"
+	AvatarFileRoute  = "/api-public/avatars/{file}"
+	// avatarFormOverhead leaves room for the multipart framing around the image
+	avatarFormOverhead = 64 * 1024
+)
+
+var _ application.IController = (*ProfileController)(nil)
+var _ ratelimit.IRateLimitedController = (*ProfileController)(nil)
+
+type ProfileController struct {
+	ProfileService service.IProfileService
+	UserService    service.IUserService
+}
+
+func NewProfileController(profileService service.IProfileService, userService service.IUserService) *ProfileController {
+	return &ProfileController{
+		ProfileService: profileService,
+		UserService:    userService,
+	}
+}
+
+// RateLimits caps the emails sent to addresses the user has not proven yet.
+func (controller *ProfileController) RateLimits() []*ratelimit.Rule {
+	return []*ratelimit.Rule{
+		{
+			Name:         "email-change",
+			Path:         "^" + regexp.QuoteMeta(EmailChangeRoute) + "$",
+			Methods:      []string{http.MethodPost},
+			Key:          ratelimit.KeyByUser,
+			Limit:        3,
+			PeriodSecond: 600,
+		},
+	}
+}
+
+func (controller *ProfileController) Routes(server *fuego.Server) {
+	fuego.Get(server, "/api-private/me", controller.Me)
+	fuego.Patch(server, "/api-private/me", controller.UpdateName)
+	fuego.Patch(server, "/api-private/me/attributes", controller.UpdateAttributes)
+	fuego.Post(server, "/api-private/me/password", controller.ChangePassword)
+	fuego.Post(server, EmailChangeRoute, controller.RequestEmailChange)
+	fuego.Post(server, "/api-private/me/email/confirm", controller.ConfirmEmailChange)
+	fuego.Post(server, "/api-private/me/avatar", controller.UploadAvatar)
+	fuego.Post(server, "/api-private/me/delete", controller.ScheduleDeletion)
+	fuego.Post(server, "/api-private/me/delete/cancel", controller.CancelDeletion)
+
+	fuego.GetStd(server, AvatarFileRoute, controller.Avatar, middleware.PublicRoute())
+}
+
+func (controller *ProfileController) Middlewares() []func(next http.Handler) http.Handler {
+	return []func(next http.Handler) http.Handler{}
+}
+
+// loginThrottleHttpError answers 429 while LoginThrottleService refuses the attempt, nil for other errors.
+func loginThrottleHttpError[B any](c fuego.ContextWithBody[B], err error) error {
+	var throttleErr *service.LoginThrottleError
+	if !errors.As(err, &throttleErr) {
+		return nil
+	}
+	c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(throttleErr.RetryAfter.Seconds()))))
+	return fuego.HTTPError{Detail: throttleErr.Error(), Status: http.StatusTooManyRequests}
+}
+
+func currentUserID[B any](c fuego.ContextWithBody[B]) (uint, error) {
+	user, err := helper.GetUserFromContext(c.Request().Context())
+	if err != nil {
+		return 0, fuego.HTTPError{Detail: err.Error(), Status: http.StatusUnauthorized}
+	}
+	return user.ID, nil
+}
+
+func (controller *ProfileController) Me(c fuego.ContextNoBody) (*repository.User, error) {
+	userID, err := currentUserID(c)
+	if err != nil {
+		return nil, err
+	}
+	user, err := controller.UserService.FindUser(c.Request().Context(), userID)
+	if err != nil {
+		return nil, userNotFoundOr(err, http.StatusBadRequest)
+	}
+	return user, nil
+}
+
+func (controller *ProfileController) UpdateName(c fuego.ContextWithBody[UpdateNameBody]) (*repository.User, error) {
+	userID, err := currentUserID(c)
+	if err != nil {
+		return nil, err
+	}
+	body, err := c.Body()
+	if err != nil {
+		return nil, err
+	}
+	user, err := controller.ProfileService.UpdateName(c.Request().Context(), userID, body.UserName)
+	if err != nil {
+		return nil, newHttpError(err, http.StatusBadRequest)
+	}
+	return user, nil
+}
+
+// UpdateAttributes only accepts the attributes marked user_editable.
+func (controller *ProfileController) UpdateAttributes(c fuego.ContextWithBody[UserAttributesBody]) (*repository.User, error) {
+	userID, err := currentUserID(c)
+	if err != nil {
+		return nil, err
+	}
+	body, err := c.Body()
+	if err != nil {
+		return nil, err
+	}
+	user, err := controller.ProfileService.UpdateAttributes(c.Request().Context(), userID, body.Attributes)
+	if err != nil {
+		return nil, newHttpError(err, http.StatusBadRequest)
+	}
+	return user, nil
+}
+
+func (controller *ProfileController) ChangePassword(c fuego.ContextWithBody[ChangePasswordBody]) (*http.Response, error) {
+	userID, err := currentUserID(c)
+	if err != nil {
+		return nil, err
+	}
+	body, err := c.Body()
+	if err != nil {
+		return nil, err
+	}
+	err = controller.ProfileService.ChangePassword(c.Request().Context(), userID, body.CurrentPassword, body.NewPassword)
+	if throttleErr := loginThrottleHttpError(c, err); throttleErr != nil {
+		return nil, throttleErr
+	}
+	if errors.Is(err, service.PasswordIncorrect) {
+		return nil, fuego.HTTPError{Err: err, Detail: err.Error(), Status: http.StatusForbidden}
+	}
+	if err != nil {
+		return nil, newHttpError(err, http.StatusBadRequest)
+	}
+	return &http.Response{StatusCode: http.StatusNoContent}, nil
+}
+
+func (controller *ProfileController) RequestEmailChange(c fuego.ContextWithBody[EmailChangeBody]) (*TokenResponse, error) {
+	userID, err := currentUserID(c)
+	if err != nil {
+		return nil, err
+	}
+	body, err := c.Body()
+	if err != nil {
+		return nil, err
+	}
+	token, err := controller.ProfileService.RequestEmailChange(c.Request().Context(), userID, body.Email)
+	if err != nil {
+		return nil, newHttpError(err, http.StatusBadRequest)
+	}
+	return &TokenResponse{Token: token}, nil
+}
+
+func (controller *ProfileController) ConfirmEmailChange(c fuego.ContextWithBody[EmailChangeConfirmBody]) (*repository.User, error) {
+	userID, err := currentUserID(c)
+	if err != nil {
+		return nil, err
+	}
+	body, err := c.Body()
+	if err != nil {
+		return nil, err
+	}
+	user, err := controller.ProfileService.ConfirmEmailChange(c.Request().Context(), userID, body.Token, body.OtpCode)
+	if err != nil {
+		return nil, newHttpError(err, http.StatusBadRequest)
+	}
+	return user, nil
+}
+
+// UploadAvatar takes the image from the "avatar" field of a multipart form.
+func (controller *ProfileController) UploadAvatar(c fuego.ContextNoBody) (*repository.User, error) {
+	userID, err := currentUserID(c)
+	if err != nil {
+		return nil, err
+	}
+	request := c.Request()
+	maxBytes := controller.ProfileService.GetProfileConfig().AvatarMaxBytes()
+	request.Body = http.MaxBytesReader(c.Response(), request.Body, avatarFormOverhead+maxBytes)
+	file, _, err := request.FormFile("avatar")
+	if err != nil {
+		return nil, fuego.HTTPError{Detail: "Missing or oversized avatar file: " + err.Error(), Status: http.StatusBadRequest}
+	}
+	defer file.Close()
+
+	user, err := controller.ProfileService.SaveAvatar(request.Context(), userID, file)
+	switch {
+	case errors.Is(err, service.AvatarTooLarge):
+		return nil, fuego.HTTPError{Err: err, Detail: err.Error(), Status: http.StatusRequestEntityTooLarge}
+	case errors.Is(err, service.AvatarInvalid):
+		return nil, fuego.HTTPError{Err: err, Detail: err.Error(), Status: http.StatusUnsupportedMediaType}
+	case err != nil:
+		return nil, newHttpError(err, http.StatusBadRequest)
+	}
+	return user, nil
+}
+
+func (controller *ProfileController) Avatar(w http.ResponseWriter, r *http.Request) {
+	path, err := controller.ProfileService.AvatarPath(r.PathValue("file"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=86400, immutable")
+	http.ServeFile(w, r, path)
+}
+
+func (controller *ProfileController) ScheduleDeletion(c fuego.ContextWithBody[PasswordBody]) (*repository.User, error) {
+	userID, err := currentUserID(c)
+	if err != nil {
+		return nil, err
+	}
+	body, err := c.Body()
+	if err != nil {
+		return nil, err
+	}
+	user, err := controller.ProfileService.ScheduleDeletion(c.Request().Context(), userID, body.Password)
+	if throttleErr := loginThrottleHttpError(c, err); throttleErr != nil {
+		return nil, throttleErr
+	}
+	if errors.Is(err, service.PasswordIncorrect) {
+		return nil, fuego.HTTPError{Err: err, Detail: err.Error(), Status: http.StatusForbidden}
+	}
+	if err != nil {
+		return nil, newHttpError(err, http.StatusBadRequest)
+	}
+	return user, nil
+}
+
+func (controller *ProfileController) CancelDeletion(c fuego.ContextNoBody) (*repository.User, error) {
+	userID, err := currentUserID(c)
+	if err != nil {
+		return nil, err
+	}
+	user, err := controller.ProfileService.CancelDeletion(c.Request().Context(), userID)
+	if err != nil {
+		return nil, newHttpError(err, http.StatusBadRequest)
+	}
+	return user, nil
+}
@@ -3,6 +3,7 @@ package controller
 import (
 	"fmt"
 	"github.com/GolangSpring/gospring/application"
+	"github.com/GolangSpring/gospring/pkg/security/middleware"
 	"github.com/go-fuego/fuego"
 	"github.com/shirou/gopsutil/v4/cpu"
 	"github.com/shirou/gopsutil/v4/disk"
@@ -58,7 +59,7 @@ func NewSystemController() *SystemController {
 }
 
 func (controller *SystemController) Routes(server *fuego.Server) {
-	fuego.Get(server, "/api-public/health", controller.Health)
+	fuego.Get(server, "/api-public/health", controller.Health, middleware.PublicRoute())
 
 }
 
@@ -0,0 +1,254 @@
+package controller
+
+import (
+	"errors"
+	"github.com/GolangSpring/gospring/application"
+	"github.com/GolangSpring/gospring/pkg/security/middleware"
+	"github.com/GolangSpring/gospring/pkg/security/repository"
+	"github.com/GolangSpring/gospring/pkg/security/service"
+	"github.com/go-fuego/fuego"
+	"github.com/go-fuego/fuego/option"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type UserStatusBody struct {
+	Status repository.AccountStatus `json:"status" validate:"required,oneof=active disabled locked pending"`
+	Reason string                   `json:"reason" validate:"max=255"`
+}
+
+// UserAttributesBody changes the custom attributes given, a null value removes the attribute.
+type UserAttributesBody struct {
+	Attributes repository.UserAttributes `json:"attributes" validate:"required"`
+}
+
+type UserPage struct {
+	Users  []*repository.User `json:"users"`
+	Total  int64              `json:"total"`
+	Limit  int                `json:"limit"`
+	Offset int                `json:"offset"`
+}
+
+var _ application.IController = (*UserAdminController)(nil)
+
+type UserAdminController struct {
+	UserService service.IUserService
+	AdminRole   string
+}
+
+func NewUserAdminController(userService service.IUserService, adminRole string) *UserAdminController {
+	return &UserAdminController{
+		UserService: userService,
+		AdminRole:   adminRole,
+	}
+}
+
+func (controller *UserAdminController) Routes(server *fuego.Server) {
+	adminOnly := middleware.RequireRoles(controller.AdminRole)
+	fuego.Get(server, "/api-admin/users", controller.AllUsers, adminOnly,
+		option.Query("search", "Part of the name or email"),
+		option.QueryBool("verified", "Only verified or unverified users"),
+		option.Query("status", "Only users in the status, one of active, disabled, locked, pending"),
+		option.Query("role", "Only users holding the role"),
+		option.Query("created_after", "RFC 3339 time, inclusive"),
+		option.Query("created_before", "RFC 3339 time, exclusive"),
+		option.QueryBool("deleted", "List soft-deleted users instead"),
+		option.Query("sort", "One of "+strings.Join(repository.UserSortFields, ", ")),
+		option.Query("order", "asc or desc"),
+		option.QueryInt("limit", "Page size"),
+		option.QueryInt("offset", "Number of users to skip"),
+	)
+	fuego.Get(server, "/api-admin/users/{id}", controller.User, adminOnly)
+	fuego.Patch(server, "/api-admin/users/{id}", controller.UpdateUser, adminOnly)
+	fuego.Patch(server, "/api-admin/users/{id}/attributes", controller.UpdateUserAttributes, adminOnly)
+	fuego.Post(server, "/api-admin/users/{id}/status", controller.UpdateUserStatus, adminOnly)
+	fuego.Post(server, "/api-admin/users/{id}/disable", controller.DisableUser, adminOnly,
+		option.Query("reason", "Shown to the user when they try to sign in"),
+	)
+	fuego.Post(server, "/api-admin/users/{id}/enable", controller.EnableUser, adminOnly)
+	fuego.Delete(server, "/api-admin/users/{id}", controller.DeleteUser, adminOnly)
+	fuego.Post(server, "/api-admin/users/{id}/restore", controller.RestoreUser, adminOnly)
+}
+
+func (controller *UserAdminController) Middlewares() []func(next http.Handler) http.Handler {
+	return []func(next http.Handler) http.Handler{}
+}
+
+func parseOptionalBoolQuery(c fuego.ContextNoBody, name string) (*bool, error) {
+	if !c.HasQueryParam(name) {
+		return nil, nil
+	}
+	value, err := strconv.ParseBool(c.QueryParam(name))
+	if err != nil {
+		return nil, fuego.HTTPError{Detail: "Invalid " + name, Status: http.StatusBadRequest}
+	}
+	return &value, nil
+}
+
+func parseOptionalTimeQuery(c fuego.ContextNoBody, name string) (*time.Time, error) {
+	if c.QueryParam(name) == "" {
+		return nil, nil
+	}
+	value, err := time.Parse(time.RFC3339, c.QueryParam(name))
+	if err != nil {
+		return nil, fuego.HTTPError{Detail: "Invalid " + name + ", expecting RFC 3339", Status: http.StatusBadRequest}
+	}
+	return &value, nil
+}
+
+func parseUserQuery(c fuego.ContextNoBody) (*repository.UserQuery, error) {
+	var err error
+	query := &repository.UserQuery{
+		Search:     c.QueryParam("search"),
+		Role:       c.QueryParam("role"),
+		Deleted:    c.QueryParamBool("deleted"),
+		SortBy:     c.QueryParam("sort"),
+		Descending: strings.EqualFold(c.QueryParam("order"), "desc"),
+		Limit:      c.QueryParamInt("limit"),
+		Offset:     max(c.QueryParamInt("offset"), 0),
+	}
+	if query.Limit <= 0 {
+		query.Limit = DefaultPageSize
+	}
+	if query.IsVerified, err = parseOptionalBoolQuery(c, "verified"); err != nil {
+		return nil, err
+	}
+	if status := repository.AccountStatus(c.QueryParam("status")); status != "" {
+		if !slices.Contains(repository.AccountStatuses, status) {
+			return nil, fuego.HTTPError{Detail: "Invalid status", Status: http.StatusBadRequest}
+		}
+		query.Status = status
+	}
+	if query.CreatedAfter, err = parseOptionalTimeQuery(c, "created_after"); err != nil {
+		return nil, err
+	}
+	if query.CreatedBefore, err = parseOptionalTimeQuery(c, "created_before"); err != nil {
+		return nil, err
+	}
+	return query, nil
+}
+
+func userNotFoundOr(err error, status int) fuego.HTTPError {
+	if errors.Is(err, service.UserNotFound) {
+		return fuego.HTTPError{Err: err, Detail: err.Error(), Status: http.StatusNotFound}
+	}
+	return newHttpError(err, status)
+}
+
+func (controller *UserAdminController) AllUsers(c fuego.ContextNoBody) (*UserPage, error) {
+	query, err := parseUserQuery(c)
+	if err != nil {
+		return nil, err
+	}
+	users, total, err := controller.UserService.FindUsers(c.Request().Context(), query)
+	if err != nil {
+		return nil, fuego.HTTPError{Detail: err.Error(), Status: http.StatusInternalServerError}
+	}
+	return &UserPage{Users: users, Total: total, Limit: query.Limit, Offset: query.Offset}, nil
+}
+
+func (controller *UserAdminController) User(c fuego.ContextNoBody) (*repository.User, error) {
+	userID, err := parseUintPathParam(c.PathParam("id"))
+	if err != nil {
+		return nil, err
+	}
+	user, err := controller.UserService.FindUser(c.Request().Context(), userID)
+	if err != nil {
+		return nil, userNotFoundOr(err, http.StatusBadRequest)
+	}
+	return user, nil
+}
+
+func (controller *UserAdminController) UpdateUser(c fuego.ContextWithBody[service.UserProfileUpdate]) (*repository.User, error) {
+	userID, err := parseUintPathParam(c.PathParam("id"))
+	if err != nil {
+		return nil, err
+	}
+	body, err := c.Body()
+	if err != nil {
+		return nil, err
+	}
+	user, err := controller.UserService.UpdateProfile(c.Request().Context(), userID, &body)
+	if err != nil {
+		return nil, userNotFoundOr(err, http.StatusBadRequest)
+	}
+	return user, nil
+}
+
+func (controller *UserAdminController) UpdateUserAttributes(c fuego.ContextWithBody[UserAttributesBody]) (*repository.User, error) {
+	userID, err := parseUintPathParam(c.PathParam("id"))
+	if err != nil {
+		return nil, err
+	}
+	body, err := c.Body()
+	if err != nil {
+		return nil, err
+	}
+	user, err := controller.UserService.UpdateAttributes(c.Request().Context(), userID, body.Attributes)
+	if err != nil {
+		return nil, userNotFoundOr(err, http.StatusBadRequest)
+	}
+	return user, nil
+}
+
+func (controller *UserAdminController) setStatus(c fuego.ContextNoBody, status repository.AccountStatus, reason string) (*repository.User, error) {
+	userID, err := parseUintPathParam(c.PathParam("id"))
+	if err != nil {
+		return nil, err
+	}
+	user, err := controller.UserService.SetUserStatus(c.Request().Context(), userID, status, reason)
+	if err != nil {
+		return nil, userNotFoundOr(err, http.StatusBadRequest)
+	}
+	return user, nil
+}
+
+func (controller *UserAdminController) UpdateUserStatus(c fuego.ContextWithBody[UserStatusBody]) (*repository.User, error) {
+	userID, err := parseUintPathParam(c.PathParam("id"))
+	if err != nil {
+		return nil, err
+	}
+	body, err := c.Body()
+	if err != nil {
+		return nil, err
+	}
+	user, err := controller.UserService.SetUserStatus(c.Request().Context(), userID, body.Status, body.Reason)
+	if err != nil {
+		return nil, userNotFoundOr(err, http.StatusBadRequest)
+	}
+	return user, nil
+}
+
+func (controller *UserAdminController) DisableUser(c fuego.ContextNoBody) (*repository.User, error) {
+	return controller.setStatus(c, repository.AccountStatusDisabled, c.QueryParam("reason"))
+}
+
+func (controller *UserAdminController) EnableUser(c fuego.ContextNoBody) (*repository.User, error) {
+	return controller.setStatus(c, repository.AccountStatusActive, "")
+}
+
+func (controller *UserAdminController) DeleteUser(c fuego.ContextNoBody) (*http.Response, error) {
+	userID, err := parseUintPathParam(c.PathParam("id"))
+	if err != nil {
+		return nil, err
+	}
+	if err := controller.UserService.SoftDeleteUser(c.Request().Context(), userID); err != nil {
+		return nil, userNotFoundOr(err, http.StatusBadRequest)
+	}
+	return &http.Response{StatusCode: http.StatusNoContent}, nil
+}
+
+func (controller *UserAdminController) RestoreUser(c fuego.ContextNoBody) (*repository.User, error) {
+	userID, err := parseUintPathParam(c.PathParam("id"))
+	if err != nil {
+		return nil, err
+	}
+	user, err := controller.UserService.RestoreUser(c.Request().Context(), userID)
+	if err != nil {
+		return nil, userNotFoundOr(err, http.StatusBadRequest)
+	}
+	return user, nil
+}
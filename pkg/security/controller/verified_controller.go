@@ -0,0 +1,47 @@
+package controller
+
+import (
+	"github.com/GolangSpring/gospring/application"
+	"github.com/GolangSpring/gospring/pkg/security/middleware"
+	"github.com/go-fuego/fuego"
+	"net/http"
+	"regexp"
+)
+
+// UnverifiedAllowedRoutes are the private routes an unverified user needs to get verified,
+// they are always reachable when VerificationConfig.RequireVerified is set.
+var UnverifiedAllowedRoutes = []string{
+	"/api-private/current-user",
+	"/api-private/logout",
+	SendVerificationRoute,
+}
+
+// UnverifiedAllowedPatterns anchors UnverifiedAllowedRoutes and appends the configured patterns.
+func UnverifiedAllowedPatterns(configured []string) []string {
+	patterns := make([]string, 0, len(UnverifiedAllowedRoutes)+len(configured))
+	for _, route := range UnverifiedAllowedRoutes {
+		patterns = append(patterns, "^"+regexp.QuoteMeta(route)+"$")
+	}
+	return append(patterns, configured...)
+}
+
+var _ application.IController = (*VerifiedController)(nil)
+
+// VerifiedController only contributes the middleware refusing unverified users.
+type VerifiedController struct {
+	VerifiedMiddleware *middleware.VerifiedMiddleware
+}
+
+func NewVerifiedController(verifiedMiddleware *middleware.VerifiedMiddleware) *VerifiedController {
+	return &VerifiedController{
+		VerifiedMiddleware: verifiedMiddleware,
+	}
+}
+
+func (controller *VerifiedController) Routes(server *fuego.Server) {}
+
+func (controller *VerifiedController) Middlewares() []func(next http.Handler) http.Handler {
+	return []func(next http.Handler) http.Handler{
+		controller.VerifiedMiddleware.Middleware,
+	}
+}
@@ -2,6 +2,7 @@ package middleware
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/GolangSpring/gospring/helper"
 	"github.com/GolangSpring/gospring/pkg/security/service"
@@ -66,7 +67,12 @@ func (middleware *AuthMiddleware) Middleware(next http.Handler) http.Handler {
 
 		// Token is valid - set custom headers or context (e.g., user info)
 		// Add user info to the request context
-		userClaims, err := middleware.AuthService.ParseUserClaims(tokenFound)
+		userClaims, err := middleware.AuthService.ParseUserClaims(r.Context(), tokenFound)
+		var statusErr *service.AccountStatusError
+		if errors.As(err, &statusErr) {
+			http.Error(w, statusErr.Error(), http.StatusForbidden)
+			return
+		}
 		if err != nil {
 			http.Error(w, fmt.Sprintf("Invalid token: %v", err), http.StatusUnauthorized)
 			return
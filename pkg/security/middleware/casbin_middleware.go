@@ -1,10 +1,14 @@
 package middleware
 
 import (
+	"context"
 	"github.com/GolangSpring/gospring/pkg/security/service"
 	"net/http"
 )
 
+// TenantContextKey holds the tenant the request was authorized in, with the domain model.
+const TenantContextKey = "tenant"
+
 type CasbinMiddleware struct {
 	AuthService   service.IAuthService
 	CasbinService *service.CasbinService
@@ -27,18 +31,47 @@ func (middleware *CasbinMiddleware) Middleware(next http.Handler) http.Handler {
 			return
 		}
 
-		// Check if the user is allowed to access the resource
-		for _, role := range userClaims.Roles {
-			allowed, err := middleware.CasbinService.Enforcer.Enforce(role, obj, act)
-			if err != nil {
-				http.Error(w, "Authorization error", http.StatusInternalServerError)
-				return
-			}
-			if allowed {
-				next.ServeHTTP(w, r)
-				return
-			}
+		// The tenant only matters to the domain model, the flat one ignores it
+		config := middleware.CasbinService.CasbinConfig
+		var tenant string
+		if config.IsDomainModel() {
+			tenant = config.Tenant.Resolve(r, userClaims)
+			r = r.WithContext(context.WithValue(r.Context(), TenantContextKey, tenant))
+		}
+
+		allowed, err := middleware.authorize(userClaims, tenant, obj, act)
+		if err != nil {
+			http.Error(w, "Authorization error", http.StatusInternalServerError)
+			return
+		}
+		if allowed {
+			next.ServeHTTP(w, r)
+			return
 		}
 		http.Error(w, "Forbidden", http.StatusForbidden)
 	})
 }
+
+// authorize checks the global roles against the global and tenant policies, the tenant roles only
+// against the policies of the tenant, so a tenant admin is no platform admin.
+func (middleware *CasbinMiddleware) authorize(userClaims *service.UserClaims, tenant, obj, act string) (bool, error) {
+	casbinService := middleware.CasbinService
+	// Casbin resolves the roles of the user subject itself through its "g" policies
+	if casbinService.CasbinConfig.ResolveRoles {
+		return casbinService.Enforce(service.UserSubject(userClaims.ID), tenant, obj, act)
+	}
+
+	for _, role := range userClaims.Roles {
+		allowed, err := casbinService.Enforce(role, tenant, obj, act)
+		if err != nil || allowed {
+			return allowed, err
+		}
+	}
+	for _, role := range userClaims.Tenants[tenant] {
+		allowed, err := casbinService.EnforceTenantRole(role, tenant, obj, act)
+		if err != nil || allowed {
+			return allowed, err
+		}
+	}
+	return false, nil
+}
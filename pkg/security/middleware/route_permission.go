@@ -0,0 +1,54 @@
+package middleware
+
+import (
+	"github.com/GolangSpring/gospring/pkg/security/service"
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/go-fuego/fuego"
+)
+
+// BearerSecurityScheme is the OpenAPI security scheme of the login token.
+const BearerSecurityScheme = "bearerAuth"
+
+// RequireRoles is a fuego route option declaring the roles allowed on the route. CasbinService
+// generates their policies on startup and the OpenAPI spec lists them as a bearer requirement.
+func RequireRoles(roles ...string) func(*fuego.BaseRoute) {
+	return func(route *fuego.BaseRoute) {
+		addRouteRoles(route, roles)
+		registerBearerScheme(route.OpenAPI.Description())
+		if route.Operation.Security == nil {
+			route.Operation.Security = openapi3.NewSecurityRequirements()
+		}
+		route.Operation.Security.With(openapi3.NewSecurityRequirement().Authenticate(BearerSecurityScheme, roles...))
+	}
+}
+
+// PublicRoute is a fuego route option making the route reachable without login.
+func PublicRoute() func(*fuego.BaseRoute) {
+	return func(route *fuego.BaseRoute) {
+		addRouteRoles(route, []string{service.CasbinPublicKey})
+		route.Operation.Security = openapi3.NewSecurityRequirements()
+	}
+}
+
+func addRouteRoles(route *fuego.BaseRoute, roles []string) {
+	if route.Operation.Extensions == nil {
+		route.Operation.Extensions = map[string]any{}
+	}
+	existing, _ := route.Operation.Extensions[service.RolesExtension].([]string)
+	route.Operation.Extensions[service.RolesExtension] = append(existing, roles...)
+}
+
+func registerBearerScheme(description *openapi3.T) {
+	if description.Components == nil {
+		description.Components = &openapi3.Components{}
+	}
+	if description.Components.SecuritySchemes == nil {
+		description.Components.SecuritySchemes = openapi3.SecuritySchemes{}
+	}
+	if _, ok := description.Components.SecuritySchemes[BearerSecurityScheme]; ok {
+		return
+	}
+	description.Components.SecuritySchemes[BearerSecurityScheme] = &openapi3.SecuritySchemeRef{
+		Value: openapi3.NewJWTSecurityScheme(),
+	}
+}
@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"github.com/GolangSpring/gospring/pkg/security/service"
+	"github.com/casbin/casbin/v2"
+	"github.com/casbin/casbin/v2/model"
+	fileadapter "github.com/casbin/casbin/v2/persist/file-adapter"
+	"github.com/go-fuego/fuego"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPublicRouteRegistersPublicPolicy(t *testing.T) {
+	policyFile := filepath.Join(t.TempDir(), "policy.csv")
+	if err := os.WriteFile(policyFile, nil, 0o644); err != nil {
+		t.Fatalf("failed to write the policy file: %v", err)
+	}
+	casbinModel, err := model.NewModelFromString(service.DomainModelString)
+	if err != nil {
+		t.Fatalf("failed to parse the domain model: %v", err)
+	}
+	enforcer, err := casbin.NewSyncedEnforcer(casbinModel, fileadapter.NewAdapter(policyFile))
+	if err != nil {
+		t.Fatalf("failed to create the enforcer: %v", err)
+	}
+	casbinService := service.NewCasbinService(enforcer, nil, &service.CasbinConfig{Model: service.CasbinModelDomain})
+
+	server := fuego.NewServer()
+	fuego.Post(server, "/api-public/items/{id}", func(c fuego.ContextNoBody) (string, error) { return "", nil }, PublicRoute())
+	fuego.Post(server, "/api-private/items/{id}", func(c fuego.ContextNoBody) (string, error) { return "", nil }, RequireRoles("admin"))
+	casbinService.RoutesRegistered(server)
+
+	tests := []struct {
+		path     string
+		expected bool
+	}{
+		{"/api-public/items/1", true},
+		{"/api-public/items/1/other", false},
+		{"/api-private/items/1", false},
+	}
+	for _, test := range tests {
+		isAllowed, err := casbinService.HasPermission(service.CasbinPublicKey, test.path, http.MethodPost)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if isAllowed != test.expected {
+			t.Fatalf("%s: expected public access %v, got %v", test.path, test.expected, isAllowed)
+		}
+	}
+}
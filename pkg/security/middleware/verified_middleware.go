@@ -0,0 +1,55 @@
+package middleware
+
+import (
+	"github.com/GolangSpring/gospring/pkg/security/service"
+	"net/http"
+	"regexp"
+)
+
+// VerifiedMiddleware refuses users who have not verified their email, it runs after AuthMiddleware.
+// The claims AuthMiddleware stores carry the verification of the stored user rather than the one
+// the token was issued with, so verifying or changing the email applies right away.
+type VerifiedMiddleware struct {
+	CasbinService *service.CasbinService
+	AllowedRoutes []*regexp.Regexp
+}
+
+func NewVerifiedMiddleware(casbinService *service.CasbinService, allowedRoutes []string) (*VerifiedMiddleware, error) {
+	middleware := &VerifiedMiddleware{
+		CasbinService: casbinService,
+	}
+	for _, route := range allowedRoutes {
+		pattern, err := regexp.Compile(route)
+		if err != nil {
+			return nil, err
+		}
+		middleware.AllowedRoutes = append(middleware.AllowedRoutes, pattern)
+	}
+	return middleware, nil
+}
+
+func (middleware *VerifiedMiddleware) isAllowedRoute(path string) bool {
+	for _, pattern := range middleware.AllowedRoutes {
+		if pattern.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+func (middleware *VerifiedMiddleware) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		isPublicAllowed, err := middleware.CasbinService.HasPermission(service.CasbinPublicKey, r.URL.Path, r.Method)
+		if err == nil && isPublicAllowed {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		userClaims, ok := r.Context().Value(UserContextKey).(*service.UserClaims)
+		if !ok || userClaims == nil || userClaims.IsVerified || middleware.isAllowedRoute(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		http.Error(w, service.UserNotVerified.Error(), http.StatusForbidden)
+	})
+}
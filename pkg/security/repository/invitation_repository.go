@@ -0,0 +1,90 @@
+package repository
+
+import (
+	"context"
+	"gorm.io/gorm"
+	"time"
+)
+
+type IInvitationRepository interface {
+	FindAll(ctx context.Context) ([]*Invitation, error)
+	FindByID(ctx context.Context, id uint) (*Invitation, error)
+	FindPendingByEmail(ctx context.Context, email string) (*Invitation, error)
+	Save(ctx context.Context, invitation *Invitation) error
+	DeleteByID(ctx context.Context, id uint) error
+	MarkAcceptedTx(tx *gorm.DB, invitation *Invitation) (bool, error)
+	DeleteForUserTx(tx *gorm.DB, user *User) error
+}
+
+var _ IInvitationRepository = (*InvitationRepository)(nil)
+
+type InvitationRepository struct {
+	Engine *gorm.DB
+}
+
+func NewInvitationRepository(engine *gorm.DB) *InvitationRepository {
+	return &InvitationRepository{
+		Engine: engine,
+	}
+}
+
+func (repo *InvitationRepository) FindAll(ctx context.Context) ([]*Invitation, error) {
+	var invitations []*Invitation
+	err := repo.Engine.WithContext(ctx).Order("created_at desc").Find(&invitations).Error
+	if err != nil {
+		return nil, err
+	}
+	return invitations, nil
+}
+
+func (repo *InvitationRepository) FindByID(ctx context.Context, id uint) (*Invitation, error) {
+	var invitation Invitation
+	err := repo.Engine.WithContext(ctx).First(&invitation, id).Error
+	if err != nil {
+		return nil, err
+	}
+	return &invitation, nil
+}
+
+func (repo *InvitationRepository) FindPendingByEmail(ctx context.Context, email string) (*Invitation, error) {
+	var invitation Invitation
+	err := repo.Engine.WithContext(ctx).
+		Where("email = ? AND accepted_at IS NULL AND expires_at > ?", email, time.Now()).
+		First(&invitation).Error
+	if err != nil {
+		return nil, err
+	}
+	return &invitation, nil
+}
+
+func (repo *InvitationRepository) Save(ctx context.Context, invitation *Invitation) error {
+	return repo.Engine.WithContext(ctx).Save(invitation).Error
+}
+
+func (repo *InvitationRepository) DeleteByID(ctx context.Context, id uint) error {
+	return repo.Engine.WithContext(ctx).Delete(&Invitation{}, id).Error
+}
+
+// MarkAcceptedTx claims the invitation within tx and reports false when it was accepted already,
+// so concurrent accepts of the same invitation cannot both succeed.
+func (repo *InvitationRepository) MarkAcceptedTx(tx *gorm.DB, invitation *Invitation) (bool, error) {
+	now := time.Now()
+	result := tx.Model(&Invitation{}).
+		Where("id = ? AND accepted_at IS NULL", invitation.ID).
+		Update("accepted_at", now)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return false, nil
+	}
+	invitation.AcceptedAt = &now
+	return true, nil
+}
+
+// DeleteForUserTx removes within tx the invitations sent to the user and the pending ones the user
+// sent, accepted invitations of other users are kept.
+func (repo *InvitationRepository) DeleteForUserTx(tx *gorm.DB, user *User) error {
+	return tx.Where("email = ? OR (invited_by = ? AND accepted_at IS NULL)", user.Email, user.ID).
+		Delete(&Invitation{}).Error
+}
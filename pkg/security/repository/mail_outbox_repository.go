@@ -0,0 +1,133 @@
+package repository
+
+import (
+	"context"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+type IMailOutboxRepository interface {
+	FindByID(ctx context.Context, id uint) (*MailOutbox, error)
+	FindByIdempotencyKey(ctx context.Context, key string) (*MailOutbox, error)
+	FindByStatus(ctx context.Context, status MailStatus, limit int, offset int) ([]*MailOutbox, error)
+	Save(ctx context.Context, mail *MailOutbox) error
+	ClaimDue(ctx context.Context, limit int, staleAfter time.Duration) ([]*MailOutbox, error)
+	MarkSent(ctx context.Context, mail *MailOutbox) error
+	MarkRetry(ctx context.Context, mail *MailOutbox, nextAttemptAt time.Time, lastError string) error
+	MarkDead(ctx context.Context, mail *MailOutbox, lastError string) error
+	Requeue(ctx context.Context, mail *MailOutbox) error
+}
+
+var _ IMailOutboxRepository = (*MailOutboxRepository)(nil)
+
+type MailOutboxRepository struct {
+	Engine *gorm.DB
+}
+
+func NewMailOutboxRepository(engine *gorm.DB) *MailOutboxRepository {
+	return &MailOutboxRepository{
+		Engine: engine,
+	}
+}
+
+func (repo *MailOutboxRepository) FindByID(ctx context.Context, id uint) (*MailOutbox, error) {
+	var mail MailOutbox
+	err := repo.Engine.WithContext(ctx).First(&mail, id).Error
+	if err != nil {
+		return nil, err
+	}
+	return &mail, nil
+}
+
+func (repo *MailOutboxRepository) FindByIdempotencyKey(ctx context.Context, key string) (*MailOutbox, error) {
+	var mail MailOutbox
+	err := repo.Engine.WithContext(ctx).First(&mail, "idempotency_key = ?", key).Error
+	if err != nil {
+		return nil, err
+	}
+	return &mail, nil
+}
+
+func (repo *MailOutboxRepository) FindByStatus(ctx context.Context, status MailStatus, limit int, offset int) ([]*MailOutbox, error) {
+	var mails []*MailOutbox
+	tx := repo.Engine.WithContext(ctx).Order("id desc").Limit(limit).Offset(offset)
+	if status != "" {
+		tx = tx.Where("status = ?", status)
+	}
+	if err := tx.Find(&mails).Error; err != nil {
+		return nil, err
+	}
+	return mails, nil
+}
+
+func (repo *MailOutboxRepository) Save(ctx context.Context, mail *MailOutbox) error {
+	return repo.Engine.WithContext(ctx).Save(mail).Error
+}
+
+// ClaimDue locks due messages with SKIP LOCKED and flags them as sending, so several workers
+// and replicas never pick the same message. Messages stuck in sending longer than staleAfter
+// (e.g. the worker died mid-delivery) are claimed again.
+func (repo *MailOutboxRepository) ClaimDue(ctx context.Context, limit int, staleAfter time.Duration) ([]*MailOutbox, error) {
+	var mails []*MailOutbox
+	now := time.Now()
+	err := repo.Engine.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("(status = ? AND next_attempt_at <= ?) OR (status = ? AND updated_at < ?)",
+				MailStatusPending, now, MailStatusSending, now.Add(-staleAfter)).
+			Order("next_attempt_at").
+			Limit(limit).
+			Find(&mails).Error
+		if err != nil || len(mails) == 0 {
+			return err
+		}
+
+		ids := make([]uint, len(mails))
+		for idx, mail := range mails {
+			ids[idx] = mail.ID
+			mail.Status = MailStatusSending
+		}
+		return tx.Model(&MailOutbox{}).Where("id IN ?", ids).Updates(map[string]any{
+			"status":     MailStatusSending,
+			"updated_at": now,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return mails, nil
+}
+
+func (repo *MailOutboxRepository) MarkSent(ctx context.Context, mail *MailOutbox) error {
+	return repo.Engine.WithContext(ctx).Model(mail).Updates(map[string]any{
+		"status":     MailStatusSent,
+		"attempts":   gorm.Expr("attempts + 1"),
+		"sent_at":    time.Now(),
+		"last_error": "",
+	}).Error
+}
+
+func (repo *MailOutboxRepository) MarkRetry(ctx context.Context, mail *MailOutbox, nextAttemptAt time.Time, lastError string) error {
+	return repo.Engine.WithContext(ctx).Model(mail).Updates(map[string]any{
+		"status":          MailStatusPending,
+		"attempts":        gorm.Expr("attempts + 1"),
+		"next_attempt_at": nextAttemptAt,
+		"last_error":      lastError,
+	}).Error
+}
+
+func (repo *MailOutboxRepository) MarkDead(ctx context.Context, mail *MailOutbox, lastError string) error {
+	return repo.Engine.WithContext(ctx).Model(mail).Updates(map[string]any{
+		"status":     MailStatusDead,
+		"attempts":   gorm.Expr("attempts + 1"),
+		"last_error": lastError,
+	}).Error
+}
+
+func (repo *MailOutboxRepository) Requeue(ctx context.Context, mail *MailOutbox) error {
+	return repo.Engine.WithContext(ctx).Model(mail).Updates(map[string]any{
+		"status":          MailStatusPending,
+		"attempts":        0,
+		"next_attempt_at": time.Now(),
+	}).Error
+}
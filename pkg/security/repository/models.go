@@ -1,22 +1,87 @@
 package repository
 
 import (
+	"database/sql/driver"
+	"encoding/json"
 	"fmt"
 	"github.com/lib/pq"
+	"gorm.io/gorm"
 	"time"
 )
 
+type AccountStatus string
+
+const (
+	AccountStatusActive   AccountStatus = "active"
+	AccountStatusDisabled AccountStatus = "disabled"
+	AccountStatusLocked   AccountStatus = "locked"
+	AccountStatusPending  AccountStatus = "pending"
+)
+
+var AccountStatuses = []AccountStatus{AccountStatusActive, AccountStatusDisabled, AccountStatusLocked, AccountStatusPending}
+
+// UserAttributes holds the custom fields applications add to their users, stored as jsonb.
+type UserAttributes map[string]any
+
+func (attributes UserAttributes) Value() (driver.Value, error) {
+	if attributes == nil {
+		return nil, nil
+	}
+	return json.Marshal(attributes)
+}
+
+func (attributes *UserAttributes) Scan(value any) error {
+	*attributes = nil
+	switch raw := value.(type) {
+	case nil:
+		return nil
+	case []byte:
+		return json.Unmarshal(raw, attributes)
+	case string:
+		return json.Unmarshal([]byte(raw), attributes)
+	}
+	return fmt.Errorf("unsupported type %T for UserAttributes", value)
+}
+
 type User struct {
 	Name       string         `gorm:"type:varchar(100);not null" json:"name"`
 	Email      string         `gorm:"type:varchar(100);unique;not null" json:"email"`
 	Password   string         `gorm:"type:varchar(255);not null" json:"-"` // Excluded from JSON responses
 	IsVerified bool           `gorm:"default:false" json:"is_verified"`
 	Roles      pq.StringArray `gorm:"type:text[]" json:"roles"`
+	Locale     string         `gorm:"type:varchar(16)" json:"locale"`
+	AvatarFile string         `gorm:"type:varchar(255)" json:"avatar_file"`
+	Attributes UserAttributes `gorm:"type:jsonb" json:"attributes"`
+
+	// PasswordHistory holds the hashes of previous passwords, most recent first
+	PasswordHistory pq.StringArray `gorm:"type:text[]" json:"-"`
+
+	TotpSecret        string         `gorm:"type:varchar(64)" json:"-"`
+	TotpEnabled       bool           `gorm:"default:false" json:"totp_enabled"`
+	TotpRecoveryCodes pq.StringArray `gorm:"type:text[]" json:"-"` // bcrypt hashes of unused recovery codes
+	// TotpLastStep is the time step of the last accepted code, codes of that step or earlier are refused
+	TotpLastStep    int64 `gorm:"default:0" json:"-"`
+	EmailOtpEnabled bool  `gorm:"default:false" json:"email_otp_enabled"`
+
+	FailedLoginCount  int        `gorm:"default:0" json:"failed_login_count"`
+	LastFailedLoginAt *time.Time `json:"last_failed_login_at"`
+	LockedUntil       *time.Time `json:"locked_until"`
+
+	// Status decides whether the user may sign in, StatusReason tells the user or admins why not
+	Status          AccountStatus `gorm:"type:varchar(16);not null;default:active;index" json:"status"`
+	StatusReason    string        `gorm:"type:varchar(255)" json:"status_reason"`
+	StatusChangedAt *time.Time    `json:"status_changed_at"`
+	// DeletionScheduledAt is when a deletion requested by the user itself takes effect
+	DeletionScheduledAt *time.Time `json:"deletion_scheduled_at"`
 
-	ID        uint       `gorm:"primaryKey" json:"id"` // Auto-increment primary key
-	CreatedAt time.Time  `json:"created_at"`
-	UpdatedAt time.Time  `json:"updated_at"`
-	DeletedAt *time.Time `json:"deleted_at"`
+	ID        uint           `gorm:"primaryKey" json:"id"` // Auto-increment primary key
+	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+	DeletedAt gorm.DeletedAt `gorm:"index" json:"deleted_at"`
+}
+
+func (user *User) IsActive() bool {
+	return user.Status == AccountStatusActive
 }
 
 func (user *User) Validate() error {
@@ -31,3 +96,48 @@ func (user *User) Validate() error {
 	}
 	return nil
 }
+
+type Invitation struct {
+	Email      string         `gorm:"type:varchar(100);not null;index" json:"email"`
+	Roles      pq.StringArray `gorm:"type:text[]" json:"roles"`
+	Locale     string         `gorm:"type:varchar(16)" json:"locale"`
+	InvitedBy  uint           `json:"invited_by"`
+	ExpiresAt  time.Time      `gorm:"not null" json:"expires_at"`
+	AcceptedAt *time.Time     `json:"accepted_at"`
+
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (invitation *Invitation) IsExpired() bool {
+	return time.Now().After(invitation.ExpiresAt)
+}
+
+type MailStatus string
+
+const (
+	MailStatusPending MailStatus = "pending"
+	MailStatusSending MailStatus = "sending"
+	MailStatusSent    MailStatus = "sent"
+	MailStatusDead    MailStatus = "dead"
+)
+
+// MailOutbox is a queued outgoing email, RawMessage holds the complete MIME message
+// so it can be delivered again exactly as it was built.
+type MailOutbox struct {
+	IdempotencyKey *string        `gorm:"type:varchar(255);uniqueIndex" json:"idempotency_key"`
+	Sender         string         `gorm:"type:varchar(255);not null" json:"sender"`
+	Recipients     pq.StringArray `gorm:"type:text[]" json:"recipients"`
+	Subject        string         `gorm:"type:varchar(255)" json:"subject"`
+	RawMessage     []byte         `gorm:"type:bytea" json:"-"`
+	Status         MailStatus     `gorm:"type:varchar(16);not null;index" json:"status"`
+	Attempts       int            `gorm:"default:0" json:"attempts"`
+	NextAttemptAt  time.Time      `gorm:"index" json:"next_attempt_at"`
+	LastError      string         `gorm:"type:text" json:"last_error"`
+	SentAt         *time.Time     `json:"sent_at"`
+
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
@@ -2,20 +2,128 @@ package repository
 
 import (
 	"context"
+	"encoding/json"
 	"github.com/lib/pq"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"slices"
+	"strings"
+	"time"
 )
 
+// UserSortFields are the columns the user listing can be ordered by.
+var UserSortFields = []string{"id", "name", "email", "created_at", "updated_at"}
+
+// UserQuery filters the user listing, zero values leave the filter out. Soft-deleted users are
+// only listed, and then exclusively, with Deleted.
+type UserQuery struct {
+	// Search matches name or email, case-insensitively
+	Search        string
+	IsVerified    *bool
+	Status        AccountStatus
+	Role          string
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	Deleted       bool
+	SortBy        string
+	Descending    bool
+	Limit         int
+	Offset        int
+}
+
 type IUserRepository interface {
 	FindAll(ctx context.Context) ([]*User, error)
+	FindPage(ctx context.Context, query *UserQuery) ([]*User, int64, error)
 	FindByID(ctx context.Context, id uint) (*User, error)
 	Save(ctx context.Context, user *User) error
+	SaveWith(ctx context.Context, user *User, sync func(tx *gorm.DB) error) error
 	DeleteByID(ctx context.Context, id uint) error
 	FindByEmail(ctx context.Context, email string) (*User, error)
 	FindByUserName(ctx context.Context, name string) (*User, error)
 	UpdateUserPassword(ctx context.Context, user *User, password string) error
+	UpdateUserPasswordWithHistory(ctx context.Context, user *User, password string, history []string) error
 	ActivateUser(ctx context.Context, user *User) error
 	UpdateUserRoles(ctx context.Context, user *User, roles []string) error
+	UpdateUserRolesWith(ctx context.Context, user *User, roles []string, sync func(tx *gorm.DB) error) error
+	UpdateUserTotp(ctx context.Context, user *User, secret string, enabled bool, recoveryCodes []string) error
+	UpdateUserRecoveryCodes(ctx context.Context, user *User, recoveryCodes []string) error
+	AcceptUserTotpStep(ctx context.Context, user *User, step int64) (bool, error)
+	UpdateUserEmailOtp(ctx context.Context, user *User, enabled bool) error
+	UpdateUserLoginFailures(ctx context.Context, user *User, failedCount int, lastFailedAt *time.Time, lockedUntil *time.Time) error
+	RecordUserLoginFailure(ctx context.Context, user *User, failure *LoginFailure) error
+	UpdateUserProfile(ctx context.Context, user *User, name string, email string, locale string, isVerified bool) error
+	UpdateUserStatus(ctx context.Context, user *User, status AccountStatus, reason string) error
+	FindDeletedByID(ctx context.Context, id uint) (*User, error)
+	FindConflicting(ctx context.Context, email string, name string) ([]*User, error)
+	RestoreByID(ctx context.Context, id uint) error
+	FindDeletedBefore(ctx context.Context, deletedBefore time.Time) ([]*User, error)
+	PurgeWith(ctx context.Context, user *User, sync func(tx *gorm.DB) error) error
+	UpdateUserAvatar(ctx context.Context, user *User, avatarFile string) error
+	MergeUserAttributes(ctx context.Context, user *User, set UserAttributes, removed []string) error
+	UpdateUserDeletionScheduledAt(ctx context.Context, user *User, scheduledAt *time.Time) error
+	FindDueForDeletion(ctx context.Context, now time.Time) ([]*User, error)
+}
+
+// UserEmailIndex and UserNameIndex keep emails and names unique case-insensitively, soft-deleted
+// users included, so concurrent registrations cannot both pass the availability check.
+const (
+	UserEmailIndex = "idx_users_lower_email"
+	UserNameIndex  = "idx_users_lower_name"
+)
+
+// UserConflict lists the users sharing an email or name ignoring case, which keeps the unique
+// index of that column from being built.
+type UserConflict struct {
+	Column string `gorm:"-"`
+	Value  string
+	IDs    pq.Int64Array `gorm:"column:ids"`
+}
+
+// MigrateUserIndexes creates the indexes gorm cannot declare on the model. An index is skipped
+// while stored users share its value, those users are returned so an operator can resolve them
+// and the index is created on a later start.
+func MigrateUserIndexes(engine *gorm.DB) ([]*UserConflict, error) {
+	var skipped []*UserConflict
+	for _, index := range [][2]string{{UserEmailIndex, "email"}, {UserNameIndex, "name"}} {
+		name, column := index[0], index[1]
+		if engine.Migrator().HasIndex(&User{}, name) {
+			continue
+		}
+		var conflicts []*UserConflict
+		err := engine.Raw("SELECT LOWER(" + column + ") AS value, array_agg(id ORDER BY id) AS ids " +
+			"FROM users GROUP BY LOWER(" + column + ") HAVING COUNT(*) > 1").Scan(&conflicts).Error
+		if err != nil {
+			return nil, err
+		}
+		if len(conflicts) > 0 {
+			for _, conflict := range conflicts {
+				conflict.Column = column
+			}
+			skipped = append(skipped, conflicts...)
+			continue
+		}
+		if err := engine.Exec("CREATE UNIQUE INDEX IF NOT EXISTS " + name + " ON users (LOWER(" + column + "))").Error; err != nil {
+			return nil, err
+		}
+	}
+	return skipped, nil
+}
+
+// MigrateUserStatus turns the disabled_at column the account status replaced into the disabled
+// status, then drops it so the migration runs once.
+func MigrateUserStatus(engine *gorm.DB) error {
+	migrator := engine.Migrator()
+	if !migrator.HasColumn(&User{}, "disabled_at") {
+		return nil
+	}
+	return engine.Transaction(func(tx *gorm.DB) error {
+		err := tx.Exec("UPDATE users SET status = ?, status_changed_at = disabled_at WHERE disabled_at IS NOT NULL AND status = ?",
+			AccountStatusDisabled, AccountStatusActive).Error
+		if err != nil {
+			return err
+		}
+		return tx.Migrator().DropColumn(&User{}, "disabled_at")
+	})
 }
 
 var _ IUserRepository = (*UserRepository)(nil)
@@ -34,7 +142,7 @@ func (repo *UserRepository) createPreloadTx(ctx context.Context) *gorm.DB {
 
 func (repo *UserRepository) FindByEmail(ctx context.Context, email string) (*User, error) {
 	var user User
-	err := repo.createPreloadTx(ctx).First(&user, "email = ?", email).Error
+	err := repo.createPreloadTx(ctx).First(&user, "LOWER(email) = LOWER(?)", email).Error
 	if err != nil {
 		return nil, err
 	}
@@ -43,7 +151,7 @@ func (repo *UserRepository) FindByEmail(ctx context.Context, email string) (*Use
 
 func (repo *UserRepository) FindByUserName(ctx context.Context, name string) (*User, error) {
 	var user User
-	err := repo.createPreloadTx(ctx).First(&user, "name = ?", name).Error
+	err := repo.createPreloadTx(ctx).First(&user, "LOWER(name) = LOWER(?)", name).Error
 	if err != nil {
 		return nil, err
 	}
@@ -59,6 +167,61 @@ func (repo *UserRepository) FindAll(ctx context.Context) ([]*User, error) {
 	return users, nil
 }
 
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// escapeLike makes the wildcards of a LIKE pattern match literally.
+func escapeLike(value string) string {
+	return likeEscaper.Replace(value)
+}
+
+// FindPage returns one page of the users matching the query and the number of matching users.
+func (repo *UserRepository) FindPage(ctx context.Context, query *UserQuery) ([]*User, int64, error) {
+	tx := repo.createPreloadTx(ctx).Model(&User{})
+	if query.Deleted {
+		tx = tx.Unscoped().Where("deleted_at IS NOT NULL")
+	}
+	if query.Search != "" {
+		pattern := "%" + escapeLike(strings.ToLower(query.Search)) + "%"
+		tx = tx.Where(`LOWER(name) LIKE ? ESCAPE '\' OR LOWER(email) LIKE ? ESCAPE '\'`, pattern, pattern)
+	}
+	if query.IsVerified != nil {
+		tx = tx.Where("is_verified = ?", *query.IsVerified)
+	}
+	if query.Status != "" {
+		tx = tx.Where("status = ?", query.Status)
+	}
+	if query.Role != "" {
+		tx = tx.Where("? = ANY(roles)", query.Role)
+	}
+	if query.CreatedAfter != nil {
+		tx = tx.Where("created_at >= ?", *query.CreatedAfter)
+	}
+	if query.CreatedBefore != nil {
+		tx = tx.Where("created_at < ?", *query.CreatedBefore)
+	}
+
+	// A new session keeps the count from leaking into the page query
+	tx = tx.Session(&gorm.Session{})
+	var total int64
+	if err := tx.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	sortBy := "id"
+	if slices.Contains(UserSortFields, query.SortBy) {
+		sortBy = query.SortBy
+	}
+	var users []*User
+	err := tx.Order(clause.OrderByColumn{Column: clause.Column{Name: sortBy}, Desc: query.Descending}).
+		Limit(query.Limit).
+		Offset(query.Offset).
+		Find(&users).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	return users, total, nil
+}
+
 func (repo *UserRepository) FindByID(ctx context.Context, id uint) (*User, error) {
 	var user User
 	err := repo.createPreloadTx(ctx).First(&user, id).Error
@@ -72,6 +235,16 @@ func (repo *UserRepository) Save(ctx context.Context, user *User) error {
 	return repo.Engine.WithContext(ctx).Save(user).Error
 }
 
+// SaveWith saves the user and runs sync in the same transaction.
+func (repo *UserRepository) SaveWith(ctx context.Context, user *User, sync func(tx *gorm.DB) error) error {
+	return repo.Engine.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(user).Error; err != nil {
+			return err
+		}
+		return sync(tx)
+	})
+}
+
 func (repo *UserRepository) DeleteByID(ctx context.Context, id uint) error {
 	return repo.Engine.WithContext(ctx).Delete(&User{}, id).Error
 }
@@ -80,10 +253,216 @@ func (repo *UserRepository) UpdateUserPassword(ctx context.Context, user *User,
 	return repo.Engine.WithContext(ctx).Model(user).Update("password", password).Error
 }
 
+func (repo *UserRepository) UpdateUserPasswordWithHistory(ctx context.Context, user *User, password string, history []string) error {
+	return repo.Engine.WithContext(ctx).Model(user).Updates(map[string]any{
+		"password":         password,
+		"password_history": pq.StringArray(history),
+	}).Error
+}
+
 func (repo *UserRepository) UpdateUserRoles(ctx context.Context, user *User, roles []string) error {
 	return repo.Engine.WithContext(ctx).Model(user).Update("roles", pq.StringArray(roles)).Error
 }
 
+// UpdateUserRolesWith stores the roles and runs sync in the same transaction, both are kept or neither.
+func (repo *UserRepository) UpdateUserRolesWith(ctx context.Context, user *User, roles []string, sync func(tx *gorm.DB) error) error {
+	return repo.Engine.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(user).Update("roles", pq.StringArray(roles)).Error; err != nil {
+			return err
+		}
+		return sync(tx)
+	})
+}
+
+func (repo *UserRepository) UpdateUserTotp(ctx context.Context, user *User, secret string, enabled bool, recoveryCodes []string) error {
+	return repo.Engine.WithContext(ctx).Model(user).Updates(map[string]any{
+		"totp_secret":         secret,
+		"totp_enabled":        enabled,
+		"totp_recovery_codes": pq.StringArray(recoveryCodes),
+	}).Error
+}
+
+func (repo *UserRepository) UpdateUserRecoveryCodes(ctx context.Context, user *User, recoveryCodes []string) error {
+	return repo.Engine.WithContext(ctx).Model(user).Update("totp_recovery_codes", pq.StringArray(recoveryCodes)).Error
+}
+
+// AcceptUserTotpStep stores the step of an accepted TOTP code unless that step or a later one was
+// accepted already, concurrent uses of the same code are accepted only once.
+func (repo *UserRepository) AcceptUserTotpStep(ctx context.Context, user *User, step int64) (bool, error) {
+	result := repo.Engine.WithContext(ctx).Model(user).
+		Where("totp_last_step < ?", step).
+		Update("totp_last_step", step)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+func (repo *UserRepository) UpdateUserEmailOtp(ctx context.Context, user *User, enabled bool) error {
+	return repo.Engine.WithContext(ctx).Model(user).Update("email_otp_enabled", enabled).Error
+}
+
+func (repo *UserRepository) UpdateUserLoginFailures(ctx context.Context, user *User, failedCount int, lastFailedAt *time.Time, lockedUntil *time.Time) error {
+	return repo.Engine.WithContext(ctx).Model(user).Updates(map[string]any{
+		"failed_login_count":   failedCount,
+		"last_failed_login_at": lastFailedAt,
+		"locked_until":         lockedUntil,
+	}).Error
+}
+
+// LoginFailure describes a failed login to count, RecordUserLoginFailure fills in the resulting
+// FailedCount and LockedUntil.
+type LoginFailure struct {
+	FailedAt time.Time
+	// WindowStart is the time before which earlier failures no longer count
+	WindowStart time.Time
+	MaxFailures int
+	// LockUntil is when the lock started by this failure ends
+	LockUntil time.Time
+
+	FailedCount int
+	LockedUntil *time.Time
+}
+
+// loginFailureRestart tells whether the failure starts the count over, as the previous ones left
+// the window or the lock they caused is over.
+const loginFailureRestart = `(last_failed_login_at IS NULL OR last_failed_login_at < @window_start OR locked_until < @failed_at)`
+
+const recordLoginFailureSql = `
+UPDATE users SET
+	failed_login_count = CASE WHEN ` + loginFailureRestart + ` THEN 1 ELSE failed_login_count + 1 END,
+	locked_until = CASE
+		WHEN (CASE WHEN ` + loginFailureRestart + ` THEN 1 ELSE failed_login_count + 1 END) >= @max_failures THEN @lock_until
+		WHEN ` + loginFailureRestart + ` THEN NULL
+		ELSE locked_until
+	END,
+	last_failed_login_at = @failed_at,
+	updated_at = @failed_at
+WHERE id = @id
+RETURNING failed_login_count, locked_until`
+
+// RecordUserLoginFailure counts the failure in a single statement, so concurrent failures are all counted.
+func (repo *UserRepository) RecordUserLoginFailure(ctx context.Context, user *User, failure *LoginFailure) error {
+	var result struct {
+		FailedLoginCount int
+		LockedUntil      *time.Time
+	}
+	err := repo.Engine.WithContext(ctx).Raw(recordLoginFailureSql, map[string]any{
+		"id":           user.ID,
+		"failed_at":    failure.FailedAt,
+		"window_start": failure.WindowStart,
+		"max_failures": failure.MaxFailures,
+		"lock_until":   failure.LockUntil,
+	}).Scan(&result).Error
+	if err != nil {
+		return err
+	}
+	failure.FailedCount, failure.LockedUntil = result.FailedLoginCount, result.LockedUntil
+	user.FailedLoginCount, user.LastFailedLoginAt, user.LockedUntil = result.FailedLoginCount, &failure.FailedAt, result.LockedUntil
+	return nil
+}
+
+func (repo *UserRepository) UpdateUserProfile(ctx context.Context, user *User, name string, email string, locale string, isVerified bool) error {
+	return repo.Engine.WithContext(ctx).Model(user).Updates(map[string]any{
+		"name":        name,
+		"email":       email,
+		"locale":      locale,
+		"is_verified": isVerified,
+	}).Error
+}
+
+func (repo *UserRepository) UpdateUserStatus(ctx context.Context, user *User, status AccountStatus, reason string) error {
+	return repo.Engine.WithContext(ctx).Model(user).Updates(map[string]any{
+		"status":            status,
+		"status_reason":     reason,
+		"status_changed_at": time.Now(),
+	}).Error
+}
+
+func (repo *UserRepository) FindDeletedByID(ctx context.Context, id uint) (*User, error) {
+	var user User
+	err := repo.createPreloadTx(ctx).Unscoped().Where("deleted_at IS NOT NULL").First(&user, id).Error
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// FindConflicting returns the users, soft-deleted ones included, holding the email or the name.
+func (repo *UserRepository) FindConflicting(ctx context.Context, email string, name string) ([]*User, error) {
+	var users []*User
+	err := repo.createPreloadTx(ctx).Unscoped().
+		Where("LOWER(email) = LOWER(?) OR LOWER(name) = LOWER(?)", email, name).
+		Find(&users).Error
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (repo *UserRepository) RestoreByID(ctx context.Context, id uint) error {
+	return repo.Engine.WithContext(ctx).Unscoped().Model(&User{}).Where("id = ?", id).Update("deleted_at", nil).Error
+}
+
+func (repo *UserRepository) FindDeletedBefore(ctx context.Context, deletedBefore time.Time) ([]*User, error) {
+	var users []*User
+	err := repo.Engine.WithContext(ctx).Unscoped().Where("deleted_at < ?", deletedBefore).Find(&users).Error
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// PurgeWith removes the user for good and runs sync in the same transaction.
+func (repo *UserRepository) PurgeWith(ctx context.Context, user *User, sync func(tx *gorm.DB) error) error {
+	return repo.Engine.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Delete(user).Error; err != nil {
+			return err
+		}
+		return sync(tx)
+	})
+}
+
+func (repo *UserRepository) UpdateUserAvatar(ctx context.Context, user *User, avatarFile string) error {
+	return repo.Engine.WithContext(ctx).Model(user).Update("avatar_file", avatarFile).Error
+}
+
+// MergeUserAttributes sets and removes attributes in the stored jsonb, concurrent updates of other
+// attributes are kept. The user gets the attributes as stored afterwards.
+func (repo *UserRepository) MergeUserAttributes(ctx context.Context, user *User, set UserAttributes, removed []string) error {
+	setJson, err := json.Marshal(set)
+	if err != nil {
+		return err
+	}
+	var attributes UserAttributes
+	err = repo.Engine.WithContext(ctx).Raw(
+		`UPDATE users SET attributes = (COALESCE(attributes, '{}'::jsonb) || ?::jsonb) - ?::text[], updated_at = ?
+		WHERE id = ? RETURNING attributes`,
+		string(setJson), pq.StringArray(removed), time.Now(), user.ID,
+	).Row().Scan(&attributes)
+	if err != nil {
+		return err
+	}
+	user.Attributes = attributes
+	return nil
+}
+
+func (repo *UserRepository) UpdateUserDeletionScheduledAt(ctx context.Context, user *User, scheduledAt *time.Time) error {
+	return repo.Engine.WithContext(ctx).Model(user).Update("deletion_scheduled_at", scheduledAt).Error
+}
+
+// FindDueForDeletion returns the users whose scheduled deletion has passed.
+func (repo *UserRepository) FindDueForDeletion(ctx context.Context, now time.Time) ([]*User, error) {
+	var users []*User
+	err := repo.createPreloadTx(ctx).
+		Where("deletion_scheduled_at <= ?", now).
+		Find(&users).Error
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
 func NewUserRepository(engine *gorm.DB) *UserRepository {
 	return &UserRepository{
 		Engine: engine,
@@ -0,0 +1,17 @@
+package repository
+
+import "testing"
+
+func TestEscapeLike(t *testing.T) {
+	tests := map[string]string{
+		"alice":     "alice",
+		"100%":      `100\%`,
+		"a_b":       `a\_b`,
+		`back\path`: `back\\path`,
+	}
+	for value, expected := range tests {
+		if escaped := escapeLike(value); escaped != expected {
+			t.Fatalf("expected %q for %q, got %q", expected, value, escaped)
+		}
+	}
+}
@@ -9,7 +9,22 @@ type SecurityConfig struct {
 	Security struct {
 		Secret string `yaml:"secret" validate:"required"`
 	} `yaml:"security" validate:"required"`
-	Smtp *service.SmtpConfig `yaml:"smtp" validate:"required"`
+	Smtp       *service.SmtpConfig      `yaml:"smtp" validate:"required"`
+	Mfa        service.MfaConfig        `yaml:"mfa"`
+	Invitation service.InvitationConfig `yaml:"invitation"`
+	Template   service.TemplateConfig   `yaml:"template"`
+	MailQueue  service.MailQueueConfig  `yaml:"mail_queue"`
+	Casbin     service.CasbinConfig     `yaml:"casbin"`
+
+	Registration    service.RegistrationConfig    `yaml:"registration"`
+	LoginProtection service.LoginProtectionConfig `yaml:"login_protection"`
+	PasswordPolicy  service.PasswordPolicyConfig  `yaml:"password_policy"`
+	PasswordHash    service.PasswordHashConfig    `yaml:"password_hash"`
+	Verification    service.VerificationConfig    `yaml:"verification"`
+	Profile         service.ProfileConfig         `yaml:"profile"`
+	UserPurge       service.UserPurgeConfig       `yaml:"user_purge"`
+	UserAttributes  service.UserAttributeConfig   `yaml:"user_attributes"`
+	AdminBootstrap  service.AdminBootstrapConfig  `yaml:"admin_bootstrap"`
 }
 
 func MustNewSecurityConfig(configPath string) *SecurityConfig {
@@ -4,6 +4,7 @@ import (
 	"github.com/GolangSpring/gospring/application"
 	"github.com/GolangSpring/gospring/pkg/postgres"
 	"github.com/GolangSpring/gospring/pkg/security/controller"
+	"github.com/GolangSpring/gospring/pkg/security/middleware"
 	securityRepository "github.com/GolangSpring/gospring/pkg/security/repository"
 	"github.com/casbin/casbin/v2"
 	"github.com/casbin/casbin/v2/model"
@@ -22,57 +23,132 @@ func MustNewSecurityContext(securityConfig *SecurityConfig, postgresContext *app
 		log.Fatal().Msgf("Failed to get Postgres engine service from context: %v", err)
 	}
 
-	models := []any{securityRepository.User{}}
+	models := []any{securityRepository.User{}, securityRepository.Invitation{}, securityRepository.MailOutbox{}}
 
 	if err = service.MigrateModels(models...); err != nil {
 		log.Fatal().Msgf("Failed to migrate models: %v", err)
 	}
+	conflicts, err := securityRepository.MigrateUserIndexes(service.Engine)
+	if err != nil {
+		log.Fatal().Msgf("Failed to migrate user indexes: %v", err)
+	}
+	for _, conflict := range conflicts {
+		log.Warn().Msgf("Users %v share the %s %q ignoring case, its unique index is skipped until they are resolved",
+			conflict.IDs, conflict.Column, conflict.Value)
+	}
+	if err = securityRepository.MigrateUserStatus(service.Engine); err != nil {
+		log.Fatal().Msgf("Failed to migrate disabled users to the account status: %v", err)
+	}
 
 	adapter, err := gormadapter.NewAdapterByDB(service.Engine)
 	if err != nil {
 		log.Fatal().Msgf("Failed to create Casbin adapter: %v", err)
 	}
 
-	casbinModel, err := model.NewModelFromString(securityService.ModelString)
+	casbinModel, err := model.NewModelFromString(securityConfig.Casbin.ModelString())
 	if err != nil {
 		log.Fatal().Msgf("Failed to create Casbin model: %v", err)
 	}
 
-	enforcer, err := casbin.NewEnforcer(casbinModel, adapter)
+	enforcer, err := casbin.NewSyncedEnforcer(casbinModel, adapter)
 	if err != nil {
 		log.Fatal().Msgf("Failed to create Casbin enforcer: %v", err)
 	}
 
-	casbinService := securityService.NewCasbinService(enforcer)
+	casbinService := securityService.NewCasbinService(enforcer, service.Engine, &securityConfig.Casbin)
 
 	engine := service.Engine
 	userRepo := securityRepository.NewUserRepository(engine)
+	invitationRepo := securityRepository.NewInvitationRepository(engine)
 
-	userService := securityService.NewUserService(userRepo)
-	authService := securityService.NewAuthService(userService, securityConfig.Security.Secret)
-
+	attributeSchema, err := securityService.NewUserAttributeSchema(&securityConfig.UserAttributes)
+	if err != nil {
+		log.Fatal().Msgf("Failed to load the user attribute schema: %v", err)
+	}
+	userService := securityService.NewUserService(userRepo, attributeSchema)
 	smtpService := securityService.NewSmtpService(securityConfig.Smtp)
+	templateService := securityService.NewTemplateService(&securityConfig.Template, securityConfig.Smtp)
+
+	// With the mail queue enabled every flow enqueues into the outbox instead of sending in the request
+	var mailService securityService.ISmtpService = smtpService
+	var mailQueueService *securityService.MailQueueService
+	if securityConfig.MailQueue.Enabled {
+		mailOutboxRepo := securityRepository.NewMailOutboxRepository(engine)
+		mailQueueService = securityService.NewMailQueueService(smtpService, mailOutboxRepo, &securityConfig.MailQueue)
+		mailService = mailQueueService
+	}
 	otpService := securityService.NewOtpService(securityService.DefaultGenerateOtpCodeFunc)
 
-	_ = securityService.NewUserVerificationService(smtpService, userService, authService, otpService)
-	userResetPasswordService := securityService.NewUserResetPasswordService(smtpService, userService, authService, otpService)
-
-	authController := controller.NewAuthController(authService, casbinService)
-	casbinController := controller.NewCasbinController(casbinService, authService)
+	loginThrottleService := securityService.NewLoginThrottleService(userService, mailService, templateService, &securityConfig.LoginProtection)
+	passwordHasher := securityService.NewPasswordHasher(&securityConfig.PasswordHash)
+	passwordPolicyService := securityService.NewPasswordPolicyService(passwordHasher, &securityConfig.PasswordPolicy)
+	authService := securityService.NewAuthService(userService, mailService, templateService, otpService, loginThrottleService, passwordPolicyService, passwordHasher, casbinService, securityConfig.Security.Secret, &securityConfig.Mfa, &securityConfig.Registration)
+	totpService := securityService.NewTotpService(userService, authService, loginThrottleService, &securityConfig.Mfa)
+
+	userVerificationService := securityService.NewUserVerificationService(mailService, templateService, userService, authService, otpService, &securityConfig.Verification)
+	userResetPasswordService := securityService.NewUserResetPasswordService(mailService, templateService, userService, authService, otpService)
+	profileService := securityService.NewProfileService(userService, authService, otpService, mailService, templateService, loginThrottleService, &securityConfig.Profile)
+	invitationService := securityService.NewInvitationService(invitationRepo, mailService, templateService, userService, authService, casbinService, &securityConfig.Invitation)
+
+	// The admin routes declare the role the admin bootstrap gives, so they follow its configuration
+	adminRole := securityConfig.AdminBootstrap.GetRole()
+	authController := controller.NewAuthController(authService, casbinService, userVerificationService, adminRole)
+	casbinController := controller.NewCasbinController(casbinService, authService, adminRole)
 	systemController := controller.NewSystemController()
+	mfaController := controller.NewMfaController(authService, userService, totpService)
+	accountController := controller.NewAccountController(userVerificationService, userResetPasswordService, adminRole)
+	invitationController := controller.NewInvitationController(invitationService, adminRole)
+	userAdminController := controller.NewUserAdminController(userService, adminRole)
+	profileController := controller.NewProfileController(profileService, userService)
+
+	services := []application.IService{
+		casbinService,
+		// Services are stopped in reverse order, so everyone sending mails stops before the transport closes
+		smtpService,
+		templateService,
+		userService,
+		loginThrottleService,
+		passwordPolicyService,
+		authService,
+		totpService,
+		userVerificationService,
+		userResetPasswordService,
+		invitationService,
+		profileService,
+		securityService.NewAdminBootstrapService(authService, userService, casbinService, &securityConfig.AdminBootstrap),
+	}
+	controllers := []application.IController{
+		authController,
+		casbinController,
+		systemController,
+		mfaController,
+		accountController,
+		invitationController,
+		userAdminController,
+		profileController,
+	}
+	if mailQueueService != nil {
+		services = append(services, mailQueueService)
+		controllers = append(controllers, controller.NewMailOutboxController(mailQueueService, adminRole))
+	}
+	if securityConfig.UserPurge.Enabled {
+		services = append(services, securityService.NewUserPurgeService(userService, invitationRepo, casbinService, profileService, &securityConfig.UserPurge))
+	}
+	if securityConfig.Verification.RequireVerified {
+		allowedRoutes := controller.UnverifiedAllowedPatterns(securityConfig.Verification.AllowedRoutes)
+		verifiedMiddleware, err := middleware.NewVerifiedMiddleware(casbinService, allowedRoutes)
+		if err != nil {
+			log.Fatal().Msgf("Invalid verification allowed route: %v", err)
+		}
+		controllers = append(controllers, controller.NewVerifiedController(verifiedMiddleware))
+	}
+	if memoryTransport, ok := securityService.UnwrapMailTransport(smtpService.Transport).(*securityService.MemoryTransport); ok {
+		controllers = append(controllers, controller.NewMailViewerController(memoryTransport, adminRole))
+	}
 
 	return &application.ApplicationContext{
-		Name: ContextName,
-		Services: []application.IService{
-			casbinService,
-			userService,
-			authService,
-			userResetPasswordService,
-		},
-		Controllers: []application.IController{
-			authController,
-			casbinController,
-			systemController,
-		},
+		Name:        ContextName,
+		Services:    services,
+		Controllers: controllers,
 	}
 }
@@ -0,0 +1,165 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/GolangSpring/gospring/application"
+	. "github.com/GolangSpring/gospring/pkg/security/repository"
+	"github.com/rs/zerolog/log"
+	"os"
+	"slices"
+)
+
+const (
+	DefaultAdminRole     = "admin"
+	DefaultAdminUserName = "admin"
+	// AdminPolicyObject grants the bootstrapped admin role every route
+	AdminPolicyObject = "^/.*$"
+
+	AdminEmailEnv    = "GOSPRING_ADMIN_EMAIL"
+	AdminUserNameEnv = "GOSPRING_ADMIN_USER_NAME"
+	AdminPasswordEnv = "GOSPRING_ADMIN_PASSWORD"
+)
+
+// AdminBootstrapConfig describes the first admin, the environment variables take precedence so
+// the password does not have to sit in the config file. Nothing is created without email and password.
+type AdminBootstrapConfig struct {
+	Email    string `yaml:"email"`
+	UserName string `yaml:"user_name"`
+	Password string `yaml:"password"`
+	Role     string `yaml:"role"`
+}
+
+func envOrDefault(name string, defaultValue string) string {
+	if value, ok := os.LookupEnv(name); ok && value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func (config *AdminBootstrapConfig) GetEmail() string {
+	return envOrDefault(AdminEmailEnv, config.Email)
+}
+
+func (config *AdminBootstrapConfig) GetUserName() string {
+	if config.UserName == "" {
+		return envOrDefault(AdminUserNameEnv, DefaultAdminUserName)
+	}
+	return envOrDefault(AdminUserNameEnv, config.UserName)
+}
+
+func (config *AdminBootstrapConfig) GetPassword() string {
+	return envOrDefault(AdminPasswordEnv, config.Password)
+}
+
+func (config *AdminBootstrapConfig) GetRole() string {
+	if config.Role == "" {
+		return DefaultAdminRole
+	}
+	return config.Role
+}
+
+var _ application.IService = (*AdminBootstrapService)(nil)
+
+// AdminBootstrapService creates the configured admin when no user holds the admin role yet, or gives
+// the role back to the configured admin account when it was demoted or deleted.
+type AdminBootstrapService struct {
+	AuthService          IAuthService
+	UserService          IUserService
+	CasbinService        *CasbinService
+	AdminBootstrapConfig *AdminBootstrapConfig
+}
+
+func NewAdminBootstrapService(
+	authService IAuthService,
+	userService IUserService,
+	casbinService *CasbinService,
+	adminBootstrapConfig *AdminBootstrapConfig,
+) *AdminBootstrapService {
+	return &AdminBootstrapService{
+		AuthService:          authService,
+		UserService:          userService,
+		CasbinService:        casbinService,
+		AdminBootstrapConfig: adminBootstrapConfig,
+	}
+}
+
+func (service *AdminBootstrapService) PostConstruct() {
+	config := service.AdminBootstrapConfig
+	if config.GetEmail() == "" || config.GetPassword() == "" {
+		return
+	}
+	if err := service.bootstrap(context.Background()); err != nil {
+		log.Fatal().Msgf("Failed to bootstrap admin %s: %v", config.GetEmail(), err)
+	}
+}
+
+func (service *AdminBootstrapService) bootstrap(ctx context.Context) error {
+	config := service.AdminBootstrapConfig
+	role := config.GetRole()
+	_, total, err := service.UserService.FindPage(ctx, &UserQuery{Role: role, Limit: 1})
+	if err != nil {
+		return err
+	}
+	if total > 0 {
+		return nil
+	}
+
+	user, err := service.AuthService.RegisterUser(ctx, config.GetUserName(), config.GetEmail(), config.GetPassword())
+	if errors.Is(err, UserExists) {
+		user, err = service.findExistingAdmin(ctx)
+		if err != nil || user == nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	if !user.IsVerified {
+		if err := service.UserService.ActivateUser(ctx, user); err != nil {
+			return err
+		}
+	}
+	roles := slices.Clone(user.Roles)
+	if !slices.Contains(roles, role) {
+		roles = append(roles, role)
+	}
+	if _, err := service.AuthService.AssignRoles(ctx, user.ID, roles); err != nil {
+		return err
+	}
+	if _, err := service.CasbinService.mergePolicy(&Policy{Subject: role, Object: AdminPolicyObject, Action: PolicyActionAny}); err != nil {
+		return err
+	}
+	if !user.IsActive() {
+		log.Warn().Msgf("Bootstrapped admin user %d is %s, they cannot sign in until an admin changes it", user.ID, user.Status)
+	}
+	log.Info().Msgf("Bootstrapped admin user %d (%s) with role %s", user.ID, user.Email, role)
+	return nil
+}
+
+// findExistingAdmin returns the user registered with the admin email, restored when it was soft deleted,
+// as it lost the admin role since. Nil is returned when another user holds the admin user name.
+func (service *AdminBootstrapService) findExistingAdmin(ctx context.Context) (*User, error) {
+	config := service.AdminBootstrapConfig
+	email := NormalizeEmail(config.GetEmail())
+	users, err := service.UserService.FindConflicting(ctx, email, config.GetUserName())
+	if err != nil {
+		return nil, err
+	}
+	idx := slices.IndexFunc(users, func(user *User) bool { return user.Email == email })
+	if idx < 0 {
+		log.Warn().Msgf("Admin %s not bootstrapped, the user name %s belongs to another user", email, config.GetUserName())
+		return nil, nil
+	}
+
+	user := users[idx]
+	if user.DeletedAt.Valid {
+		restored, err := service.UserService.RestoreUser(ctx, user.ID)
+		if err != nil {
+			return nil, err
+		}
+		log.Warn().Msgf("Restored deleted admin user %d (%s)", user.ID, email)
+		user = restored
+	}
+	return user, nil
+}
@@ -0,0 +1,70 @@
+package service
+
+import (
+	"context"
+	. "github.com/GolangSpring/gospring/pkg/security/repository"
+	"gorm.io/gorm"
+	"testing"
+	"time"
+)
+
+// bootstrapUserService holds the users FindConflicting returns, the other methods are left unimplemented.
+type bootstrapUserService struct {
+	IUserService
+	users    []*User
+	restored []uint
+}
+
+func (service *bootstrapUserService) FindConflicting(ctx context.Context, email string, name string) ([]*User, error) {
+	return service.users, nil
+}
+
+func (service *bootstrapUserService) RestoreUser(ctx context.Context, userID uint) (*User, error) {
+	service.restored = append(service.restored, userID)
+	for _, user := range service.users {
+		if user.ID == userID {
+			user.DeletedAt = gorm.DeletedAt{}
+			return user, nil
+		}
+	}
+	return nil, UserNotFound
+}
+
+func TestFindExistingAdmin(t *testing.T) {
+	config := &AdminBootstrapConfig{Email: "Admin@Example.com", UserName: "admin", Password: "secret"}
+	deletedAt := gorm.DeletedAt{Time: time.Now(), Valid: true}
+
+	tests := []struct {
+		name     string
+		users    []*User
+		expected uint
+		restored bool
+	}{
+		{"demoted admin", []*User{{ID: 1, Name: "admin", Email: "admin@example.com"}}, 1, false},
+		{"deleted admin", []*User{{ID: 2, Name: "admin", Email: "admin@example.com", DeletedAt: deletedAt}}, 2, true},
+		{"name taken by another user", []*User{{ID: 3, Name: "admin", Email: "other@example.com"}}, 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			userService := &bootstrapUserService{users: test.users}
+			service := &AdminBootstrapService{UserService: userService, AdminBootstrapConfig: config}
+
+			user, err := service.findExistingAdmin(context.Background())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if test.expected == 0 {
+				if user != nil {
+					t.Fatalf("expected no admin, got user %d", user.ID)
+				}
+				return
+			}
+			if user == nil || user.ID != test.expected {
+				t.Fatalf("expected user %d, got %+v", test.expected, user)
+			}
+			if restored := len(userService.restored) > 0; restored != test.restored {
+				t.Fatalf("expected restored=%v, got %v", test.restored, restored)
+			}
+		})
+	}
+}
@@ -2,11 +2,16 @@ package service
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	. "github.com/GolangSpring/gospring/pkg/security/repository"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/rs/zerolog/log"
-	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+	"slices"
 	"time"
 )
 
@@ -16,6 +21,12 @@ type UserClaims struct {
 	Roles              []string `json:"roles"`
 	ExpirationDuration float64  `json:"exp"`
 	IsVerified         bool     `json:"is_verified"`
+	// Attributes are the custom user attributes marked in_claims
+	Attributes map[string]any `json:"attributes,omitempty"`
+	// Tenants maps each tenant the user belongs to with the domain model to the user roles in it
+	Tenants map[string][]string `json:"tenants,omitempty"`
+	// Tenant is set when the user belongs to a single tenant, for TenantFromClaim
+	Tenant string `json:"tenant,omitempty"`
 }
 
 func NewUserClaims(userID uint, userName string, roles []string, expiration float64, isVerified bool) *UserClaims {
@@ -35,11 +46,54 @@ func (claims *UserClaims) Validate() error {
 	return nil
 }
 
+type MfaPendingClaims struct {
+	ID                 uint      `json:"id"`
+	Method             MfaMethod `json:"method"`
+	ExpirationDuration float64   `json:"exp"`
+}
+
+// LoginResult is returned by a successful password check. When MfaPending is set,
+// Token is a short-lived mfa pending token that has to be exchanged together with
+// a second factor for the real session token.
+type LoginResult struct {
+	Token              string
+	MfaPending         bool
+	MfaMethod          MfaMethod
+	EnrollmentRequired bool
+}
+
+type RegistrationConfig struct {
+	// RequireApproval keeps self-registered users pending until an admin activates them
+	RequireApproval bool `yaml:"require_approval"`
+}
+
+// InitialStatus is the account status of a self-registered user.
+func (config *RegistrationConfig) InitialStatus() AccountStatus {
+	if config != nil && config.RequireApproval {
+		return AccountStatusPending
+	}
+	return AccountStatusActive
+}
+
+// LoginMetadata carries details of the login request that affect the login decision.
+type LoginMetadata struct {
+	TrustedDeviceToken string
+	IpAddress          string
+}
+
+func (metadata *LoginMetadata) GetIpAddress() string {
+	if metadata == nil {
+		return ""
+	}
+	return metadata.IpAddress
+}
+
 func NewUser(name string, email string, password string) (*User, error) {
 	user := User{
 		Name:     name,
-		Email:    email,
+		Email:    NormalizeEmail(email),
 		Password: password,
+		Status:   AccountStatusActive,
 	}
 	if err := user.Validate(); err != nil {
 		return nil, err
@@ -49,42 +103,159 @@ func NewUser(name string, email string, password string) (*User, error) {
 }
 
 type IAuthService interface {
-	LoginWithEmail(ctx context.Context, email string, password string) (string, error)
-	LoginWithUserName(ctx context.Context, userName string, password string) (string, error)
+	LoginWithEmail(ctx context.Context, email string, password string, metadata *LoginMetadata) (*LoginResult, error)
+	LoginWithUserName(ctx context.Context, userName string, password string, metadata *LoginMetadata) (*LoginResult, error)
 	IssueJsonWebToken(claims *jwt.MapClaims) string
 	IssueLoginToken(user *User, expiration time.Duration) (string, error)
+	IssueMfaPendingToken(user *User, method MfaMethod) (string, error)
+	ParseMfaPendingClaims(tokenString string) (*MfaPendingClaims, error)
+	CompleteEmailOtpLogin(ctx context.Context, mfaToken string, code string) (string, error)
+	ResendLoginOtpEmail(ctx context.Context, mfaToken string) error
+	IssueTrustedDeviceToken(user *User) (string, time.Duration, error)
+	IsTrustedDevice(user *User, deviceToken string) bool
 	ExtractUserClaims(claims *jwt.MapClaims) (*UserClaims, error)
 
-	ParseUserClaims(tokenString string) (*UserClaims, error)
+	ParseUserClaims(ctx context.Context, tokenString string) (*UserClaims, error)
 	RegisterUser(ctx context.Context, name string, email string, password string) (*User, error)
+	ValidatePassword(name string, email string, password string) error
+	ChangePassword(ctx context.Context, user *User, password string) error
 	AssignRoles(ctx context.Context, userID uint, roles []string) (*User, error)
+	AssignTenantRoles(ctx context.Context, userID uint, tenant string, roles []string) (map[string][]string, error)
+	UnlockUser(ctx context.Context, userID uint) error
 
 	DecodeJsonWebTokenWithSecret(rawToken string, secret []byte) (*jwt.Token, error)
 	DecodeJsonWebToken(rawToken string) (*jwt.Token, error)
 	GenerateHashedPassword(password string) (string, error)
+	VerifyPassword(password string, hashedPassword string) error
 }
 
 var _ IAuthService = (*AuthService)(nil)
 
 type AuthService struct {
-	Secret      string
-	UserService IUserService
+	Secret          string
+	UserService     IUserService
+	SmtpService     ISmtpService
+	TemplateService ITemplateService
+	OtpService      IOtpService
+	LoginThrottle   ILoginThrottleService
+	PasswordPolicy  IPasswordPolicyService
+	PasswordHasher  IPasswordHasher
+	CasbinService   *CasbinService
+	MfaConfig       *MfaConfig
+	Registration    *RegistrationConfig
 }
 
-func (service *AuthService) PostConstruct() {}
+func (service *AuthService) PostConstruct() {
+	service.backfillCasbinRoles(context.Background())
+}
 
+// backfillCasbinRoles copies the roles of users casbin knows nothing about, roles changed
+// in casbin directly are left alone.
+func (service *AuthService) backfillCasbinRoles(ctx context.Context) {
+	users, err := service.UserService.FindAll(ctx)
+	if err != nil {
+		log.Warn().Msgf("Failed to load users for casbin role backfill: %v", err)
+		return
+	}
+	// The missing "g" rules are written at once, a startup with many users reloads the policy a single time
+	var rules [][]string
+	backfilled := 0
+	for _, user := range users {
+		if len(user.Roles) == 0 {
+			continue
+		}
+		casbinRoles, err := service.CasbinService.GetRolesForUser(UserSubject(user.ID))
+		if err != nil || len(casbinRoles) > 0 {
+			continue
+		}
+		for _, role := range slices.Compact(slices.Sorted(slices.Values(user.Roles))) {
+			policy := &RolePolicy{Subject: UserSubject(user.ID), Role: role}
+			rules = append(rules, policy.rule(service.CasbinService.domains()))
+		}
+		backfilled++
+	}
+	if len(rules) == 0 {
+		return
+	}
+	if _, err := service.CasbinService.Enforcer.AddGroupingPoliciesEx(rules); err != nil {
+		log.Warn().Msgf("Failed to backfill casbin roles: %v", err)
+		return
+	}
+	if err := service.CasbinService.ReloadPolicy(); err != nil {
+		log.Warn().Msgf("Failed to reload casbin policy after the role backfill: %v", err)
+	}
+	log.Info().Msgf("Backfilled casbin roles of %d users", backfilled)
+}
+
+// AssignRoles stores the roles on the user, where tokens read them, and as casbin grouping
+// policies in one transaction.
 func (service *AuthService) AssignRoles(ctx context.Context, userID uint, roles []string) (*User, error) {
-	return service.UserService.UpdateUserRolesByUserID(ctx, userID, roles)
+	user, err := service.UserService.FindUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	err = service.UserService.UpdateUserRolesWith(ctx, user, roles, func(tx *gorm.DB) error {
+		return service.CasbinService.ReplaceRolesForUserTx(tx, UserSubject(user.ID), roles)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := service.CasbinService.ReloadPolicy(); err != nil {
+		log.Warn().Msgf("Failed to reload casbin policy after assigning roles to user %d: %v", user.ID, err)
+	}
+	user.Roles = roles
+	return user, nil
 }
 
-func NewAuthService(userService IUserService, secret string) *AuthService {
+// AssignTenantRoles replaces the roles of the user in the tenant, they are only held by casbin
+// and reach the token on the next login.
+func (service *AuthService) AssignTenantRoles(ctx context.Context, userID uint, tenant string, roles []string) (map[string][]string, error) {
+	user, err := service.UserService.FindUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := service.CasbinService.ReplaceTenantRolesForUser(ctx, UserSubject(user.ID), tenant, roles); err != nil {
+		return nil, err
+	}
+	return service.CasbinService.GetTenantRoles(UserSubject(user.ID))
+}
+
+func (service *AuthService) UnlockUser(ctx context.Context, userID uint) error {
+	return service.LoginThrottle.Unlock(ctx, userID)
+}
+
+func NewAuthService(
+	userService IUserService,
+	smtpService ISmtpService,
+	templateService ITemplateService,
+	otpService IOtpService,
+	loginThrottle ILoginThrottleService,
+	passwordPolicy IPasswordPolicyService,
+	passwordHasher IPasswordHasher,
+	casbinService *CasbinService,
+	secret string,
+	mfaConfig *MfaConfig,
+	registration *RegistrationConfig,
+) *AuthService {
 	return &AuthService{
-		UserService: userService,
-		Secret:      secret,
+		UserService:     userService,
+		SmtpService:     smtpService,
+		TemplateService: templateService,
+		OtpService:      otpService,
+		LoginThrottle:   loginThrottle,
+		PasswordPolicy:  passwordPolicy,
+		PasswordHasher:  passwordHasher,
+		CasbinService:   casbinService,
+		Secret:          secret,
+		MfaConfig:       mfaConfig,
+		Registration:    registration,
 	}
 }
 
 func (service *AuthService) RegisterUser(ctx context.Context, name string, email string, rawPassword string) (*User, error) {
+	if err := service.ValidatePassword(name, email, rawPassword); err != nil {
+		return nil, err
+	}
 	hashedPassword, err := service.GenerateHashedPassword(rawPassword)
 	if err != nil {
 		return nil, err
@@ -93,10 +264,33 @@ func (service *AuthService) RegisterUser(ctx context.Context, name string, email
 	if err != nil {
 		return nil, err
 	}
+	user.Status = service.Registration.InitialStatus()
 
 	return user, service.UserService.AddUser(ctx, user)
 }
 
+func (service *AuthService) ValidatePassword(name string, email string, password string) error {
+	return service.PasswordPolicy.Validate(name, email, password)
+}
+
+// ChangePassword enforces the password policy, then stores the new hash and pushes the old one into the history.
+func (service *AuthService) ChangePassword(ctx context.Context, user *User, password string) error {
+	if err := service.PasswordPolicy.ValidateChange(user, password); err != nil {
+		return err
+	}
+	hashedPassword, err := service.GenerateHashedPassword(password)
+	if err != nil {
+		return err
+	}
+	history := service.PasswordPolicy.NextPasswordHistory(user)
+	if err := service.UserService.UpdateUserPasswordWithHistory(ctx, user, hashedPassword, history); err != nil {
+		return err
+	}
+	user.Password = hashedPassword
+	user.PasswordHistory = history
+	return nil
+}
+
 func (service *AuthService) ExtractUserClaims(claims *jwt.MapClaims) (*UserClaims, error) {
 
 	userID, ok := (*claims)["id"].(float64)
@@ -112,10 +306,7 @@ func (service *AuthService) ExtractUserClaims(claims *jwt.MapClaims) (*UserClaim
 	if !ok {
 		return nil, fmt.Errorf("invalid or missing 'roles' claim")
 	}
-	roles := make([]string, len(roleInterfaces))
-	for idx, role := range roleInterfaces {
-		roles[idx] = role.(string)
-	}
+	roles := toStrings(roleInterfaces)
 
 	expiration, ok := (*claims)["exp"].(float64)
 	if !ok {
@@ -128,9 +319,33 @@ func (service *AuthService) ExtractUserClaims(claims *jwt.MapClaims) (*UserClaim
 	}
 
 	userClaims := NewUserClaims(uint(userID), userName, roles, expiration, isVerified)
+	// Attributes are left out of the token when the user has none to carry
+	if attributes, ok := (*claims)["attributes"].(map[string]any); ok {
+		userClaims.Attributes = attributes
+	}
+	if tenants, ok := (*claims)["tenants"].(map[string]any); ok {
+		userClaims.Tenants = make(map[string][]string, len(tenants))
+		for tenant, tenantRoles := range tenants {
+			roleInterfaces, _ := tenantRoles.([]any)
+			userClaims.Tenants[tenant] = toStrings(roleInterfaces)
+		}
+	}
+	if tenant, ok := (*claims)["tenant"].(string); ok {
+		userClaims.Tenant = tenant
+	}
 	return userClaims, nil
 }
 
+func toStrings(values []any) []string {
+	strs := make([]string, 0, len(values))
+	for _, value := range values {
+		if str, ok := value.(string); ok {
+			strs = append(strs, str)
+		}
+	}
+	return strs
+}
+
 func (service *AuthService) DecodeJsonWebTokenWithSecret(rawToken string, secret []byte) (*jwt.Token, error) {
 	token, err := jwt.Parse(rawToken, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
@@ -150,30 +365,112 @@ func (service *AuthService) DecodeJsonWebToken(rawToken string) (*jwt.Token, err
 
 }
 
-func (service *AuthService) LoginWithUserName(ctx context.Context, userName string, password string) (string, error) {
-	user, err := service.UserService.FindByUserName(ctx, userName)
+func (service *AuthService) LoginWithUserName(ctx context.Context, userName string, password string, metadata *LoginMetadata) (*LoginResult, error) {
+	return service.loginWithPassword(ctx, password, metadata, func() (*User, error) {
+		return service.UserService.FindByUserName(ctx, userName)
+	})
+}
+
+func (service *AuthService) LoginWithEmail(ctx context.Context, email string, password string, metadata *LoginMetadata) (*LoginResult, error) {
+	return service.loginWithPassword(ctx, password, metadata, func() (*User, error) {
+		return service.UserService.FindByEmail(ctx, email)
+	})
+}
+
+// loginWithPassword checks the password of the found user, failures count against both
+// the client ip and the account, unknown accounts against the ip only.
+func (service *AuthService) loginWithPassword(ctx context.Context, password string, metadata *LoginMetadata, findUser func() (*User, error)) (*LoginResult, error) {
+	ip := metadata.GetIpAddress()
+	if err := service.LoginThrottle.Check(ctx, nil, ip); err != nil {
+		return nil, err
+	}
+
+	user, err := findUser()
 	if err != nil {
-		return "", UserNotFound
+		service.LoginThrottle.RecordFailure(ctx, nil, ip)
+		return nil, UserNotFound
+	}
+	if err := service.LoginThrottle.Check(ctx, user, ip); err != nil {
+		return nil, err
 	}
 
 	if err := service.VerifyPassword(password, user.Password); err != nil {
-		return "", err
+		service.LoginThrottle.RecordFailure(ctx, user, ip)
+		return nil, err
 	}
+	service.LoginThrottle.RecordSuccess(ctx, user, ip)
+	service.rehashIfOutdated(ctx, user, password)
 
-	return service.IssueLoginToken(user, time.Hour)
+	if err := CheckAccountStatus(user); err != nil {
+		return nil, err
+	}
+
+	return service.completeLogin(ctx, user, metadata)
 }
 
-func (service *AuthService) LoginWithEmail(ctx context.Context, email string, password string) (string, error) {
-	user, err := service.UserService.FindByEmail(ctx, email)
+// rehashIfOutdated upgrades the stored hash to the configured algorithm and parameters
+// while the plain password is at hand, so users migrate without a reset.
+func (service *AuthService) rehashIfOutdated(ctx context.Context, user *User, password string) {
+	if !service.PasswordHasher.NeedsRehash(user.Password) {
+		return
+	}
+	hashedPassword, err := service.GenerateHashedPassword(password)
 	if err != nil {
-		return "", UserNotFound
+		log.Error().Msgf("Failed to rehash password of user %d: %v", user.ID, err)
+		return
+	}
+	if err := service.UserService.UpdateUserPassword(ctx, user, hashedPassword); err != nil {
+		log.Error().Msgf("Failed to store rehashed password of user %d: %v", user.ID, err)
+		return
 	}
+	user.Password = hashedPassword
+	log.Info().Msgf("Rehashed password of user %d", user.ID)
+}
 
-	if err := service.VerifyPassword(password, user.Password); err != nil {
-		return "", err
+// requiredMfaMethod picks the second factor for the user, TOTP always wins once enrolled.
+func (service *AuthService) requiredMfaMethod(user *User) (MfaMethod, bool) {
+	isEnforced := service.MfaConfig.IsEnforcedFor(user.Roles)
+	switch {
+	case user.TotpEnabled:
+		return MfaMethodTotp, true
+	case service.MfaConfig.IsEmailOtpEnabled() && (user.EmailOtpEnabled || isEnforced):
+		return MfaMethodEmail, true
+	case isEnforced:
+		return MfaMethodTotp, true
+	}
+	return "", false
+}
+
+func (service *AuthService) completeLogin(ctx context.Context, user *User, metadata *LoginMetadata) (*LoginResult, error) {
+	method, isRequired := service.requiredMfaMethod(user)
+	if isRequired && metadata != nil && service.IsTrustedDevice(user, metadata.TrustedDeviceToken) {
+		log.Info().Msgf("Skipping second factor for user %d on trusted device", user.ID)
+		isRequired = false
 	}
 
-	return service.IssueLoginToken(user, time.Hour)
+	if isRequired {
+		if method == MfaMethodEmail {
+			if err := service.sendLoginOtp(ctx, user); err != nil {
+				return nil, err
+			}
+		}
+		token, err := service.IssueMfaPendingToken(user, method)
+		if err != nil {
+			return nil, err
+		}
+		return &LoginResult{
+			Token:              token,
+			MfaPending:         true,
+			MfaMethod:          method,
+			EnrollmentRequired: method == MfaMethodTotp && !user.TotpEnabled,
+		}, nil
+	}
+
+	token, err := service.IssueLoginToken(user, time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	return &LoginResult{Token: token}, nil
 }
 
 func (service *AuthService) IssueJsonWebToken(claims *jwt.MapClaims) string {
@@ -191,10 +488,186 @@ func (service *AuthService) IssueLoginToken(user *User, expiration time.Duration
 		"exp":         time.Now().Add(expiration).Unix(),
 		"is_verified": user.IsVerified,
 	}
+	if attributes := service.UserService.GetAttributeSchema().ClaimAttributes(user.Attributes); len(attributes) > 0 {
+		claims["attributes"] = attributes
+	}
+	tenants, err := service.CasbinService.GetTenantRoles(UserSubject(user.ID))
+	if err != nil {
+		return "", err
+	}
+	if len(tenants) > 0 {
+		claims["tenants"] = tenants
+	}
+	if len(tenants) == 1 {
+		for tenant := range tenants {
+			claims["tenant"] = tenant
+		}
+	}
+	return service.IssueJsonWebToken(&claims), nil
+}
+
+func (service *AuthService) IssueMfaPendingToken(user *User, method MfaMethod) (string, error) {
+	claims := jwt.MapClaims{
+		"purpose": string(PurposeMfaPending),
+		"id":      user.ID,
+		"method":  string(method),
+		"exp":     time.Now().Add(service.MfaConfig.PendingTokenDuration()).Unix(),
+	}
 	return service.IssueJsonWebToken(&claims), nil
 }
 
-func (service *AuthService) ParseUserClaims(tokenString string) (*UserClaims, error) {
+func (service *AuthService) ParseMfaPendingClaims(tokenString string) (*MfaPendingClaims, error) {
+	_jwt, err := service.DecodeJsonWebToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := _jwt.Claims.(jwt.MapClaims)
+	if !ok || !_jwt.Valid {
+		return nil, TokenInvalid
+	}
+
+	purpose, ok := claims["purpose"].(string)
+	if !ok || purpose != string(PurposeMfaPending) {
+		return nil, fmt.Errorf("invalid or missing 'purpose' claim, getting %s, expects %v", purpose, PurposeMfaPending)
+	}
+	userID, ok := claims["id"].(float64)
+	if !ok {
+		return nil, TokenInvalid
+	}
+	method, ok := claims["method"].(string)
+	if !ok {
+		return nil, TokenInvalid
+	}
+	expiration, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, TokenInvalid
+	}
+	return &MfaPendingClaims{ID: uint(userID), Method: MfaMethod(method), ExpirationDuration: expiration}, nil
+}
+
+// sendLoginOtp mails the login code. A code still pending is sent again with its attempts kept, so
+// logging in again grants no more guesses, and past MaxOtpResends the code already sent stays valid.
+func (service *AuthService) sendLoginOtp(ctx context.Context, user *User) error {
+	otp, err := service.OtpService.GetOtp(user.ID, PurposeLoginEmailOtp)
+	switch {
+	case err != nil || otp.isExpired(time.Now()):
+		otp = service.OtpService.GenerateOtp(user.ID, PurposeLoginEmailOtp)
+	default:
+		otp, err = service.OtpService.ResendOtp(user.ID, PurposeLoginEmailOtp)
+		if errors.Is(err, OtpResendLimitExceeded) {
+			log.Info().Msgf("Login code of user %d not sent again, the resend limit is reached", user.ID)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return service.sendLoginOtpEmail(ctx, user, otp)
+}
+
+func (service *AuthService) sendLoginOtpEmail(ctx context.Context, user *User, otp *OTP) error {
+	emailTemplate := NewEmailTemplate(user.Name, otp.Code, service.SmtpService.GetSmtpConfig().CompanyName)
+	email, err := service.TemplateService.Render(TemplateLoginOtp, user.Locale, emailTemplate)
+	if err != nil {
+		return err
+	}
+
+	message := service.SmtpService.CreateRenderedMessage(user.Email, email)
+	return service.SmtpService.SendEmail(message)
+}
+
+func (service *AuthService) parseEmailOtpPendingUser(ctx context.Context, mfaToken string) (*User, error) {
+	claims, err := service.ParseMfaPendingClaims(mfaToken)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Method != MfaMethodEmail {
+		return nil, MfaMethodMismatch
+	}
+	user, err := service.UserService.FindByID(ctx, claims.ID)
+	if err != nil {
+		return nil, UserNotFound
+	}
+	return user, nil
+}
+
+func (service *AuthService) CompleteEmailOtpLogin(ctx context.Context, mfaToken string, code string) (string, error) {
+	user, err := service.parseEmailOtpPendingUser(ctx, mfaToken)
+	if err != nil {
+		return "", err
+	}
+	// Wrong codes count like failed logins, whoever holds the password cannot guess codes forever
+	if err := service.LoginThrottle.Check(ctx, user, ""); err != nil {
+		return "", err
+	}
+	if err := service.OtpService.VerifyOtp(user.ID, PurposeLoginEmailOtp, code); err != nil {
+		service.LoginThrottle.RecordFailure(ctx, user, "")
+		return "", err
+	}
+	service.LoginThrottle.RecordSuccess(ctx, user, "")
+	// The account may have been disabled since the password was checked
+	if err := CheckAccountStatus(user); err != nil {
+		return "", err
+	}
+	return service.IssueLoginToken(user, time.Hour)
+}
+
+// ResendLoginOtpEmail sends a new code for the pending login, at most MaxOtpResends times. The wrong
+// codes already submitted still count, once the OTP is dropped the user has to log in again.
+func (service *AuthService) ResendLoginOtpEmail(ctx context.Context, mfaToken string) error {
+	user, err := service.parseEmailOtpPendingUser(ctx, mfaToken)
+	if err != nil {
+		return err
+	}
+	otp, err := service.OtpService.ResendOtp(user.ID, PurposeLoginEmailOtp)
+	if err != nil {
+		return err
+	}
+	return service.sendLoginOtpEmail(ctx, user, otp)
+}
+
+// passwordFingerprint identifies the current password of the user without exposing its hash.
+func passwordFingerprint(user *User) string {
+	sum := sha256.Sum256([]byte(user.Password))
+	return hex.EncodeToString(sum[:16])
+}
+
+// IssueTrustedDeviceToken signs the value of the device cookie that lets the user
+// skip the second factor on this device until it expires or the password changes.
+func (service *AuthService) IssueTrustedDeviceToken(user *User) (string, time.Duration, error) {
+	expiration := service.MfaConfig.TrustedDeviceDuration()
+	claims := jwt.MapClaims{
+		"purpose":  string(PurposeTrustedDevice),
+		"id":       user.ID,
+		"password": passwordFingerprint(user),
+		"exp":      time.Now().Add(expiration).Unix(),
+	}
+	return service.IssueJsonWebToken(&claims), expiration, nil
+}
+
+func (service *AuthService) IsTrustedDevice(user *User, deviceToken string) bool {
+	if deviceToken == "" {
+		return false
+	}
+	_jwt, err := service.DecodeJsonWebToken(deviceToken)
+	if err != nil {
+		return false
+	}
+	claims, ok := _jwt.Claims.(jwt.MapClaims)
+	if !ok || !_jwt.Valid {
+		return false
+	}
+	purpose, _ := claims["purpose"].(string)
+	deviceUserID, _ := claims["id"].(float64)
+	fingerprint, _ := claims["password"].(string)
+	return purpose == string(PurposeTrustedDevice) && uint(deviceUserID) == user.ID &&
+		subtle.ConstantTimeCompare([]byte(fingerprint), []byte(passwordFingerprint(user))) == 1
+}
+
+// ParseUserClaims also checks the user behind the token, so deleted or inactive users lose
+// access before their token expires, and takes the email verification from the stored user.
+func (service *AuthService) ParseUserClaims(ctx context.Context, tokenString string) (*UserClaims, error) {
 	_jwt, err := service.DecodeJsonWebToken(tokenString)
 	if err != nil {
 		return nil, err
@@ -206,19 +679,31 @@ func (service *AuthService) ParseUserClaims(tokenString string) (*UserClaims, er
 			return nil, err
 		}
 
+		user, err := service.UserService.FindUser(ctx, userClaims.ID)
+		if err != nil {
+			return nil, err
+		}
+		if err := CheckAccountStatus(user); err != nil {
+			return nil, err
+		}
+		// The stored flag wins, an email change unverifies the user before the token expires
+		userClaims.IsVerified = user.IsVerified
 		return userClaims, nil
 	}
 	return nil, jwt.ErrTokenInvalidClaims
 }
 
 func (service *AuthService) GenerateHashedPassword(password string) (string, error) {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil {
-		return "", err
-	}
-	return string(hashedPassword), nil
+	return service.PasswordHasher.Hash(password)
 }
 
 func (service *AuthService) VerifyPassword(password string, hashedPassword string) error {
-	return bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
+	isMatched, err := service.PasswordHasher.Verify(password, hashedPassword)
+	if err != nil {
+		return err
+	}
+	if !isMatched {
+		return PasswordIncorrect
+	}
+	return nil
 }
@@ -0,0 +1,182 @@
+package service
+
+import (
+	"context"
+	"errors"
+	. "github.com/GolangSpring/gospring/pkg/security/repository"
+	"github.com/golang-jwt/jwt/v5"
+	"gopkg.in/gomail.v2"
+	"testing"
+	"time"
+)
+
+// countingSmtpService counts the mails sent, rendering is left to countingTemplateService.
+type countingSmtpService struct {
+	ISmtpService
+	sent int
+}
+
+func (service *countingSmtpService) GetSmtpConfig() *SmtpConfig {
+	return &SmtpConfig{CompanyName: "Acme"}
+}
+
+func (service *countingSmtpService) CreateRenderedMessage(to string, email *RenderedEmail) *gomail.Message {
+	return gomail.NewMessage()
+}
+
+func (service *countingSmtpService) SendEmail(message *gomail.Message) error {
+	service.sent++
+	return nil
+}
+
+type countingTemplateService struct{}
+
+func (service *countingTemplateService) Render(name TemplateName, locale string, data any) (*RenderedEmail, error) {
+	return &RenderedEmail{}, nil
+}
+
+// recordingLoginThrottle counts the failures and successes recorded, it never refuses an attempt.
+type recordingLoginThrottle struct {
+	ILoginThrottleService
+	failures  int
+	successes int
+}
+
+func (throttle *recordingLoginThrottle) Check(ctx context.Context, user *User, ip string) error {
+	return nil
+}
+
+func (throttle *recordingLoginThrottle) RecordFailure(ctx context.Context, user *User, ip string) {
+	throttle.failures++
+}
+
+func (throttle *recordingLoginThrottle) RecordSuccess(ctx context.Context, user *User, ip string) {
+	throttle.successes++
+}
+
+// singleUserService finds the one user it holds.
+type singleUserService struct {
+	IUserService
+	user *User
+}
+
+func (service *singleUserService) FindByID(ctx context.Context, id uint) (*User, error) {
+	if id != service.user.ID {
+		return nil, UserNotFound
+	}
+	return service.user, nil
+}
+
+func (service *singleUserService) FindUser(ctx context.Context, userID uint) (*User, error) {
+	return service.FindByID(ctx, userID)
+}
+
+func TestParseUserClaimsTakesStoredVerification(t *testing.T) {
+	user := &User{ID: 1, Name: "alice", Status: AccountStatusActive}
+	service := &AuthService{Secret: "secret", UserService: &singleUserService{user: user}}
+	token := service.IssueJsonWebToken(&jwt.MapClaims{
+		"user_name":   user.Name,
+		"id":          user.ID,
+		"roles":       []string{},
+		"exp":         time.Now().Add(time.Hour).Unix(),
+		"is_verified": true,
+	})
+
+	claims, err := service.ParseUserClaims(context.Background(), token)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if claims.IsVerified {
+		t.Fatal("expected the user unverified since the token was issued to be unverified")
+	}
+}
+
+func TestTrustedDeviceRevokedOnPasswordChange(t *testing.T) {
+	service := &AuthService{Secret: "secret"}
+	user := &User{Password: "hash-1"}
+	user.ID = 1
+
+	token, _, err := service.IssueTrustedDeviceToken(user)
+	if err != nil {
+		t.Fatalf("expected a device token, got %v", err)
+	}
+	if !service.IsTrustedDevice(user, token) {
+		t.Fatal("expected the device to be trusted")
+	}
+
+	other := &User{Password: "hash-1"}
+	other.ID = 2
+	if service.IsTrustedDevice(other, token) {
+		t.Fatal("expected the device not to be trusted for another user")
+	}
+
+	user.Password = "hash-2"
+	if service.IsTrustedDevice(user, token) {
+		t.Fatal("expected the device to be forgotten once the password changed")
+	}
+}
+
+func TestRegistrationInitialStatus(t *testing.T) {
+	var unset *RegistrationConfig
+	if status := unset.InitialStatus(); status != AccountStatusActive {
+		t.Fatalf("expected active without config, got %s", status)
+	}
+	if status := (&RegistrationConfig{RequireApproval: true}).InitialStatus(); status != AccountStatusPending {
+		t.Fatalf("expected pending with approval required, got %s", status)
+	}
+}
+
+func TestLoginAgainKeepsOtpAttempts(t *testing.T) {
+	smtpService := &countingSmtpService{}
+	otpService := NewOtpService(fixedOtpCode)
+	service := &AuthService{Secret: "secret", SmtpService: smtpService, TemplateService: &countingTemplateService{}, OtpService: otpService}
+	user := &User{ID: 1}
+	ctx := context.Background()
+
+	if err := service.sendLoginOtp(ctx, user); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_ = otpService.VerifyOtp(user.ID, PurposeLoginEmailOtp, "wrong")
+	_ = otpService.VerifyOtp(user.ID, PurposeLoginEmailOtp, "wrong")
+
+	for idx := 0; idx < MaxOtpResends+2; idx++ {
+		if err := service.sendLoginOtp(ctx, user); err != nil {
+			t.Fatalf("login %d: unexpected error: %v", idx, err)
+		}
+	}
+	otp, err := otpService.GetOtp(user.ID, PurposeLoginEmailOtp)
+	if err != nil {
+		t.Fatalf("expected the code to be pending, got %v", err)
+	}
+	if otp.Attempts != 2 {
+		t.Fatalf("expected the wrong codes to still count, got %d attempts", otp.Attempts)
+	}
+	if smtpService.sent != 1+MaxOtpResends {
+		t.Fatalf("expected %d mails, got %d", 1+MaxOtpResends, smtpService.sent)
+	}
+}
+
+func TestCompleteEmailOtpLogin(t *testing.T) {
+	user := &User{ID: 1, Status: AccountStatusActive}
+	throttle := &recordingLoginThrottle{}
+	otpService := NewOtpService(fixedOtpCode)
+	service := &AuthService{Secret: "secret", UserService: &singleUserService{user: user}, OtpService: otpService, LoginThrottle: throttle}
+	ctx := context.Background()
+	token, err := service.IssueMfaPendingToken(user, MfaMethodEmail)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	otp := otpService.GenerateOtp(user.ID, PurposeLoginEmailOtp)
+
+	if _, err := service.CompleteEmailOtpLogin(ctx, token, "wrong"); !errors.Is(err, OtpIncorrect) {
+		t.Fatalf("expected OtpIncorrect, got %v", err)
+	}
+	if throttle.failures != 1 {
+		t.Fatalf("expected the wrong code to count as a failed login, got %d", throttle.failures)
+	}
+
+	user.Status = AccountStatusDisabled
+	if _, err := service.CompleteEmailOtpLogin(ctx, token, otp.Code); !errors.Is(err, AccountDisabled) {
+		t.Fatalf("expected AccountDisabled, got %v", err)
+	}
+}
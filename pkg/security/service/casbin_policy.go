@@ -0,0 +1,426 @@
+package service
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	gormadapter "github.com/casbin/gorm-adapter/v3"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"io"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const (
+	PolicyTypePermission = "p"
+	PolicyTypeRole       = "g"
+	PolicyActionAny      = "*"
+	// PolicyDomainAny is the domain of the global policies and roles, only global roles reach global policies
+	PolicyDomainAny   = "*"
+	userSubjectPrefix = "user:"
+)
+
+// PolicyActions are the actions a permission policy may grant, besides PolicyActionAny.
+var PolicyActions = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+	http.MethodPatch, http.MethodDelete, http.MethodOptions,
+}
+
+// Policy is a "p" rule, the subject may do the action on the paths matching the object regex.
+// Domain is the tenant of the domain model, empty means PolicyDomainAny.
+type Policy struct {
+	Subject string `json:"subject" yaml:"subject" validate:"required"`
+	Domain  string `json:"domain,omitempty" yaml:"domain"`
+	Object  string `json:"object" yaml:"object" validate:"required"`
+	Action  string `json:"action" yaml:"action" validate:"required"`
+}
+
+func (policy *Policy) rule(withDomain bool) []string {
+	if withDomain {
+		return []string{policy.Subject, domainOrAny(policy.Domain), policy.Object, policy.Action}
+	}
+	return []string{policy.Subject, policy.Object, policy.Action}
+}
+
+// RolePolicy is a "g" rule, the subject inherits every permission of the role, within Domain
+// with the domain model.
+type RolePolicy struct {
+	Subject string `json:"subject" yaml:"subject" validate:"required"`
+	Role    string `json:"role" yaml:"role" validate:"required"`
+	Domain  string `json:"domain,omitempty" yaml:"domain"`
+}
+
+func (policy *RolePolicy) rule(withDomain bool) []string {
+	if withDomain {
+		return []string{policy.Subject, policy.Role, domainOrAny(policy.Domain)}
+	}
+	return []string{policy.Subject, policy.Role}
+}
+
+func domainOrAny(domain string) string {
+	if domain == "" {
+		return PolicyDomainAny
+	}
+	return domain
+}
+
+// PolicyInvalidError tells which policy was refused and why, Line is set for imported CSV lines.
+// It matches PolicyInvalid with errors.Is.
+type PolicyInvalidError struct {
+	Line   int
+	Reason string
+}
+
+func (err *PolicyInvalidError) Error() string {
+	if err.Line > 0 {
+		return fmt.Sprintf("%v: line %d: %s", PolicyInvalid, err.Line, err.Reason)
+	}
+	return fmt.Sprintf("%v: %s", PolicyInvalid, err.Reason)
+}
+
+func (err *PolicyInvalidError) Unwrap() error {
+	return PolicyInvalid
+}
+
+func atLine(err error, line int) error {
+	var invalidErr *PolicyInvalidError
+	if errors.As(err, &invalidErr) {
+		invalidErr.Line = line
+	}
+	return err
+}
+
+type PolicyImportResult struct {
+	Policies     int `json:"policies"`
+	RolePolicies int `json:"role_policies"`
+}
+
+type PolicyCheckResult struct {
+	Allowed bool `json:"allowed"`
+	// MatchedPolicy is the policy granting the access, empty when denied
+	MatchedPolicy []string `json:"matched_policy"`
+}
+
+func ValidatePolicy(policy *Policy) error {
+	if strings.TrimSpace(policy.Subject) == "" {
+		return &PolicyInvalidError{Reason: "subject is empty"}
+	}
+	if _, err := regexp.Compile(policy.Object); err != nil {
+		return &PolicyInvalidError{Reason: "object is not a valid regex: " + err.Error()}
+	}
+	if !strings.HasPrefix(policy.Object, "^") || !strings.HasSuffix(policy.Object, "$") {
+		return &PolicyInvalidError{Reason: "object regex must be anchored with ^ and $"}
+	}
+	if policy.Action != PolicyActionAny && !slices.Contains(PolicyActions, policy.Action) {
+		return &PolicyInvalidError{Reason: "action must be an HTTP method or " + PolicyActionAny}
+	}
+	return nil
+}
+
+// ValidateRolePolicy refuses user subjects, their roles are assigned through AuthService.AssignRoles
+// so the user and casbin agree.
+func ValidateRolePolicy(policy *RolePolicy) error {
+	if strings.TrimSpace(policy.Subject) == "" || strings.TrimSpace(policy.Role) == "" {
+		return &PolicyInvalidError{Reason: "subject and role are required"}
+	}
+	if strings.HasPrefix(policy.Subject, userSubjectPrefix) {
+		return &PolicyInvalidError{Reason: "user roles are assigned with /api-admin/assign-roles or /api-admin/tenants/{tenant}/assign-roles"}
+	}
+	if policy.Subject == policy.Role {
+		return &PolicyInvalidError{Reason: "a role cannot inherit itself"}
+	}
+	return nil
+}
+
+// checkDomain refuses domains with the flat model, they would silently be dropped.
+func (service *CasbinService) checkDomain(domain string) error {
+	if domain != "" && !service.domains() {
+		return &PolicyInvalidError{Reason: "domain needs the domain model"}
+	}
+	return nil
+}
+
+func toPolicies(rules [][]string) []*Policy {
+	policies := make([]*Policy, 0, len(rules))
+	for _, rule := range rules {
+		switch len(rule) {
+		case 3:
+			policies = append(policies, &Policy{Subject: rule[0], Object: rule[1], Action: rule[2]})
+		case 4:
+			policies = append(policies, &Policy{Subject: rule[0], Domain: rule[1], Object: rule[2], Action: rule[3]})
+		}
+	}
+	return policies
+}
+
+func toRolePolicies(rules [][]string) []*RolePolicy {
+	policies := make([]*RolePolicy, 0, len(rules))
+	for _, rule := range rules {
+		switch len(rule) {
+		case 2:
+			policies = append(policies, &RolePolicy{Subject: rule[0], Role: rule[1]})
+		case 3:
+			policies = append(policies, &RolePolicy{Subject: rule[0], Role: rule[1], Domain: rule[2]})
+		}
+	}
+	return policies
+}
+
+// GetPolicies lists the permission policies, only those of the subject when it is given.
+func (service *CasbinService) GetPolicies(subject string) ([]*Policy, error) {
+	if subject == "" {
+		rules, err := service.Enforcer.GetPolicy()
+		return toPolicies(rules), err
+	}
+	rules, err := service.Enforcer.GetFilteredPolicy(0, subject)
+	return toPolicies(rules), err
+}
+
+func (service *CasbinService) AddPolicy(policy *Policy) error {
+	if err := ValidatePolicy(policy); err != nil {
+		return err
+	}
+	if err := service.checkDomain(policy.Domain); err != nil {
+		return err
+	}
+	// The enforcer reports an existing policy as added, so it is looked up first
+	exists, err := service.Enforcer.HasPolicy(policy.rule(service.domains()))
+	if err != nil {
+		return err
+	}
+	if exists {
+		return PolicyExists
+	}
+	_, err = service.Enforcer.AddPolicy(policy.rule(service.domains()))
+	return err
+}
+
+func (service *CasbinService) UpdatePolicy(oldPolicy *Policy, newPolicy *Policy) error {
+	if err := ValidatePolicy(newPolicy); err != nil {
+		return err
+	}
+	if err := service.checkDomain(newPolicy.Domain); err != nil {
+		return err
+	}
+	hasOld, err := service.Enforcer.HasPolicy(oldPolicy.rule(service.domains()))
+	if err != nil {
+		return err
+	}
+	if !hasOld {
+		return PolicyNotFound
+	}
+	hasNew, err := service.Enforcer.HasPolicy(newPolicy.rule(service.domains()))
+	if err != nil {
+		return err
+	}
+	if hasNew {
+		return PolicyExists
+	}
+	_, err = service.Enforcer.UpdatePolicy(oldPolicy.rule(service.domains()), newPolicy.rule(service.domains()))
+	return err
+}
+
+func (service *CasbinService) RemovePolicy(policy *Policy) error {
+	removed, err := service.Enforcer.RemovePolicy(policy.rule(service.domains()))
+	if err != nil {
+		return err
+	}
+	if !removed {
+		return PolicyNotFound
+	}
+	return nil
+}
+
+// GetRolePolicies lists the role inheritances, only those of the subject when it is given.
+func (service *CasbinService) GetRolePolicies(subject string) ([]*RolePolicy, error) {
+	if subject == "" {
+		rules, err := service.Enforcer.GetGroupingPolicy()
+		return toRolePolicies(rules), err
+	}
+	rules, err := service.Enforcer.GetFilteredGroupingPolicy(0, subject)
+	return toRolePolicies(rules), err
+}
+
+func (service *CasbinService) AddRolePolicy(policy *RolePolicy) error {
+	if err := ValidateRolePolicy(policy); err != nil {
+		return err
+	}
+	if err := service.checkDomain(policy.Domain); err != nil {
+		return err
+	}
+	// The enforcer reports an existing policy as added, so it is looked up first
+	exists, err := service.Enforcer.HasGroupingPolicy(policy.rule(service.domains()))
+	if err != nil {
+		return err
+	}
+	if exists {
+		return PolicyExists
+	}
+	_, err = service.Enforcer.AddGroupingPolicy(policy.rule(service.domains()))
+	return err
+}
+
+func (service *CasbinService) UpdateRolePolicy(oldPolicy *RolePolicy, newPolicy *RolePolicy) error {
+	if err := ValidateRolePolicy(oldPolicy); err != nil {
+		return err
+	}
+	if err := ValidateRolePolicy(newPolicy); err != nil {
+		return err
+	}
+	if err := service.checkDomain(newPolicy.Domain); err != nil {
+		return err
+	}
+	hasOld, err := service.Enforcer.HasGroupingPolicy(oldPolicy.rule(service.domains()))
+	if err != nil {
+		return err
+	}
+	if !hasOld {
+		return PolicyNotFound
+	}
+	hasNew, err := service.Enforcer.HasGroupingPolicy(newPolicy.rule(service.domains()))
+	if err != nil {
+		return err
+	}
+	if hasNew {
+		return PolicyExists
+	}
+	_, err = service.Enforcer.UpdateGroupingPolicy(oldPolicy.rule(service.domains()), newPolicy.rule(service.domains()))
+	return err
+}
+
+func (service *CasbinService) RemoveRolePolicy(policy *RolePolicy) error {
+	if err := ValidateRolePolicy(policy); err != nil {
+		return err
+	}
+	removed, err := service.Enforcer.RemoveGroupingPolicy(policy.rule(service.domains()))
+	if err != nil {
+		return err
+	}
+	if !removed {
+		return PolicyNotFound
+	}
+	return nil
+}
+
+// CheckPermission tells whether the subject may do the action on the object in the domain, without
+// doing it. The domain is ignored by the flat model.
+func (service *CasbinService) CheckPermission(subject string, domain string, object string, action string) (*PolicyCheckResult, error) {
+	request := []any{subject, object, action}
+	if service.domains() {
+		request = []any{subject, domainOrAny(domain), object, action}
+	}
+	allowed, explain, err := service.Enforcer.EnforceEx(request...)
+	if err != nil {
+		return nil, err
+	}
+	return &PolicyCheckResult{Allowed: allowed, MatchedPolicy: explain}, nil
+}
+
+// ExportCsv writes every policy in the casbin CSV form, "p, subject, object, action" and
+// "g, subject, role" lines, with the domain model "p, subject, domain, object, action" and
+// "g, subject, role, domain" lines.
+func (service *CasbinService) ExportCsv(writer io.Writer) error {
+	policies, err := service.GetPolicies("")
+	if err != nil {
+		return err
+	}
+	rolePolicies, err := service.GetRolePolicies("")
+	if err != nil {
+		return err
+	}
+
+	csvWriter := csv.NewWriter(writer)
+	for _, policy := range policies {
+		if err := csvWriter.Write(append([]string{PolicyTypePermission}, policy.rule(service.domains())...)); err != nil {
+			return err
+		}
+	}
+	for _, policy := range rolePolicies {
+		if err := csvWriter.Write(append([]string{PolicyTypeRole}, policy.rule(service.domains())...)); err != nil {
+			return err
+		}
+	}
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
+
+// ImportCsv adds the policies of a CSV in the ExportCsv form, existing ones are skipped and not
+// counted. Nothing is added unless every line is valid and every policy could be stored.
+func (service *CasbinService) ImportCsv(reader io.Reader) (*PolicyImportResult, error) {
+	csvReader := csv.NewReader(reader)
+	csvReader.FieldsPerRecord = -1
+	csvReader.TrimLeadingSpace = true
+	csvReader.Comment = '#'
+
+	policyFields, rolePolicyFields := 4, 3
+	expecting := "expecting \"p, subject, object, action\" or \"g, subject, role\""
+	if service.domains() {
+		policyFields, rolePolicyFields = 5, 4
+		expecting = "expecting \"p, subject, domain, object, action\" or \"g, subject, role, domain\""
+	}
+
+	var policies, rolePolicies [][]string
+	for line := 1; ; line++ {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, &PolicyInvalidError{Line: line, Reason: err.Error()}
+		}
+		switch {
+		case record[0] == PolicyTypePermission && len(record) == policyFields:
+			policy := toPolicies([][]string{record[1:]})[0]
+			if err := ValidatePolicy(policy); err != nil {
+				return nil, atLine(err, line)
+			}
+			policies = append(policies, policy.rule(service.domains()))
+		case record[0] == PolicyTypeRole && len(record) == rolePolicyFields:
+			policy := toRolePolicies([][]string{record[1:]})[0]
+			if err := ValidateRolePolicy(policy); err != nil {
+				return nil, atLine(err, line)
+			}
+			rolePolicies = append(rolePolicies, policy.rule(service.domains()))
+		default:
+			return nil, &PolicyInvalidError{Line: line, Reason: expecting}
+		}
+	}
+
+	var result PolicyImportResult
+	err := service.Engine.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if result.Policies, err = insertRulesTx(tx, PolicyTypePermission, policies); err != nil {
+			return err
+		}
+		result.RolePolicies, err = insertRulesTx(tx, PolicyTypeRole, rolePolicies)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := service.ReloadPolicy(); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// insertRulesTx stores within tx the rules not stored yet and returns how many were added.
+func insertRulesTx(tx *gorm.DB, ptype string, rules [][]string) (int, error) {
+	if len(rules) == 0 {
+		return 0, nil
+	}
+	rows := make([]gormadapter.CasbinRule, len(rules))
+	for idx, rule := range rules {
+		row := &rows[idx]
+		row.Ptype = ptype
+		values := []*string{&row.V0, &row.V1, &row.V2, &row.V3, &row.V4, &row.V5}
+		for field, value := range rule {
+			*values[field] = value
+		}
+	}
+	result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&rows)
+	return int(result.RowsAffected), result.Error
+}
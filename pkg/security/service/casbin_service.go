@@ -1,9 +1,14 @@
 package service
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/casbin/casbin/v2"
+	gormadapter "github.com/casbin/gorm-adapter/v3"
 	"github.com/rs/zerolog/log"
-	"time"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 const (
@@ -23,40 +28,206 @@ g = _, _
 [matchers]
 m = g(r.sub, p.sub) && regexMatch(r.obj, p.obj) && (r.act == p.act || p.act == "*")
 `
+	// DomainModelString scopes roles and permissions to a tenant, the "*" domain holds the global ones.
+	// Roles granted in "*" reach the global policies and those of the tenant, roles granted in a
+	// tenant only reach the policies of that tenant.
+	DomainModelString = `
+[request_definition]
+r = sub, dom, obj, act
+
+[policy_definition]
+p = sub, dom, obj, act
+
+[policy_effect]
+e = some(where (p.eft == allow))
+
+[role_definition]
+g = _, _, _
+
+[matchers]
+m = (g(r.sub, p.sub, "*") && (p.dom == "*" || p.dom == r.dom) || g(r.sub, p.sub, r.dom) && p.dom == r.dom) && regexMatch(r.obj, p.obj) && (r.act == p.act || p.act == "*")
+`
+	// tenantRoleMatcher checks a role the user holds in the tenant, it never reaches the global policies
+	tenantRoleMatcher = `g(r.sub, p.sub, r.dom) && p.dom == r.dom && regexMatch(r.obj, p.obj) && (r.act == p.act || p.act == "*")`
+
 	DefaultPublic = "public"
 )
 
-const CasbinPublicKey = "public"
+type CasbinModelType string
+
+const (
+	CasbinModelRbac   CasbinModelType = "rbac"
+	CasbinModelDomain CasbinModelType = "domain"
+)
+
+const (
+	CasbinPublicKey = "public"
+	// PublicRoutesPattern makes every route under /api-public reachable without login
+	PublicRoutesPattern = "^/api-public/.*$"
+)
+
+// PolicySeed lists policies merged into casbin on startup, existing ones are left as they are
+// and policies missing from the seed are never removed.
+type PolicySeed struct {
+	Policies []Policy     `yaml:"policies" validate:"dive"`
+	Roles    []RolePolicy `yaml:"roles" validate:"dive"`
+}
+
+type CasbinConfig struct {
+	// Model selects the flat CasbinModelRbac, the default, or the tenant scoped CasbinModelDomain.
+	// Switching an existing database needs its casbin_rule rows migrated to the new arity
+	Model CasbinModelType `yaml:"model" validate:"omitempty,oneof=rbac domain"`
+	// Tenant resolves the tenant of a request with the domain model
+	Tenant TenantConfig `yaml:"tenant"`
+	// ResolveRoles authorizes with the roles casbin holds for the user instead of the token roles,
+	// so role changes apply before the token expires
+	ResolveRoles bool `yaml:"resolve_roles"`
+	// DisableAutoPublic stops PublicRoutesPattern from being registered as a public policy
+	DisableAutoPublic bool       `yaml:"disable_auto_public"`
+	Seed              PolicySeed `yaml:"seed"`
+	// SyncIntervalSeconds reloads the whole policy as a fallback to the change notifications
+	SyncIntervalSeconds int `yaml:"sync_interval_seconds"`
+}
+
+func (config *CasbinConfig) IsDomainModel() bool {
+	return config.Model == CasbinModelDomain
+}
+
+func (config *CasbinConfig) ModelString() string {
+	if config.IsDomainModel() {
+		return DomainModelString
+	}
+	return ModelString
+}
+
+// UserSubject is the casbin subject of a user, its roles are the "g" policies of the subject.
+func UserSubject(userID uint) string {
+	return fmt.Sprintf("user:%d", userID)
+}
 
 type CasbinService struct {
-	Enforcer *casbin.Enforcer
+	Enforcer       *casbin.SyncedEnforcer
+	Engine         *gorm.DB
+	PublicPolicies [][]string
+	CasbinConfig   *CasbinConfig
+
+	routes []*RoutePermission
+	cancel context.CancelFunc
 }
 
-func NewCasbinService(enforcer *casbin.Enforcer) *CasbinService {
-	service := &CasbinService{Enforcer: enforcer}
+func NewCasbinService(enforcer *casbin.SyncedEnforcer, engine *gorm.DB, casbinConfig *CasbinConfig) *CasbinService {
+	service := &CasbinService{
+		Enforcer:       enforcer,
+		Engine:         engine,
+		PublicPolicies: [][]string{},
+		CasbinConfig:   casbinConfig,
+	}
 	return service
 }
 
 func (service *CasbinService) PostConstruct() {
-	service.PollingSyncingPolicy()
+	if err := service.installPolicyTrigger(); err != nil {
+		log.Fatal().Msgf("Failed to install the casbin policy trigger: %v", err)
+	}
+	if !service.CasbinConfig.DisableAutoPublic {
+		service.RegisterPublicPolicy(PublicRoutesPattern, PolicyActionAny)
+	}
+	service.ensurePublicPolicies()
+	service.seedPolicies()
+	service.WatchPolicy()
 }
 
-func (service *CasbinService) PollingSyncingPolicy() {
-	log.Info().Msg("Start syncing policy for every 60 seconds")
-	go func() {
-		for {
-			time.Sleep(10 * time.Second)
-			if err := service.Enforcer.LoadPolicy(); err != nil {
-				log.Warn().Msgf("Failed to sync policy: %v", err)
-			}
+// RegisterPublicPolicy declares a route reachable without login, it is persisted on PostConstruct.
+// The object is a regex like every other policy object, so it should be anchored.
+func (service *CasbinService) RegisterPublicPolicy(object string, action string) {
+	service.PublicPolicies = append(service.PublicPolicies, []string{CasbinPublicKey, object, action})
+}
+
+// mergePolicy adds the policy unless it exists and reports whether it was added.
+func (service *CasbinService) mergePolicy(policy *Policy) (bool, error) {
+	if err := service.AddPolicy(policy); err != nil {
+		if errors.Is(err, PolicyExists) {
+			return false, nil
 		}
-	}()
+		return false, err
+	}
+	return true, nil
 }
 
-func (service *CasbinService) HasPermission(subject, object, action string) (bool, error) {
+func (service *CasbinService) ensurePublicPolicies() {
+	for _, rule := range service.PublicPolicies {
+		policy := &Policy{Subject: rule[0], Object: rule[1], Action: rule[2]}
+		added, err := service.mergePolicy(policy)
+		if err != nil {
+			log.Warn().Msgf("Failed to add public policy %v: %v", rule, err)
+			continue
+		}
+		if added {
+			log.Info().Msgf("Public policy added: %v", rule)
+		}
+	}
+}
+
+// seedPolicies merges the configured seed, an invalid seed is a configuration error.
+func (service *CasbinService) seedPolicies() {
+	seed := &service.CasbinConfig.Seed
+	for idx := range seed.Policies {
+		policy := &seed.Policies[idx]
+		added, err := service.mergePolicy(policy)
+		if err != nil {
+			log.Fatal().Msgf("Failed to seed policy %v: %v", policy.rule(service.domains()), err)
+		}
+		if added {
+			log.Info().Msgf("Seeded policy: %v", policy.rule(service.domains()))
+		}
+	}
+	for idx := range seed.Roles {
+		policy := &seed.Roles[idx]
+		err := service.AddRolePolicy(policy)
+		if errors.Is(err, PolicyExists) {
+			continue
+		}
+		if err != nil {
+			log.Fatal().Msgf("Failed to seed role policy %v: %v", policy.rule(service.domains()), err)
+		}
+		log.Info().Msgf("Seeded role policy: %v", policy.rule(service.domains()))
+	}
+}
+
+func (service *CasbinService) domains() bool {
+	return service.CasbinConfig.IsDomainModel()
+}
+
+// globalDomain is the domain of the role assignments that are not tied to a tenant.
+func (service *CasbinService) globalDomain() string {
+	if service.domains() {
+		return PolicyDomainAny
+	}
+	return ""
+}
+
+// Enforce checks the request against the policies, the domain is ignored by the flat model.
+func (service *CasbinService) Enforce(subject, domain, object, action string) (bool, error) {
+	if service.domains() {
+		return service.Enforcer.Enforce(subject, domain, object, action)
+	}
 	return service.Enforcer.Enforce(subject, object, action)
 }
 
+// EnforceTenantRole checks a role the user holds in the tenant, like the tenant roles of the token
+// claims. Only the policies of the tenant apply, never the global ones.
+func (service *CasbinService) EnforceTenantRole(role, tenant, object, action string) (bool, error) {
+	if !service.domains() || tenant == "" || tenant == PolicyDomainAny {
+		return false, nil
+	}
+	return service.Enforcer.EnforceWithMatcher(tenantRoleMatcher, role, tenant, object, action)
+}
+
+// HasPermission checks the global permissions.
+func (service *CasbinService) HasPermission(subject, object, action string) (bool, error) {
+	return service.Enforce(subject, PolicyDomainAny, object, action)
+}
+
 func (service *CasbinService) GetAllUsedRoles() ([]string, error) {
 	roles := []string{}
 	policyRoles, err := service.Enforcer.GetAllSubjects()
@@ -74,5 +245,82 @@ func (service *CasbinService) GetAllUsedRoles() ([]string, error) {
 }
 
 func (service *CasbinService) AddRoleForUser(user string, role string) (bool, error) {
+	if service.domains() {
+		return service.Enforcer.AddRoleForUser(user, role, PolicyDomainAny)
+	}
 	return service.Enforcer.AddRoleForUser(user, role)
 }
+
+// GetRolesForUser returns the roles of the subject that are not tied to a tenant.
+func (service *CasbinService) GetRolesForUser(user string) ([]string, error) {
+	if service.domains() {
+		return service.Enforcer.GetRolesForUser(user, PolicyDomainAny)
+	}
+	return service.Enforcer.GetRolesForUser(user)
+}
+
+// GetTenantRoles returns the roles of the subject in each tenant it belongs to, always empty with the flat model.
+func (service *CasbinService) GetTenantRoles(user string) (map[string][]string, error) {
+	tenantRoles := map[string][]string{}
+	if !service.domains() {
+		return tenantRoles, nil
+	}
+	rules, err := service.Enforcer.GetFilteredGroupingPolicy(0, user)
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		if len(rule) < 3 || rule[2] == PolicyDomainAny {
+			continue
+		}
+		tenantRoles[rule[2]] = append(tenantRoles[rule[2]], rule[1])
+	}
+	return tenantRoles, nil
+}
+
+// ReplaceRolesForUserTx rewrites the global "g" policies of the subject within tx, the enforcer only
+// sees them once ReloadPolicy runs after the commit.
+func (service *CasbinService) ReplaceRolesForUserTx(tx *gorm.DB, user string, roles []string) error {
+	return service.replaceRolesTx(tx, user, service.globalDomain(), roles)
+}
+
+// ReplaceTenantRolesForUser rewrites the "g" policies of the subject in the tenant.
+func (service *CasbinService) ReplaceTenantRolesForUser(ctx context.Context, user string, tenant string, roles []string) error {
+	if !service.domains() {
+		return TenantModelDisabled
+	}
+	if tenant == "" || tenant == PolicyDomainAny {
+		return &PolicyInvalidError{Reason: "tenant must be a single tenant"}
+	}
+	err := service.Engine.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return service.replaceRolesTx(tx, user, tenant, roles)
+	})
+	if err != nil {
+		return err
+	}
+	return service.ReloadPolicy()
+}
+
+// RemoveSubjectTx deletes within tx the "p" and "g" policies of the subject, in every domain.
+func (service *CasbinService) RemoveSubjectTx(tx *gorm.DB, subject string) error {
+	return tx.Where("v0 = ?", subject).Delete(&gormadapter.CasbinRule{}).Error
+}
+
+func (service *CasbinService) replaceRolesTx(tx *gorm.DB, user string, domain string, roles []string) error {
+	err := tx.Where("ptype = ? AND v0 = ? AND v2 = ?", PolicyTypeRole, user, domain).Delete(&gormadapter.CasbinRule{}).Error
+	if err != nil {
+		return err
+	}
+	if len(roles) == 0 {
+		return nil
+	}
+	rules := make([]gormadapter.CasbinRule, len(roles))
+	for idx, role := range roles {
+		rules[idx] = gormadapter.CasbinRule{Ptype: PolicyTypeRole, V0: user, V1: role, V2: domain}
+	}
+	return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&rules).Error
+}
+
+func (service *CasbinService) ReloadPolicy() error {
+	return service.Enforcer.LoadPolicy()
+}
@@ -0,0 +1,97 @@
+package service
+
+import (
+	"github.com/casbin/casbin/v2"
+	"github.com/casbin/casbin/v2/model"
+	"testing"
+)
+
+func newDomainCasbinService(t *testing.T) *CasbinService {
+	t.Helper()
+	casbinModel, err := model.NewModelFromString(DomainModelString)
+	if err != nil {
+		t.Fatalf("failed to parse the domain model: %v", err)
+	}
+	enforcer, err := casbin.NewSyncedEnforcer(casbinModel)
+	if err != nil {
+		t.Fatalf("failed to create the enforcer: %v", err)
+	}
+	_, err = enforcer.AddPolicies([][]string{
+		{"admin", PolicyDomainAny, "^/.*$", PolicyActionAny},
+		{"editor", "acme", "^/docs$", "GET"},
+	})
+	if err != nil {
+		t.Fatalf("failed to add policies: %v", err)
+	}
+	_, err = enforcer.AddGroupingPolicies([][]string{
+		{"user:1", "admin", PolicyDomainAny},
+		{"user:2", "admin", "acme"},
+		{"user:3", "editor", "acme"},
+		{"user:4", "editor", PolicyDomainAny},
+	})
+	if err != nil {
+		t.Fatalf("failed to add roles: %v", err)
+	}
+	return NewCasbinService(enforcer, nil, &CasbinConfig{Model: CasbinModelDomain})
+}
+
+func TestDomainModelEnforce(t *testing.T) {
+	service := newDomainCasbinService(t)
+
+	tests := []struct {
+		name    string
+		subject string
+		domain  string
+		object  string
+		allowed bool
+	}{
+		{"global admin without tenant", "user:1", PolicyDomainAny, "/api-admin/users", true},
+		{"global admin in a tenant", "user:1", "acme", "/api-admin/users", true},
+		{"tenant admin never reaches global policies", "user:2", "acme", "/api-admin/users", false},
+		{"tenant admin without tenant", "user:2", PolicyDomainAny, "/api-admin/users", false},
+		{"tenant role in its tenant", "user:3", "acme", "/docs", true},
+		{"tenant role in another tenant", "user:3", "other", "/docs", false},
+		{"global role reaches tenant policies", "user:4", "acme", "/docs", true},
+		{"global role outside the policy tenant", "user:4", "other", "/docs", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			allowed, err := service.Enforce(test.subject, test.domain, test.object, "GET")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if allowed != test.allowed {
+				t.Fatalf("expected allowed=%v, got %v", test.allowed, allowed)
+			}
+		})
+	}
+}
+
+func TestEnforceTenantRole(t *testing.T) {
+	service := newDomainCasbinService(t)
+
+	tests := []struct {
+		name    string
+		role    string
+		tenant  string
+		object  string
+		allowed bool
+	}{
+		{"tenant admin never reaches global policies", "admin", "acme", "/api-admin/users", false},
+		{"tenant role in its tenant", "editor", "acme", "/docs", true},
+		{"tenant role in another tenant", "editor", "other", "/docs", false},
+		{"no tenant", "editor", "", "/docs", false},
+		{"global domain is no tenant", "admin", PolicyDomainAny, "/api-admin/users", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			allowed, err := service.EnforceTenantRole(test.role, test.tenant, test.object, "GET")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if allowed != test.allowed {
+				t.Fatalf("expected allowed=%v, got %v", test.allowed, allowed)
+			}
+		})
+	}
+}
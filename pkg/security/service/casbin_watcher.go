@@ -0,0 +1,237 @@
+package service
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"github.com/casbin/casbin/v2/model"
+	gormadapter "github.com/casbin/gorm-adapter/v3"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"strings"
+	"time"
+)
+
+const (
+	// CasbinPolicyChannel is the Postgres channel notified of every casbin_rule change
+	CasbinPolicyChannel = "casbin_policy"
+
+	DefaultPolicySyncIntervalSeconds = 300
+
+	policyListenRetry = 5 * time.Second
+	// policyTriggerLock serializes the trigger installation of replicas starting together
+	policyTriggerLock  = 7011
+	policyChangeReload = "RELOAD"
+)
+
+// policyTriggerSql notifies each row change of casbin_rule, payloads over the NOTIFY limit ask for a reload.
+const policyTriggerSql = `
+CREATE OR REPLACE FUNCTION notify_casbin_rule() RETURNS trigger AS $$
+DECLARE
+	payload text;
+BEGIN
+	payload := json_build_object(
+		'op', TG_OP,
+		'old', CASE WHEN TG_OP <> 'INSERT' THEN row_to_json(OLD) END,
+		'new', CASE WHEN TG_OP <> 'DELETE' THEN row_to_json(NEW) END
+	)::text;
+	IF octet_length(payload) > 7900 THEN
+		payload := json_build_object('op', 'RELOAD')::text;
+	END IF;
+	PERFORM pg_notify('casbin_policy', payload);
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+DROP TRIGGER IF EXISTS casbin_rule_notify ON casbin_rule;
+CREATE TRIGGER casbin_rule_notify AFTER INSERT OR UPDATE OR DELETE ON casbin_rule
+	FOR EACH ROW EXECUTE FUNCTION notify_casbin_rule();
+`
+
+// policyChange is the payload of a casbin_rule notification, Old is unset on insert and New on delete.
+type policyChange struct {
+	Op  string                  `json:"op"`
+	Old *gormadapter.CasbinRule `json:"old"`
+	New *gormadapter.CasbinRule `json:"new"`
+}
+
+// casbinRuleOf returns the model section, the policy type and the values of a stored rule.
+func casbinRuleOf(rule *gormadapter.CasbinRule) (string, string, []string, error) {
+	var sec string
+	switch {
+	case strings.HasPrefix(rule.Ptype, PolicyTypePermission):
+		sec = PolicyTypePermission
+	case strings.HasPrefix(rule.Ptype, PolicyTypeRole):
+		sec = PolicyTypeRole
+	default:
+		return "", "", nil, fmt.Errorf("unknown policy type %q", rule.Ptype)
+	}
+	values := []string{rule.V0, rule.V1, rule.V2, rule.V3, rule.V4, rule.V5}
+	for len(values) > 0 && values[len(values)-1] == "" {
+		values = values[:len(values)-1]
+	}
+	return sec, rule.Ptype, values, nil
+}
+
+func (config *CasbinConfig) SyncInterval() time.Duration {
+	return time.Duration(valueOrDefault(config.SyncIntervalSeconds, DefaultPolicySyncIntervalSeconds)) * time.Second
+}
+
+func (service *CasbinService) installPolicyTrigger() error {
+	return service.Engine.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", policyTriggerLock).Error; err != nil {
+			return err
+		}
+		return tx.Exec(policyTriggerSql).Error
+	})
+}
+
+// WatchPolicy keeps the enforcer in sync with the changes of every replica, as Postgres notifies them,
+// and reloads the whole policy every SyncInterval in case a notification was lost.
+func (service *CasbinService) WatchPolicy() {
+	ctx, cancel := context.WithCancel(context.Background())
+	service.cancel = cancel
+
+	go func() {
+		for ctx.Err() == nil {
+			err := service.listenPolicy(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			log.Warn().Msgf("Policy notifications interrupted, listening again in %v: %v", policyListenRetry, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(policyListenRetry):
+			}
+		}
+	}()
+
+	go func() {
+		ticker := time.NewTicker(service.CasbinConfig.SyncInterval())
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := service.ReloadPolicy(); err != nil {
+					log.Warn().Msgf("Failed to sync policy: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+func (service *CasbinService) Stop() {
+	if service.cancel != nil {
+		service.cancel()
+	}
+}
+
+// listenPolicy holds a connection of the pool until ctx is done or the connection fails, the
+// connection is then discarded so the LISTEN never leaks to another query.
+func (service *CasbinService) listenPolicy(ctx context.Context) error {
+	sqlDB, err := service.Engine.DB()
+	if err != nil {
+		return err
+	}
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(driverConn any) error {
+		stdlibConn, ok := driverConn.(*stdlib.Conn)
+		if !ok {
+			return fmt.Errorf("policy notifications need the pgx driver, got %T", driverConn)
+		}
+		pgxConn := stdlibConn.Conn()
+		if _, err := pgxConn.Exec(ctx, "LISTEN "+CasbinPolicyChannel); err != nil {
+			return fmt.Errorf("%w: %w", driver.ErrBadConn, err)
+		}
+		// Changes made while nobody listened are only caught by a full reload
+		if err := service.ReloadPolicy(); err != nil {
+			return fmt.Errorf("%w: %w", driver.ErrBadConn, err)
+		}
+		log.Info().Msgf("Listening to policy changes on %s", CasbinPolicyChannel)
+		for {
+			notification, err := pgxConn.WaitForNotification(ctx)
+			if err != nil {
+				return fmt.Errorf("%w: %w", driver.ErrBadConn, err)
+			}
+			if err := service.applyPolicyChange(notification.Payload); err != nil {
+				log.Warn().Msgf("Failed to apply policy change, reloading the policy: %v", err)
+				if err := service.ReloadPolicy(); err != nil {
+					log.Warn().Msgf("Failed to sync policy: %v", err)
+				}
+			}
+		}
+	})
+}
+
+// applyPolicyChange updates the enforcer in memory only, the change is already stored. The replica
+// making a change is notified too, applying it again leaves the policy as it is. The model is changed
+// under the enforcer lock, requests are enforced concurrently.
+func (service *CasbinService) applyPolicyChange(payload string) error {
+	var change policyChange
+	if err := json.Unmarshal([]byte(payload), &change); err != nil {
+		return err
+	}
+	if change.Op == policyChangeReload {
+		return service.ReloadPolicy()
+	}
+
+	lock := service.Enforcer.GetLock()
+	lock.Lock()
+	defer lock.Unlock()
+	if change.Old != nil {
+		if err := service.removeModelPolicy(change.Old); err != nil {
+			return err
+		}
+	}
+	if change.New != nil {
+		if err := service.addModelPolicy(change.New); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addModelPolicy expects the enforcer lock to be held.
+func (service *CasbinService) addModelPolicy(rule *gormadapter.CasbinRule) error {
+	sec, ptype, values, err := casbinRuleOf(rule)
+	if err != nil {
+		return err
+	}
+	casbinModel := service.Enforcer.GetModel()
+	exists, err := casbinModel.HasPolicy(sec, ptype, values)
+	if err != nil || exists {
+		return err
+	}
+	if err := casbinModel.AddPolicy(sec, ptype, values); err != nil {
+		return err
+	}
+	if sec == PolicyTypeRole {
+		return service.Enforcer.BuildIncrementalRoleLinks(model.PolicyAdd, ptype, [][]string{values})
+	}
+	return nil
+}
+
+// removeModelPolicy expects the enforcer lock to be held.
+func (service *CasbinService) removeModelPolicy(rule *gormadapter.CasbinRule) error {
+	sec, ptype, values, err := casbinRuleOf(rule)
+	if err != nil {
+		return err
+	}
+	removed, err := service.Enforcer.GetModel().RemovePolicy(sec, ptype, values)
+	if err != nil || !removed {
+		return err
+	}
+	if sec == PolicyTypeRole {
+		return service.Enforcer.BuildIncrementalRoleLinks(model.PolicyRemove, ptype, [][]string{values})
+	}
+	return nil
+}
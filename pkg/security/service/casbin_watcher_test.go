@@ -0,0 +1,53 @@
+package service
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestApplyPolicyChange(t *testing.T) {
+	service := newDomainCasbinService(t)
+
+	insert := `{"op":"INSERT","new":{"ptype":"g","v0":"user:5","v1":"admin","v2":"*"}}`
+	if err := service.applyPolicyChange(insert); err != nil {
+		t.Fatalf("failed to apply the insert: %v", err)
+	}
+	if allowed, _ := service.Enforce("user:5", PolicyDomainAny, "/api-admin/users", "GET"); !allowed {
+		t.Fatal("expected the inserted role to apply")
+	}
+
+	remove := `{"op":"DELETE","old":{"ptype":"g","v0":"user:5","v1":"admin","v2":"*"}}`
+	if err := service.applyPolicyChange(remove); err != nil {
+		t.Fatalf("failed to apply the delete: %v", err)
+	}
+	if allowed, _ := service.Enforce("user:5", PolicyDomainAny, "/api-admin/users", "GET"); allowed {
+		t.Fatal("expected the deleted role to be gone")
+	}
+}
+
+// TestApplyPolicyChangeWhileEnforcing is meant for go test -race.
+func TestApplyPolicyChangeWhileEnforcing(t *testing.T) {
+	service := newDomainCasbinService(t)
+	changes := []string{
+		`{"op":"INSERT","new":{"ptype":"p","v0":"viewer","v1":"*","v2":"^/docs$","v3":"GET"}}`,
+		`{"op":"DELETE","old":{"ptype":"p","v0":"viewer","v1":"*","v2":"^/docs$","v3":"GET"}}`,
+	}
+
+	var wait sync.WaitGroup
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		for idx := range 200 {
+			if err := service.applyPolicyChange(changes[idx%len(changes)]); err != nil {
+				t.Errorf("failed to apply the change: %v", err)
+				return
+			}
+		}
+	}()
+	for range 200 {
+		if _, err := service.Enforce("viewer", PolicyDomainAny, "/docs", "GET"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	wait.Wait()
+}
@@ -0,0 +1,110 @@
+package service
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/emersion/go-msgauth/dkim"
+	"os"
+	"strings"
+)
+
+const DefaultDkimCanonicalization = "relaxed/relaxed"
+
+// DkimHeaderKeys are the header fields covered by the signature, as recommended by RFC 6376 section 5.4.1.
+var DkimHeaderKeys = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID",
+	"Mime-Version", "Content-Type", "Content-Transfer-Encoding", "List-Unsubscribe",
+}
+
+type DkimConfig struct {
+	Domain         string `yaml:"domain" validate:"required"`
+	Selector       string `yaml:"selector" validate:"required"`
+	PrivateKeyPath string `yaml:"private_key_path" validate:"required"`
+	// Canonicalization is header/body as in the c= tag, relaxed/relaxed when empty
+	Canonicalization string `yaml:"canonicalization" validate:"omitempty,oneof=simple/simple simple/relaxed relaxed/simple relaxed/relaxed"`
+}
+
+func (config *DkimConfig) canonicalization() (dkim.Canonicalization, dkim.Canonicalization) {
+	canonicalization := config.Canonicalization
+	if canonicalization == "" {
+		canonicalization = DefaultDkimCanonicalization
+	}
+	header, body, _ := strings.Cut(canonicalization, "/")
+	return dkim.Canonicalization(header), dkim.Canonicalization(body)
+}
+
+func loadDkimPrivateKey(path string) (crypto.Signer, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found in DKIM private key %s", path)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch signer := key.(type) {
+	case *rsa.PrivateKey:
+		return signer, nil
+	case ed25519.PrivateKey:
+		return signer, nil
+	default:
+		return nil, errors.New("DKIM private key must be an RSA or Ed25519 key")
+	}
+}
+
+var _ IMailTransport = (*DkimTransport)(nil)
+
+// DkimTransport signs every message before handing it to the wrapped transport, since
+// signing happens at delivery, messages waiting in the mail queue pick up key rotations.
+type DkimTransport struct {
+	Transport   IMailTransport
+	SignOptions *dkim.SignOptions
+}
+
+func NewDkimTransport(transport IMailTransport, config *DkimConfig) (*DkimTransport, error) {
+	signer, err := loadDkimPrivateKey(config.PrivateKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	headerCanonicalization, bodyCanonicalization := config.canonicalization()
+	return &DkimTransport{
+		Transport: transport,
+		SignOptions: &dkim.SignOptions{
+			Domain:                 config.Domain,
+			Selector:               config.Selector,
+			Signer:                 signer,
+			HeaderCanonicalization: headerCanonicalization,
+			BodyCanonicalization:   bodyCanonicalization,
+			HeaderKeys:             DkimHeaderKeys,
+		},
+	}, nil
+}
+
+func (transport *DkimTransport) Send(from string, to []string, rawMessage []byte) error {
+	var signed bytes.Buffer
+	if err := dkim.Sign(&signed, bytes.NewReader(rawMessage), transport.SignOptions); err != nil {
+		return err
+	}
+	return transport.Transport.Send(from, to, signed.Bytes())
+}
+
+func (transport *DkimTransport) Close() error {
+	return transport.Transport.Close()
+}
+
+func (transport *DkimTransport) Unwrap() IMailTransport {
+	return transport.Transport
+}
@@ -6,12 +6,47 @@ var (
 	UserNotFound        = errors.New("UserNotFound")
 	UserExists          = errors.New("UserExists")
 	UserAlreadyVerified = errors.New("UserAlreadyVerified")
+	UserNotVerified     = errors.New("UserNotVerified")
 
-	OtpIncorrect = errors.New("OtpIncorrect")
-	OtpNotFound  = errors.New("OtpNotFound")
+	OtpIncorrect           = errors.New("OtpIncorrect")
+	OtpNotFound            = errors.New("OtpNotFound")
+	OtpExpired             = errors.New("OtpExpired")
+	OtpAttemptsExceeded    = errors.New("OtpAttemptsExceeded")
+	OtpResendLimitExceeded = errors.New("OtpResendLimitExceeded")
 
 	TokenInvalid = errors.New("TokenInvalid")
 	TokenExpired = errors.New("TokenExpired")
 
 	ResetPasswordNotMatched = errors.New("ResetPasswordNotMatched")
+
+	PasswordIncorrect         = errors.New("PasswordIncorrect")
+	PasswordHashUnknownFormat = errors.New("PasswordHashUnknownFormat")
+
+	MfaCodeIncorrect        = errors.New("MfaCodeIncorrect")
+	MfaNotEnabled           = errors.New("MfaNotEnabled")
+	MfaAlreadyEnabled       = errors.New("MfaAlreadyEnabled")
+	MfaEnrollmentNotStarted = errors.New("MfaEnrollmentNotStarted")
+	MfaMethodMismatch       = errors.New("MfaMethodMismatch")
+
+	InvitationNotFound        = errors.New("InvitationNotFound")
+	InvitationExpired         = errors.New("InvitationExpired")
+	InvitationAlreadyAccepted = errors.New("InvitationAlreadyAccepted")
+
+	AccountLocked   = errors.New("AccountLocked")
+	AccountDisabled = errors.New("AccountDisabled")
+	AccountPending  = errors.New("AccountPending")
+	LoginThrottled  = errors.New("LoginThrottled")
+
+	AvatarStorageDisabled = errors.New("AvatarStorageDisabled")
+	AvatarInvalid         = errors.New("AvatarInvalid")
+	AvatarTooLarge        = errors.New("AvatarTooLarge")
+
+	PolicyInvalid  = errors.New("PolicyInvalid")
+	PolicyExists   = errors.New("PolicyExists")
+	PolicyNotFound = errors.New("PolicyNotFound")
+
+	TenantModelDisabled = errors.New("TenantModelDisabled")
+
+	MailNotFound      = errors.New("MailNotFound")
+	MailAlreadyQueued = errors.New("MailAlreadyQueued")
 )
@@ -0,0 +1,255 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/GolangSpring/gospring/application"
+	. "github.com/GolangSpring/gospring/pkg/security/repository"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"net/url"
+	"time"
+)
+
+const (
+	DefaultInvitationExpirationHour = 72
+	DefaultInvitationAcceptUrl      = "/accept-invitation"
+)
+
+type InvitationConfig struct {
+	// AcceptUrl is the frontend page receiving the invitation token as `token` query parameter
+	AcceptUrl      string `yaml:"accept_url"`
+	ExpirationHour int    `yaml:"expiration_hour"`
+}
+
+func (config *InvitationConfig) GetAcceptUrl() string {
+	if config == nil || config.AcceptUrl == "" {
+		return DefaultInvitationAcceptUrl
+	}
+	return config.AcceptUrl
+}
+
+func (config *InvitationConfig) ExpirationDuration() time.Duration {
+	if config == nil || config.ExpirationHour <= 0 {
+		return DefaultInvitationExpirationHour * time.Hour
+	}
+	return time.Duration(config.ExpirationHour) * time.Hour
+}
+
+type InvitationClaims struct {
+	ID                 uint    `json:"id"`
+	ExpirationDuration float64 `json:"exp"`
+}
+
+type IInvitationService interface {
+	Invite(ctx context.Context, inviterID uint, email string, roles []string, locale string) (*Invitation, error)
+	AcceptInvitation(ctx context.Context, token string, name string, password string) (*User, error)
+	FindAllInvitations(ctx context.Context) ([]*Invitation, error)
+	RevokeInvitation(ctx context.Context, invitationID uint) error
+}
+
+var _ application.IService = (*InvitationService)(nil)
+var _ IInvitationService = (*InvitationService)(nil)
+
+type InvitationService struct {
+	InvitationRepository IInvitationRepository
+	SmtpService          ISmtpService
+	TemplateService      ITemplateService
+	UserService          IUserService
+	AuthService          IAuthService
+	CasbinService        *CasbinService
+	InvitationConfig     *InvitationConfig
+}
+
+func NewInvitationService(
+	invitationRepository IInvitationRepository,
+	smtpService ISmtpService,
+	templateService ITemplateService,
+	userService IUserService,
+	authService IAuthService,
+	casbinService *CasbinService,
+	invitationConfig *InvitationConfig,
+) *InvitationService {
+	return &InvitationService{
+		InvitationRepository: invitationRepository,
+		SmtpService:          smtpService,
+		TemplateService:      templateService,
+		UserService:          userService,
+		AuthService:          authService,
+		CasbinService:        casbinService,
+		InvitationConfig:     invitationConfig,
+	}
+}
+
+func (service *InvitationService) PostConstruct() {}
+
+func (service *InvitationService) Invite(ctx context.Context, inviterID uint, email string, roles []string, locale string) (*Invitation, error) {
+	email = NormalizeEmail(email)
+	if user, err := service.UserService.FindByEmail(ctx, email); err == nil && user != nil {
+		return nil, &UserExistsError{Field: "email"}
+	}
+
+	// Inviting the same email again replaces the pending invitation, so only the latest link works
+	if pending, err := service.InvitationRepository.FindPendingByEmail(ctx, email); err == nil && pending != nil {
+		if err := service.InvitationRepository.DeleteByID(ctx, pending.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	invitation := &Invitation{
+		Email:     email,
+		Roles:     roles,
+		Locale:    locale,
+		InvitedBy: inviterID,
+		ExpiresAt: time.Now().Add(service.InvitationConfig.ExpirationDuration()),
+	}
+	if err := service.InvitationRepository.Save(ctx, invitation); err != nil {
+		return nil, err
+	}
+
+	if err := service.sendInvitationEmail(invitation); err != nil {
+		return nil, err
+	}
+	log.Info().Msgf("User %d invited %s with roles %v", inviterID, email, roles)
+	return invitation, nil
+}
+
+func (service *InvitationService) issueInvitationToken(invitation *Invitation) string {
+	claims := jwt.MapClaims{
+		"purpose": string(PurposeInvitation),
+		"id":      invitation.ID,
+		"exp":     invitation.ExpiresAt.Unix(),
+	}
+	return service.AuthService.IssueJsonWebToken(&claims)
+}
+
+func (service *InvitationService) buildInviteLink(token string) (string, error) {
+	acceptUrl, err := url.Parse(service.InvitationConfig.GetAcceptUrl())
+	if err != nil {
+		return "", err
+	}
+	query := acceptUrl.Query()
+	query.Set("token", token)
+	acceptUrl.RawQuery = query.Encode()
+	return acceptUrl.String(), nil
+}
+
+func (service *InvitationService) sendInvitationEmail(invitation *Invitation) error {
+	inviteLink, err := service.buildInviteLink(service.issueInvitationToken(invitation))
+	if err != nil {
+		return err
+	}
+
+	emailTemplate := NewInvitationEmailTemplate(invitation.Email, inviteLink, service.SmtpService.GetSmtpConfig().CompanyName)
+	email, err := service.TemplateService.Render(TemplateInvitation, invitation.Locale, emailTemplate)
+	if err != nil {
+		return err
+	}
+
+	message := service.SmtpService.CreateRenderedMessage(invitation.Email, email)
+	SetIdempotencyKey(message, fmt.Sprintf("invitation:%d", invitation.ID))
+	return service.SmtpService.SendEmail(message)
+}
+
+func (service *InvitationService) parseInvitationClaims(token string) (*InvitationClaims, error) {
+	_jwt, err := service.AuthService.DecodeJsonWebToken(token)
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := _jwt.Claims.(jwt.MapClaims)
+	if !ok || !_jwt.Valid {
+		return nil, TokenInvalid
+	}
+
+	purpose, ok := claims["purpose"].(string)
+	if !ok || purpose != string(PurposeInvitation) {
+		return nil, fmt.Errorf("invalid or missing 'purpose' claim, getting %s, expects %v", purpose, PurposeInvitation)
+	}
+	invitationID, ok := claims["id"].(float64)
+	if !ok {
+		return nil, TokenInvalid
+	}
+	expiration, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, TokenInvalid
+	}
+	return &InvitationClaims{ID: uint(invitationID), ExpirationDuration: expiration}, nil
+}
+
+// AcceptInvitation creates the invited user, already verified and holding the invited roles. The user,
+// its casbin roles and the claim of the invitation are stored together or not at all.
+func (service *InvitationService) AcceptInvitation(ctx context.Context, token string, name string, password string) (*User, error) {
+	claims, err := service.parseInvitationClaims(token)
+	if err != nil {
+		return nil, err
+	}
+
+	invitation, err := service.InvitationRepository.FindByID(ctx, claims.ID)
+	if err != nil {
+		return nil, InvitationNotFound
+	}
+	if invitation.AcceptedAt != nil {
+		return nil, InvitationAlreadyAccepted
+	}
+	if invitation.IsExpired() {
+		return nil, InvitationExpired
+	}
+
+	if err := service.AuthService.ValidatePassword(name, invitation.Email, password); err != nil {
+		return nil, err
+	}
+	hashedPassword, err := service.AuthService.GenerateHashedPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	user, err := NewUser(name, invitation.Email, hashedPassword)
+	if err != nil {
+		return nil, err
+	}
+	user.IsVerified = true
+	user.Locale = invitation.Locale
+	user.Roles = invitation.Roles
+
+	err = service.UserService.AddUserWith(ctx, user, func(tx *gorm.DB) error {
+		claimed, err := service.InvitationRepository.MarkAcceptedTx(tx, invitation)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			return InvitationAlreadyAccepted
+		}
+		if len(user.Roles) == 0 {
+			return nil
+		}
+		return service.CasbinService.ReplaceRolesForUserTx(tx, UserSubject(user.ID), user.Roles)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(user.Roles) > 0 {
+		if err := service.CasbinService.ReloadPolicy(); err != nil {
+			log.Warn().Msgf("Failed to reload casbin policy after user %d accepted an invitation: %v", user.ID, err)
+		}
+	}
+	return user, nil
+}
+
+func (service *InvitationService) FindAllInvitations(ctx context.Context) ([]*Invitation, error) {
+	return service.InvitationRepository.FindAll(ctx)
+}
+
+func (service *InvitationService) RevokeInvitation(ctx context.Context, invitationID uint) error {
+	invitation, err := service.InvitationRepository.FindByID(ctx, invitationID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return InvitationNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if invitation.AcceptedAt != nil {
+		return InvitationAlreadyAccepted
+	}
+	return service.InvitationRepository.DeleteByID(ctx, invitation.ID)
+}
@@ -0,0 +1,40 @@
+package service
+
+import (
+	"context"
+	"errors"
+	. "github.com/GolangSpring/gospring/pkg/security/repository"
+	"gorm.io/gorm"
+	"testing"
+)
+
+// failingInvitationRepository fails every lookup with the given error.
+type failingInvitationRepository struct {
+	IInvitationRepository
+	findErr error
+}
+
+func (repo *failingInvitationRepository) FindByID(ctx context.Context, id uint) (*Invitation, error) {
+	return nil, repo.findErr
+}
+
+func TestRevokeInvitationErrors(t *testing.T) {
+	dbErr := errors.New("connection reset")
+	tests := []struct {
+		name     string
+		findErr  error
+		expected error
+	}{
+		{"missing invitation", gorm.ErrRecordNotFound, InvitationNotFound},
+		{"database failure", dbErr, dbErr},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			service := &InvitationService{InvitationRepository: &failingInvitationRepository{findErr: test.findErr}}
+
+			if err := service.RevokeInvitation(context.Background(), 1); !errors.Is(err, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,306 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"github.com/GolangSpring/gospring/application"
+	. "github.com/GolangSpring/gospring/pkg/security/repository"
+	"github.com/rs/zerolog/log"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMaxAccountFailures  = 5
+	DefaultMaxIpFailures       = 20
+	DefaultLockoutMinute       = 15
+	DefaultFailureWindowMinute = 15
+	DefaultLoginDelayBase      = time.Second
+	DefaultMaxLoginDelay       = 30 * time.Second
+)
+
+// LoginProtectionConfig limits password guessing. Every failure makes the next attempt wait
+// twice as long, after MaxAccountFailures (per user) or MaxIpFailures (per client ip) failures
+// within the failure window logins are refused for LockoutMinute.
+type LoginProtectionConfig struct {
+	Disabled            bool `yaml:"disabled"`
+	MaxAccountFailures  int  `yaml:"max_account_failures"`
+	MaxIpFailures       int  `yaml:"max_ip_failures"`
+	LockoutMinute       int  `yaml:"lockout_minute"`
+	FailureWindowMinute int  `yaml:"failure_window_minute"`
+	DelayBaseSecond     int  `yaml:"delay_base_second"`
+	MaxDelaySecond      int  `yaml:"max_delay_second"`
+}
+
+func (config *LoginProtectionConfig) IsEnabled() bool {
+	return config != nil && !config.Disabled
+}
+
+func (config *LoginProtectionConfig) GetMaxAccountFailures() int {
+	return valueOrDefault(config.MaxAccountFailures, DefaultMaxAccountFailures)
+}
+
+func (config *LoginProtectionConfig) GetMaxIpFailures() int {
+	return valueOrDefault(config.MaxIpFailures, DefaultMaxIpFailures)
+}
+
+func (config *LoginProtectionConfig) LockoutDuration() time.Duration {
+	return time.Duration(valueOrDefault(config.LockoutMinute, DefaultLockoutMinute)) * time.Minute
+}
+
+func (config *LoginProtectionConfig) FailureWindow() time.Duration {
+	return time.Duration(valueOrDefault(config.FailureWindowMinute, DefaultFailureWindowMinute)) * time.Minute
+}
+
+// Delay is the wait imposed after the given number of consecutive failures.
+func (config *LoginProtectionConfig) Delay(failures int) time.Duration {
+	if failures <= 0 {
+		return 0
+	}
+	maxDelay := DefaultMaxLoginDelay
+	if config.MaxDelaySecond > 0 {
+		maxDelay = time.Duration(config.MaxDelaySecond) * time.Second
+	}
+	delay := DefaultLoginDelayBase
+	if config.DelayBaseSecond > 0 {
+		delay = time.Duration(config.DelayBaseSecond) * time.Second
+	}
+	for idx := 1; idx < failures && delay < maxDelay; idx++ {
+		delay *= 2
+	}
+	return min(delay, maxDelay)
+}
+
+// LoginThrottleError tells the client how long to wait, it matches AccountLocked or LoginThrottled with errors.Is.
+type LoginThrottleError struct {
+	Reason     error
+	RetryAfter time.Duration
+}
+
+func (err *LoginThrottleError) Error() string {
+	return fmt.Sprintf("%v, retry after %d seconds", err.Reason, int(err.RetryAfter.Seconds()))
+}
+
+func (err *LoginThrottleError) Unwrap() error {
+	return err.Reason
+}
+
+// loginFailures is the failure state shared by the account and ip checks.
+type loginFailures struct {
+	Count        int
+	LastFailedAt time.Time
+	LockedUntil  time.Time
+}
+
+func (failures *loginFailures) check(config *LoginProtectionConfig, now time.Time) error {
+	if now.Before(failures.LockedUntil) {
+		return &LoginThrottleError{Reason: AccountLocked, RetryAfter: failures.LockedUntil.Sub(now)}
+	}
+	if now.Sub(failures.LastFailedAt) > config.FailureWindow() {
+		return nil
+	}
+	if allowedAt := failures.LastFailedAt.Add(config.Delay(failures.Count)); now.Before(allowedAt) {
+		return &LoginThrottleError{Reason: LoginThrottled, RetryAfter: allowedAt.Sub(now)}
+	}
+	return nil
+}
+
+// record counts a failure and reports whether it started a lockout.
+func (failures *loginFailures) record(config *LoginProtectionConfig, maxFailures int, now time.Time) bool {
+	if now.Sub(failures.LastFailedAt) > config.FailureWindow() || !failures.LockedUntil.IsZero() && now.After(failures.LockedUntil) {
+		failures.Count = 0
+		failures.LockedUntil = time.Time{}
+	}
+	failures.Count++
+	failures.LastFailedAt = now
+	if failures.Count >= maxFailures {
+		failures.LockedUntil = now.Add(config.LockoutDuration())
+		return true
+	}
+	return false
+}
+
+type ILoginThrottleService interface {
+	Check(ctx context.Context, user *User, ip string) error
+	RecordFailure(ctx context.Context, user *User, ip string)
+	RecordSuccess(ctx context.Context, user *User, ip string)
+	Unlock(ctx context.Context, userID uint) error
+}
+
+var _ application.IService = (*LoginThrottleService)(nil)
+var _ ILoginThrottleService = (*LoginThrottleService)(nil)
+
+// LoginThrottleService keeps account failures on the user row, so they hold across replicas,
+// and ip failures in memory.
+type LoginThrottleService struct {
+	UserService           IUserService
+	SmtpService           ISmtpService
+	TemplateService       ITemplateService
+	LoginProtectionConfig *LoginProtectionConfig
+
+	ipFailures  map[string]*loginFailures
+	lastPruneAt time.Time
+	lock        sync.Mutex
+}
+
+func NewLoginThrottleService(
+	userService IUserService,
+	smtpService ISmtpService,
+	templateService ITemplateService,
+	loginProtectionConfig *LoginProtectionConfig,
+) *LoginThrottleService {
+	return &LoginThrottleService{
+		UserService:           userService,
+		SmtpService:           smtpService,
+		TemplateService:       templateService,
+		LoginProtectionConfig: loginProtectionConfig,
+		ipFailures:            map[string]*loginFailures{},
+	}
+}
+
+func (service *LoginThrottleService) PostConstruct() {
+	if !service.LoginProtectionConfig.IsEnabled() {
+		log.Warn().Msg("Login protection is disabled, password attempts are not limited")
+	}
+}
+
+func userLoginFailures(user *User) *loginFailures {
+	failures := &loginFailures{Count: user.FailedLoginCount}
+	if user.LastFailedLoginAt != nil {
+		failures.LastFailedAt = *user.LastFailedLoginAt
+	}
+	if user.LockedUntil != nil {
+		failures.LockedUntil = *user.LockedUntil
+	}
+	return failures
+}
+
+// Check refuses the attempt while the ip or the account (when known) is locked or still waiting out its delay.
+func (service *LoginThrottleService) Check(ctx context.Context, user *User, ip string) error {
+	config := service.LoginProtectionConfig
+	if !config.IsEnabled() {
+		return nil
+	}
+	now := time.Now()
+
+	if ip != "" {
+		service.lock.Lock()
+		failures, ok := service.ipFailures[ip]
+		var err error
+		if ok {
+			err = failures.check(config, now)
+		}
+		service.lock.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	if user != nil {
+		return userLoginFailures(user).check(config, now)
+	}
+	return nil
+}
+
+func (service *LoginThrottleService) RecordFailure(ctx context.Context, user *User, ip string) {
+	config := service.LoginProtectionConfig
+	if !config.IsEnabled() {
+		return
+	}
+	now := time.Now()
+
+	if ip != "" {
+		service.lock.Lock()
+		service.pruneIpFailures(now)
+		failures, ok := service.ipFailures[ip]
+		if !ok {
+			failures = &loginFailures{}
+			service.ipFailures[ip] = failures
+		}
+		if failures.record(config, config.GetMaxIpFailures(), now) {
+			log.Warn().Msgf("Login attempts from %s locked until %v", ip, failures.LockedUntil)
+		}
+		service.lock.Unlock()
+	}
+
+	if user == nil {
+		return
+	}
+	failure := &LoginFailure{
+		FailedAt:    now,
+		WindowStart: now.Add(-config.FailureWindow()),
+		MaxFailures: config.GetMaxAccountFailures(),
+		LockUntil:   now.Add(config.LockoutDuration()),
+	}
+	if err := service.UserService.RecordUserLoginFailure(ctx, user, failure); err != nil {
+		log.Error().Msgf("Failed to record login failure of user %d: %v", user.ID, err)
+		return
+	}
+	// Only the failure reaching the limit notifies, concurrent ones past it find the account locked already
+	if failure.FailedCount == failure.MaxFailures {
+		log.Warn().Msgf("User %d locked until %v after %d failed logins", user.ID, *failure.LockedUntil, failure.FailedCount)
+		if err := service.sendAccountLockedEmail(user, *failure.LockedUntil, ip); err != nil {
+			log.Error().Msgf("Failed to send lockout notification to user %d: %v", user.ID, err)
+		}
+	}
+}
+
+// RecordSuccess resets the failures of the account only. The failures of the ip age out with the
+// window, otherwise logging into an own account would wipe the failures sprayed over other accounts.
+func (service *LoginThrottleService) RecordSuccess(ctx context.Context, user *User, ip string) {
+	if !service.LoginProtectionConfig.IsEnabled() {
+		return
+	}
+	if user.FailedLoginCount == 0 && user.LockedUntil == nil {
+		return
+	}
+	if err := service.UserService.UpdateUserLoginFailures(ctx, user, 0, nil, nil); err != nil {
+		log.Error().Msgf("Failed to reset login failures of user %d: %v", user.ID, err)
+	}
+}
+
+// Unlock clears the login failures and brings a user locked by an admin back to active.
+func (service *LoginThrottleService) Unlock(ctx context.Context, userID uint) error {
+	user, err := service.UserService.FindByID(ctx, userID)
+	if err != nil {
+		return UserNotFound
+	}
+	log.Info().Msgf("Unlocking user %d", userID)
+	if err := service.UserService.UpdateUserLoginFailures(ctx, user, 0, nil, nil); err != nil {
+		return err
+	}
+	if user.Status == AccountStatusLocked {
+		return service.UserService.UpdateUserStatus(ctx, user, AccountStatusActive, "")
+	}
+	return nil
+}
+
+// pruneIpFailures drops ips whose failures have aged out, at most once per failure window.
+func (service *LoginThrottleService) pruneIpFailures(now time.Time) {
+	window := service.LoginProtectionConfig.FailureWindow()
+	if now.Sub(service.lastPruneAt) < window {
+		return
+	}
+	service.lastPruneAt = now
+	for ip, failures := range service.ipFailures {
+		if now.Sub(failures.LastFailedAt) > window && now.After(failures.LockedUntil) {
+			delete(service.ipFailures, ip)
+		}
+	}
+}
+
+func (service *LoginThrottleService) sendAccountLockedEmail(user *User, lockedUntil time.Time, ip string) error {
+	emailTemplate := &AccountLockedEmailTemplate{
+		UserName:    user.Name,
+		CompanyName: service.SmtpService.GetSmtpConfig().CompanyName,
+		LockedUntil: lockedUntil.UTC().Format(time.RFC1123),
+		IpAddress:   ip,
+	}
+	email, err := service.TemplateService.Render(TemplateAccountLocked, user.Locale, emailTemplate)
+	if err != nil {
+		return err
+	}
+
+	message := service.SmtpService.CreateRenderedMessage(user.Email, email)
+	return service.SmtpService.SendEmail(message)
+}
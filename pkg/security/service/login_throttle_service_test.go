@@ -0,0 +1,138 @@
+package service
+
+import (
+	"context"
+	"errors"
+	. "github.com/GolangSpring/gospring/pkg/security/repository"
+	"testing"
+	"time"
+)
+
+func TestLoginProtectionDelay(t *testing.T) {
+	config := &LoginProtectionConfig{}
+	tests := map[int]time.Duration{
+		0:  0,
+		1:  time.Second,
+		2:  2 * time.Second,
+		3:  4 * time.Second,
+		10: DefaultMaxLoginDelay,
+	}
+	for failures, expected := range tests {
+		if delay := config.Delay(failures); delay != expected {
+			t.Errorf("%d failures: expected %v, got %v", failures, expected, delay)
+		}
+	}
+}
+
+func TestIpFailuresLockout(t *testing.T) {
+	config := &LoginProtectionConfig{MaxIpFailures: 3, DelayBaseSecond: 1}
+	service := NewLoginThrottleService(nil, nil, nil, config)
+	ctx := context.Background()
+
+	service.RecordFailure(ctx, nil, "10.0.0.1")
+	if err := service.Check(ctx, nil, "10.0.0.1"); !errors.Is(err, LoginThrottled) {
+		t.Fatalf("expected LoginThrottled right after a failure, got %v", err)
+	}
+	service.RecordFailure(ctx, nil, "10.0.0.1")
+	service.RecordFailure(ctx, nil, "10.0.0.1")
+
+	err := service.Check(ctx, nil, "10.0.0.1")
+	var throttleErr *LoginThrottleError
+	if !errors.Is(err, AccountLocked) || !errors.As(err, &throttleErr) {
+		t.Fatalf("expected the ip to be locked, got %v", err)
+	}
+	if throttleErr.RetryAfter <= 0 || throttleErr.RetryAfter > config.LockoutDuration() {
+		t.Fatalf("expected to retry within the lockout, got %v", throttleErr.RetryAfter)
+	}
+	if err := service.Check(ctx, nil, "10.0.0.2"); err != nil {
+		t.Fatalf("expected other ips to be allowed, got %v", err)
+	}
+}
+
+func TestIpFailuresSurviveSuccess(t *testing.T) {
+	config := &LoginProtectionConfig{MaxIpFailures: 3, DelayBaseSecond: 1}
+	service := NewLoginThrottleService(nil, nil, nil, config)
+	ctx := context.Background()
+
+	service.RecordFailure(ctx, nil, "10.0.0.1")
+	service.RecordFailure(ctx, nil, "10.0.0.1")
+	service.RecordSuccess(ctx, &User{ID: 1}, "10.0.0.1")
+	service.RecordFailure(ctx, nil, "10.0.0.1")
+
+	if err := service.Check(ctx, nil, "10.0.0.1"); !errors.Is(err, AccountLocked) {
+		t.Fatalf("expected the ip to be locked despite the successful login, got %v", err)
+	}
+}
+
+func TestLoginFailuresRestartAfterLock(t *testing.T) {
+	config := &LoginProtectionConfig{}
+	now := time.Now()
+	failures := &loginFailures{Count: 5, LastFailedAt: now.Add(-time.Minute), LockedUntil: now.Add(-time.Second)}
+
+	if locked := failures.record(config, 5, now); locked {
+		t.Fatal("expected a failure after the lock ran out to start over")
+	}
+	if failures.Count != 1 || !failures.LockedUntil.IsZero() {
+		t.Fatalf("expected the count to start over, got %+v", failures)
+	}
+}
+
+func TestLoginThrottleDisabled(t *testing.T) {
+	service := NewLoginThrottleService(nil, nil, nil, &LoginProtectionConfig{Disabled: true})
+	ctx := context.Background()
+	for range 50 {
+		service.RecordFailure(ctx, nil, "10.0.0.1")
+	}
+	if err := service.Check(ctx, nil, "10.0.0.1"); err != nil {
+		t.Fatalf("expected no throttling when disabled, got %v", err)
+	}
+}
+
+// unlockUserService records the updates of Unlock, the other methods are left unimplemented.
+type unlockUserService struct {
+	IUserService
+	user   *User
+	status AccountStatus
+}
+
+func (service *unlockUserService) FindByID(ctx context.Context, id uint) (*User, error) {
+	return service.user, nil
+}
+
+func (service *unlockUserService) UpdateUserLoginFailures(ctx context.Context, user *User, failedCount int, lastFailedAt *time.Time, lockedUntil *time.Time) error {
+	user.FailedLoginCount, user.LastFailedLoginAt, user.LockedUntil = failedCount, lastFailedAt, lockedUntil
+	return nil
+}
+
+func (service *unlockUserService) UpdateUserStatus(ctx context.Context, user *User, status AccountStatus, reason string) error {
+	service.status = status
+	return nil
+}
+
+func TestUnlockRestoresLockedStatus(t *testing.T) {
+	lockedUntil := time.Now().Add(time.Hour)
+	tests := []struct {
+		name     string
+		status   AccountStatus
+		expected AccountStatus
+	}{
+		{"locked by an admin", AccountStatusLocked, AccountStatusActive},
+		{"disabled stays disabled", AccountStatusDisabled, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			userService := &unlockUserService{user: &User{Status: test.status, FailedLoginCount: 5, LockedUntil: &lockedUntil}}
+			service := NewLoginThrottleService(userService, nil, nil, &LoginProtectionConfig{})
+
+			if err := service.Unlock(context.Background(), 1); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if userService.user.FailedLoginCount != 0 || userService.user.LockedUntil != nil {
+				t.Fatalf("expected the failures to be cleared, got %+v", userService.user)
+			}
+			if userService.status != test.expected {
+				t.Fatalf("expected status %q, got %q", test.expected, userService.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,295 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/GolangSpring/gospring/application"
+	. "github.com/GolangSpring/gospring/pkg/security/repository"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/gomail.v2"
+	"gorm.io/gorm"
+	"sync"
+	"time"
+)
+
+const (
+	// MailIdempotencyHeader lets callers deduplicate queued emails, a second message with the
+	// same key is not queued again. It is stripped before the message is stored or sent.
+	MailIdempotencyHeader = "X-Idempotency-Key"
+
+	DefaultMailQueueWorkers       = 2
+	DefaultMailQueuePollSecond    = 5
+	DefaultMailQueueBatchSize     = 10
+	DefaultMailQueueMaxAttempts   = 8
+	DefaultMailQueueBackoffSecond = 30
+	DefaultMailQueueMaxBackoff    = 6 * time.Hour
+	mailQueueStaleSending         = 10 * time.Minute
+)
+
+type MailQueueConfig struct {
+	Enabled            bool `yaml:"enabled"`
+	Workers            int  `yaml:"workers"`
+	PollIntervalSecond int  `yaml:"poll_interval_second"`
+	BatchSize          int  `yaml:"batch_size"`
+	MaxAttempts        int  `yaml:"max_attempts"`
+	BackoffSecond      int  `yaml:"backoff_second"`
+	MaxBackoffSecond   int  `yaml:"max_backoff_second"`
+}
+
+func valueOrDefault(value int, defaultValue int) int {
+	if value <= 0 {
+		return defaultValue
+	}
+	return value
+}
+
+func (config *MailQueueConfig) GetWorkers() int {
+	return valueOrDefault(config.Workers, DefaultMailQueueWorkers)
+}
+
+func (config *MailQueueConfig) PollInterval() time.Duration {
+	return time.Duration(valueOrDefault(config.PollIntervalSecond, DefaultMailQueuePollSecond)) * time.Second
+}
+
+func (config *MailQueueConfig) GetBatchSize() int {
+	return valueOrDefault(config.BatchSize, DefaultMailQueueBatchSize)
+}
+
+func (config *MailQueueConfig) GetMaxAttempts() int {
+	return valueOrDefault(config.MaxAttempts, DefaultMailQueueMaxAttempts)
+}
+
+// Backoff doubles the delay after every failed attempt, capped by MaxBackoffSecond.
+func (config *MailQueueConfig) Backoff(attempts int) time.Duration {
+	maxBackoff := DefaultMailQueueMaxBackoff
+	if config.MaxBackoffSecond > 0 {
+		maxBackoff = time.Duration(config.MaxBackoffSecond) * time.Second
+	}
+	backoff := time.Duration(valueOrDefault(config.BackoffSecond, DefaultMailQueueBackoffSecond)) * time.Second
+	for idx := 0; idx < attempts && backoff < maxBackoff; idx++ {
+		backoff *= 2
+	}
+	return min(backoff, maxBackoff)
+}
+
+func SetIdempotencyKey(message *gomail.Message, key string) {
+	message.SetHeader(MailIdempotencyHeader, key)
+}
+
+type IMailQueueService interface {
+	ISmtpService
+	EnqueueEmail(ctx context.Context, message *gomail.Message, idempotencyKey string) (*MailOutbox, error)
+	FindMails(ctx context.Context, status MailStatus, limit int, offset int) ([]*MailOutbox, error)
+	FindMail(ctx context.Context, id uint) (*MailOutbox, error)
+	Resend(ctx context.Context, id uint) (*MailOutbox, error)
+	Stop()
+}
+
+var _ application.IService = (*MailQueueService)(nil)
+var _ IMailQueueService = (*MailQueueService)(nil)
+
+// MailQueueService decorates the SMTP service: SendEmail stores the message in the outbox
+// table and returns right away, background workers deliver it through Transport with retries.
+type MailQueueService struct {
+	Transport            ISmtpService
+	MailOutboxRepository IMailOutboxRepository
+	MailQueueConfig      *MailQueueConfig
+
+	wakeup    chan struct{}
+	cancel    context.CancelFunc
+	waitGroup sync.WaitGroup
+}
+
+func NewMailQueueService(transport ISmtpService, mailOutboxRepository IMailOutboxRepository, mailQueueConfig *MailQueueConfig) *MailQueueService {
+	return &MailQueueService{
+		Transport:            transport,
+		MailOutboxRepository: mailOutboxRepository,
+		MailQueueConfig:      mailQueueConfig,
+		wakeup:               make(chan struct{}, 1),
+	}
+}
+
+func (service *MailQueueService) PostConstruct() {
+	ctx, cancel := context.WithCancel(context.Background())
+	service.cancel = cancel
+
+	workers := service.MailQueueConfig.GetWorkers()
+	log.Info().Msgf("Starting %d mail queue workers", workers)
+	for idx := 0; idx < workers; idx++ {
+		service.waitGroup.Add(1)
+		go service.runWorker(ctx)
+	}
+}
+
+func (service *MailQueueService) Stop() {
+	if service.cancel == nil {
+		return
+	}
+	service.cancel()
+	service.waitGroup.Wait()
+	log.Info().Msg("Mail queue workers stopped")
+}
+
+func (service *MailQueueService) GetSmtpConfig() *SmtpConfig {
+	return service.Transport.GetSmtpConfig()
+}
+
+func (service *MailQueueService) CreateNewMessage(to string, subject string, body string, contentType ContentType, attachments ...*MailAttachment) *gomail.Message {
+	return service.Transport.CreateNewMessage(to, subject, body, contentType, attachments...)
+}
+
+func (service *MailQueueService) BuildMessage(mail *MailMessage) *gomail.Message {
+	return service.Transport.BuildMessage(mail)
+}
+
+func (service *MailQueueService) CreateRenderedMessage(to string, email *RenderedEmail) *gomail.Message {
+	return service.Transport.CreateRenderedMessage(to, email)
+}
+
+func (service *MailQueueService) SendEmail(message *gomail.Message) error {
+	var idempotencyKey string
+	if keys := message.GetHeader(MailIdempotencyHeader); len(keys) > 0 {
+		idempotencyKey = keys[0]
+	}
+	_, err := service.EnqueueEmail(context.Background(), message, idempotencyKey)
+	return err
+}
+
+func (service *MailQueueService) SendRawEmail(from string, to []string, rawMessage []byte) error {
+	mail := &MailOutbox{
+		Sender:        from,
+		Recipients:    to,
+		RawMessage:    rawMessage,
+		Status:        MailStatusPending,
+		NextAttemptAt: time.Now(),
+	}
+	if err := service.MailOutboxRepository.Save(context.Background(), mail); err != nil {
+		return err
+	}
+	service.notifyWorkers()
+	return nil
+}
+
+func (service *MailQueueService) EnqueueEmail(ctx context.Context, message *gomail.Message, idempotencyKey string) (*MailOutbox, error) {
+	if idempotencyKey != "" {
+		if existing, err := service.MailOutboxRepository.FindByIdempotencyKey(ctx, idempotencyKey); err == nil {
+			log.Info().Msgf("Mail with idempotency key %s already queued as %d", idempotencyKey, existing.ID)
+			return existing, nil
+		}
+	}
+
+	sender, recipients, err := messageEnvelope(message)
+	if err != nil {
+		return nil, err
+	}
+	rawMessage, err := writeMessage(message)
+	if err != nil {
+		return nil, err
+	}
+
+	mail := &MailOutbox{
+		Sender:        sender,
+		Recipients:    recipients,
+		RawMessage:    rawMessage,
+		Status:        MailStatusPending,
+		NextAttemptAt: time.Now(),
+	}
+	if subjects := message.GetHeader("Subject"); len(subjects) > 0 {
+		mail.Subject = subjects[0]
+	}
+	if idempotencyKey != "" {
+		mail.IdempotencyKey = &idempotencyKey
+	}
+
+	if err := service.MailOutboxRepository.Save(ctx, mail); err != nil {
+		return nil, err
+	}
+	service.notifyWorkers()
+	return mail, nil
+}
+
+func (service *MailQueueService) FindMails(ctx context.Context, status MailStatus, limit int, offset int) ([]*MailOutbox, error) {
+	return service.MailOutboxRepository.FindByStatus(ctx, status, limit, offset)
+}
+
+func (service *MailQueueService) FindMail(ctx context.Context, id uint) (*MailOutbox, error) {
+	mail, err := service.MailOutboxRepository.FindByID(ctx, id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, MailNotFound
+	}
+	return mail, err
+}
+
+// Resend puts a dead-lettered or already sent message back in the queue with a fresh attempt budget.
+func (service *MailQueueService) Resend(ctx context.Context, id uint) (*MailOutbox, error) {
+	mail, err := service.FindMail(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if mail.Status == MailStatusPending || mail.Status == MailStatusSending {
+		return nil, MailAlreadyQueued
+	}
+	if err := service.MailOutboxRepository.Requeue(ctx, mail); err != nil {
+		return nil, err
+	}
+	service.notifyWorkers()
+	return service.FindMail(ctx, id)
+}
+
+func (service *MailQueueService) notifyWorkers() {
+	select {
+	case service.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+func (service *MailQueueService) runWorker(ctx context.Context) {
+	defer service.waitGroup.Done()
+	ticker := time.NewTicker(service.MailQueueConfig.PollInterval())
+	defer ticker.Stop()
+
+	for {
+		service.processDue(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-service.wakeup:
+		}
+	}
+}
+
+func (service *MailQueueService) processDue(ctx context.Context) {
+	mails, err := service.MailOutboxRepository.ClaimDue(ctx, service.MailQueueConfig.GetBatchSize(), mailQueueStaleSending)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Warn().Msgf("Failed to claim queued mails: %v", err)
+		}
+		return
+	}
+	for _, mail := range mails {
+		service.deliver(ctx, mail)
+	}
+}
+
+func (service *MailQueueService) deliver(ctx context.Context, mail *MailOutbox) {
+	sendErr := service.Transport.SendRawEmail(mail.Sender, mail.Recipients, mail.RawMessage)
+	// The outcome is recorded even while shutting down, otherwise the mail would stay in sending
+	ctx = context.WithoutCancel(ctx)
+
+	var err error
+	switch {
+	case sendErr == nil:
+		err = service.MailOutboxRepository.MarkSent(ctx, mail)
+	case mail.Attempts+1 >= service.MailQueueConfig.GetMaxAttempts():
+		log.Error().Msgf("Mail %d dead-lettered after %d attempts: %v", mail.ID, mail.Attempts+1, sendErr)
+		err = service.MailOutboxRepository.MarkDead(ctx, mail, sendErr.Error())
+	default:
+		nextAttemptAt := time.Now().Add(service.MailQueueConfig.Backoff(mail.Attempts))
+		log.Warn().Msgf("Mail %d attempt %d failed, retrying at %v: %v", mail.ID, mail.Attempts+1, nextAttemptAt, sendErr)
+		err = service.MailOutboxRepository.MarkRetry(ctx, mail, nextAttemptAt, sendErr.Error())
+	}
+	if err != nil {
+		log.Error().Msgf("Failed to update state of mail %d: %v", mail.ID, err)
+	}
+}
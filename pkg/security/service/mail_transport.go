@@ -0,0 +1,388 @@
+package service
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/gomail.v2"
+	"mime"
+	netMail "net/mail"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+type MailTransportKind string
+
+const (
+	MailTransportSmtp   MailTransportKind = "smtp"
+	MailTransportFile   MailTransportKind = "file"
+	MailTransportMemory MailTransportKind = "memory"
+)
+
+type TlsMode string
+
+const (
+	TlsModeStartTls TlsMode = "starttls"
+	TlsModeImplicit TlsMode = "implicit"
+)
+
+type MailFileFormat string
+
+const (
+	MailFileFormatEml     MailFileFormat = "eml"
+	MailFileFormatMaildir MailFileFormat = "maildir"
+)
+
+const (
+	DefaultSmtpPoolSize       = 2
+	DefaultMailFileDirectory  = "./mails"
+	DefaultMemoryMailCapacity = 200
+)
+
+// IMailTransport delivers serialized MIME messages, SmtpService builds the messages
+// and hands them to the transport selected in SmtpConfig.
+type IMailTransport interface {
+	Send(from string, to []string, rawMessage []byte) error
+	Close() error
+}
+
+func NewMailTransport(config *SmtpConfig) IMailTransport {
+	switch config.Transport {
+	case MailTransportFile:
+		return NewFileTransport(config.FileDirectory, config.FileFormat)
+	case MailTransportMemory:
+		return NewMemoryTransport(config.MemoryCapacity)
+	default:
+		return NewSmtpTransport(config)
+	}
+}
+
+// UnwrapMailTransport returns the innermost transport below decorators such as DkimTransport.
+func UnwrapMailTransport(transport IMailTransport) IMailTransport {
+	for {
+		wrapper, ok := transport.(interface{ Unwrap() IMailTransport })
+		if !ok {
+			return transport
+		}
+		transport = wrapper.Unwrap()
+	}
+}
+
+var _ IMailTransport = (*SmtpTransport)(nil)
+
+// SmtpTransport keeps up to PoolSize authenticated connections open and reuses them,
+// a pooled connection that fails is dropped and the message is retried on a fresh one.
+type SmtpTransport struct {
+	Dialer *gomail.Dialer
+	pool   chan gomail.SendCloser
+}
+
+func NewSmtpTransport(config *SmtpConfig) *SmtpTransport {
+	dialer := gomail.NewDialer(
+		config.Host,
+		config.Port,
+		config.SenderEmail,
+		config.SenderPassword,
+	)
+	switch config.TlsMode {
+	case TlsModeImplicit:
+		dialer.SSL = true
+	case TlsModeStartTls:
+		dialer.SSL = false
+	}
+	dialer.TLSConfig = &tls.Config{
+		ServerName:         config.Host,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+
+	poolSize := config.PoolSize
+	if poolSize == 0 {
+		poolSize = DefaultSmtpPoolSize
+	}
+	return &SmtpTransport{
+		Dialer: dialer,
+		pool:   make(chan gomail.SendCloser, max(poolSize, 0)),
+	}
+}
+
+func (transport *SmtpTransport) acquire() (gomail.SendCloser, bool, error) {
+	select {
+	case sender := <-transport.pool:
+		return sender, true, nil
+	default:
+		sender, err := transport.Dialer.Dial()
+		return sender, false, err
+	}
+}
+
+func (transport *SmtpTransport) release(sender gomail.SendCloser) {
+	select {
+	case transport.pool <- sender:
+	default:
+		_ = sender.Close()
+	}
+}
+
+func (transport *SmtpTransport) Send(from string, to []string, rawMessage []byte) error {
+	sender, isPooled, err := transport.acquire()
+	if err != nil {
+		return err
+	}
+
+	err = sender.Send(from, to, bytes.NewReader(rawMessage))
+	if err != nil && isPooled {
+		// The server probably closed the idle connection, try once more on a new one
+		_ = sender.Close()
+		if sender, err = transport.Dialer.Dial(); err != nil {
+			return err
+		}
+		err = sender.Send(from, to, bytes.NewReader(rawMessage))
+	}
+	if err != nil {
+		_ = sender.Close()
+		return err
+	}
+	transport.release(sender)
+	return nil
+}
+
+func (transport *SmtpTransport) Close() error {
+	for {
+		select {
+		case sender := <-transport.pool:
+			_ = sender.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+var _ IMailTransport = (*FileTransport)(nil)
+
+// FileTransport writes every message to disk instead of sending it, either as flat .eml
+// files or in a maildir (tmp/, new/, cur/) that mail clients can open directly.
+type FileTransport struct {
+	Directory string
+	Format    MailFileFormat
+}
+
+func NewFileTransport(directory string, format MailFileFormat) *FileTransport {
+	if directory == "" {
+		directory = DefaultMailFileDirectory
+	}
+	if format == "" {
+		format = MailFileFormatEml
+	}
+	return &FileTransport{
+		Directory: directory,
+		Format:    format,
+	}
+}
+
+func uniqueMailFileName() (string, error) {
+	randomBytes := make([]byte, 8)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d.%s", time.Now().UnixNano(), hex.EncodeToString(randomBytes)), nil
+}
+
+func (transport *FileTransport) Send(from string, to []string, rawMessage []byte) error {
+	fileName, err := uniqueMailFileName()
+	if err != nil {
+		return err
+	}
+
+	if transport.Format != MailFileFormatMaildir {
+		if err := os.MkdirAll(transport.Directory, 0o755); err != nil {
+			return err
+		}
+		path := filepath.Join(transport.Directory, fileName+".eml")
+		log.Info().Msgf("Mail from %s to %v written to %s", from, to, path)
+		return os.WriteFile(path, rawMessage, 0o644)
+	}
+
+	// Maildir delivery: write into tmp/ then atomically move into new/
+	for _, subDirectory := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(transport.Directory, subDirectory), 0o755); err != nil {
+			return err
+		}
+	}
+	tmpPath := filepath.Join(transport.Directory, "tmp", fileName)
+	if err := os.WriteFile(tmpPath, rawMessage, 0o644); err != nil {
+		return err
+	}
+	newPath := filepath.Join(transport.Directory, "new", fileName)
+	log.Info().Msgf("Mail from %s to %v delivered to %s", from, to, newPath)
+	return os.Rename(tmpPath, newPath)
+}
+
+func (transport *FileTransport) Close() error {
+	return nil
+}
+
+type CapturedMail struct {
+	ID         uint64    `json:"id"`
+	From       string    `json:"from"`
+	To         []string  `json:"to"`
+	Subject    string    `json:"subject"`
+	CapturedAt time.Time `json:"captured_at"`
+	Raw        string    `json:"raw,omitempty"`
+}
+
+var _ IMailTransport = (*MemoryTransport)(nil)
+
+// MemoryTransport keeps the last Capacity messages in memory for the dev mail viewer.
+type MemoryTransport struct {
+	Capacity int
+	mails    []*CapturedMail
+	nextID   uint64
+	lock     sync.RWMutex
+}
+
+func NewMemoryTransport(capacity int) *MemoryTransport {
+	if capacity <= 0 {
+		capacity = DefaultMemoryMailCapacity
+	}
+	return &MemoryTransport{
+		Capacity: capacity,
+	}
+}
+
+func decodeSubject(rawMessage []byte) string {
+	message, err := netMail.ReadMessage(bytes.NewReader(rawMessage))
+	if err != nil {
+		return ""
+	}
+	subject := message.Header.Get("Subject")
+	decoded, err := new(mime.WordDecoder).DecodeHeader(subject)
+	if err != nil {
+		return subject
+	}
+	return decoded
+}
+
+func (transport *MemoryTransport) Send(from string, to []string, rawMessage []byte) error {
+	transport.lock.Lock()
+	defer transport.lock.Unlock()
+
+	transport.nextID++
+	transport.mails = append(transport.mails, &CapturedMail{
+		ID:         transport.nextID,
+		From:       from,
+		To:         slices.Clone(to),
+		Subject:    decodeSubject(rawMessage),
+		CapturedAt: time.Now(),
+		Raw:        string(rawMessage),
+	})
+	if overflow := len(transport.mails) - transport.Capacity; overflow > 0 {
+		transport.mails = slices.Delete(transport.mails, 0, overflow)
+	}
+	log.Info().Msgf("Mail %d from %s to %v captured in memory", transport.nextID, from, to)
+	return nil
+}
+
+func (transport *MemoryTransport) Close() error {
+	return nil
+}
+
+// List returns the captured mails newest first, without their raw content.
+func (transport *MemoryTransport) List() []*CapturedMail {
+	transport.lock.RLock()
+	defer transport.lock.RUnlock()
+
+	mails := make([]*CapturedMail, 0, len(transport.mails))
+	for idx := len(transport.mails) - 1; idx >= 0; idx-- {
+		summary := *transport.mails[idx]
+		summary.Raw = ""
+		mails = append(mails, &summary)
+	}
+	return mails
+}
+
+func (transport *MemoryTransport) Get(id uint64) (*CapturedMail, error) {
+	transport.lock.RLock()
+	defer transport.lock.RUnlock()
+
+	for _, mail := range transport.mails {
+		if mail.ID == id {
+			found := *mail
+			return &found, nil
+		}
+	}
+	return nil, MailNotFound
+}
+
+func (transport *MemoryTransport) Clear() {
+	transport.lock.Lock()
+	defer transport.lock.Unlock()
+	transport.mails = nil
+}
+
+// messageEnvelope extracts the SMTP envelope the same way gomail does when sending.
+func messageEnvelope(message *gomail.Message) (string, []string, error) {
+	from := message.GetHeader("Sender")
+	if len(from) == 0 {
+		from = message.GetHeader("From")
+	}
+	if len(from) == 0 {
+		return "", nil, errors.New(`invalid message, "From" field is absent`)
+	}
+	sender, err := netMail.ParseAddress(from[0])
+	if err != nil {
+		return "", nil, err
+	}
+
+	var recipients []string
+	for _, field := range []string{"To", "Cc", "Bcc"} {
+		for _, value := range message.GetHeader(field) {
+			address, err := netMail.ParseAddress(value)
+			if err != nil {
+				return "", nil, err
+			}
+			if !slices.Contains(recipients, address.Address) {
+				recipients = append(recipients, address.Address)
+			}
+		}
+	}
+	return sender.Address, recipients, nil
+}
+
+// writeMessage serializes the message without the idempotency header, it only matters to the
+// mail queue and must not reach the recipients.
+func writeMessage(message *gomail.Message) ([]byte, error) {
+	var buffer bytes.Buffer
+	if _, err := message.WriteTo(&buffer); err != nil {
+		return nil, err
+	}
+	return stripHeader(buffer.Bytes(), MailIdempotencyHeader), nil
+}
+
+// stripHeader drops the header, folded lines included, from the top level headers of a raw message.
+func stripHeader(rawMessage []byte, name string) []byte {
+	end := bytes.Index(rawMessage, []byte("\r\n\r\n"))
+	if end < 0 {
+		return rawMessage
+	}
+	prefix := []byte(name + ":")
+	var buffer bytes.Buffer
+	skipping := false
+	for _, line := range bytes.SplitAfter(rawMessage[:end+2], []byte("\r\n")) {
+		if skipping && len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			continue
+		}
+		skipping = len(line) >= len(prefix) && bytes.EqualFold(line[:len(prefix)], prefix)
+		if !skipping {
+			buffer.Write(line)
+		}
+	}
+	buffer.Write(rawMessage[end+2:])
+	return buffer.Bytes()
+}
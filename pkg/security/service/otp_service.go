@@ -1,8 +1,10 @@
 package service
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
 	"fmt"
-	"math/rand"
+	"math/big"
 	"sync"
 	"time"
 )
@@ -12,14 +14,30 @@ type Purpose string
 const (
 	PurposeGuestEmailVerification Purpose = "guest_email_verification"
 	PurposeResetPassword          Purpose = "reset_password"
+	PurposeMfaPending             Purpose = "mfa_pending"
+	PurposeLoginEmailOtp          Purpose = "login_email_otp"
+	PurposeTrustedDevice          Purpose = "trusted_device"
+	PurposeInvitation             Purpose = "invitation"
+	PurposeEmailChange            Purpose = "email_change"
 )
 
+const (
+	OtpLifetime = 5 * time.Minute
+	// MaxOtpAttempts wrong codes drop the OTP, a new one has to be requested
+	MaxOtpAttempts = 5
+	// MaxOtpResends is how many times an OTP can be sent again before a new one has to be requested
+	MaxOtpResends = 3
+)
+
+var otpCodeRange = big.NewInt(1_000_000)
+
+// DefaultGenerateOtpCodeFunc draws a 6 digit code from crypto/rand.
 var DefaultGenerateOtpCodeFunc = func() string {
-	code := ""
-	for i := 0; i < 6; i++ {
-		code += fmt.Sprintf("%d", rand.Intn(10)) // Generate a digit (0-9)
+	number, err := rand.Int(rand.Reader, otpCodeRange)
+	if err != nil {
+		panic(err)
 	}
-	return code
+	return fmt.Sprintf("%06d", number.Int64())
 }
 
 type OTP struct {
@@ -27,11 +45,20 @@ type OTP struct {
 	Purpose        Purpose
 	Code           string
 	ExpirationTime int64
+	// Attempts counts the wrong codes submitted for this OTP
+	Attempts int
+	// Resends counts how many times the OTP was sent again
+	Resends int
+}
+
+func (otp *OTP) isExpired(now time.Time) bool {
+	return now.Unix() >= otp.ExpirationTime
 }
 
 type IOtpService interface {
 	GenerateOtp(userId uint, purpose Purpose) *OTP
 	GetOtp(userId uint, purpose Purpose) (*OTP, error)
+	ResendOtp(userId uint, purpose Purpose) (*OTP, error)
 	VerifyOtp(userId uint, purpose Purpose, code string) error
 }
 
@@ -51,21 +78,13 @@ func NewOtpService(generatorFunc func() string) *OtpService {
 	}
 }
 
-func (service *OtpService) generateOtp() string {
-	code := ""
-	for i := 0; i < 6; i++ {
-		code += fmt.Sprintf("%d", rand.Intn(10)) // Generate a digit (0-9)
-	}
-	return code
-}
-
 func (service *OtpService) GenerateOtp(userId uint, purpose Purpose) *OTP {
 	code := service.OtpGeneratorFunc()
 	otp := &OTP{
 		UserId:         userId,
 		Purpose:        purpose,
 		Code:           code,
-		ExpirationTime: time.Now().Add(time.Minute * 5).Unix(),
+		ExpirationTime: time.Now().Add(OtpLifetime).Unix(),
 	}
 
 	service.OtpLock.Lock()
@@ -78,10 +97,39 @@ func (service *OtpService) GenerateOtp(userId uint, purpose Purpose) *OTP {
 	return otp
 }
 
+// ResendOtp replaces the code of a pending OTP but keeps its attempts, so sending it again does not
+// grant more guesses. An OTP dropped after too many attempts cannot be sent again.
+func (service *OtpService) ResendOtp(userId uint, purpose Purpose) (*OTP, error) {
+	service.OtpLock.Lock()
+	defer service.OtpLock.Unlock()
+
+	cachedOtp, err := service.findOtp(userId, purpose)
+	if err != nil {
+		return nil, err
+	}
+	if cachedOtp.Resends >= MaxOtpResends {
+		return nil, OtpResendLimitExceeded
+	}
+	otp := &OTP{
+		UserId:         userId,
+		Purpose:        purpose,
+		Code:           service.OtpGeneratorFunc(),
+		ExpirationTime: time.Now().Add(OtpLifetime).Unix(),
+		Attempts:       cachedOtp.Attempts,
+		Resends:        cachedOtp.Resends + 1,
+	}
+	service.OtpCache[userId][purpose] = otp
+	return otp, nil
+}
+
 func (service *OtpService) mustGetOtp(userId uint, purpose Purpose) (*OTP, error) {
 	service.OtpLock.Lock()
 	defer service.OtpLock.Unlock()
+	return service.findOtp(userId, purpose)
+}
 
+// findOtp expects OtpLock to be held.
+func (service *OtpService) findOtp(userId uint, purpose Purpose) (*OTP, error) {
 	otpMap, ok := service.OtpCache[userId]
 	if !ok {
 		return nil, OtpNotFound
@@ -99,14 +147,36 @@ func (service *OtpService) GetOtp(userId uint, purpose Purpose) (*OTP, error) {
 	return service.mustGetOtp(userId, purpose)
 }
 
+// removeOtp expects OtpLock to be held.
+func (service *OtpService) removeOtp(userId uint, purpose Purpose) {
+	delete(service.OtpCache[userId], purpose)
+	if len(service.OtpCache[userId]) == 0 {
+		delete(service.OtpCache, userId)
+	}
+}
+
+// VerifyOtp checks the code once: a matching code consumes the OTP, an expired OTP or the
+// MaxOtpAttempts-th wrong code drops it.
 func (service *OtpService) VerifyOtp(userId uint, purpose Purpose, code string) error {
-	cachedOtp, err := service.mustGetOtp(userId, purpose)
+	service.OtpLock.Lock()
+	defer service.OtpLock.Unlock()
+
+	cachedOtp, err := service.findOtp(userId, purpose)
 	if err != nil {
 		return err
 	}
-
-	if cachedOtp.Code != code {
+	if cachedOtp.isExpired(time.Now()) {
+		service.removeOtp(userId, purpose)
+		return OtpExpired
+	}
+	if subtle.ConstantTimeCompare([]byte(cachedOtp.Code), []byte(code)) != 1 {
+		cachedOtp.Attempts++
+		if cachedOtp.Attempts >= MaxOtpAttempts {
+			service.removeOtp(userId, purpose)
+			return OtpAttemptsExceeded
+		}
 		return OtpIncorrect
 	}
+	service.removeOtp(userId, purpose)
 	return nil
 }
@@ -0,0 +1,128 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func fixedOtpCode() string {
+	return "123456"
+}
+
+func TestDefaultGenerateOtpCodeFunc(t *testing.T) {
+	for range 100 {
+		code := DefaultGenerateOtpCodeFunc()
+		if len(code) != 6 {
+			t.Fatalf("expected 6 digits, got %q", code)
+		}
+		for _, digit := range code {
+			if digit < '0' || digit > '9' {
+				t.Fatalf("expected digits only, got %q", code)
+			}
+		}
+	}
+}
+
+func TestVerifyOtpConsumesCode(t *testing.T) {
+	service := NewOtpService(fixedOtpCode)
+	service.GenerateOtp(1, PurposeResetPassword)
+
+	if err := service.VerifyOtp(1, PurposeResetPassword, "123456"); err != nil {
+		t.Fatalf("expected the code to match, got %v", err)
+	}
+	if err := service.VerifyOtp(1, PurposeResetPassword, "123456"); !errors.Is(err, OtpNotFound) {
+		t.Fatalf("expected a used code to be gone, got %v", err)
+	}
+}
+
+func TestVerifyOtpKeepsOtherPurposes(t *testing.T) {
+	service := NewOtpService(fixedOtpCode)
+	service.GenerateOtp(1, PurposeResetPassword)
+	service.GenerateOtp(1, PurposeLoginEmailOtp)
+
+	if err := service.VerifyOtp(1, PurposeResetPassword, "123456"); err != nil {
+		t.Fatalf("expected the code to match, got %v", err)
+	}
+	if err := service.VerifyOtp(1, PurposeLoginEmailOtp, "123456"); err != nil {
+		t.Fatalf("expected the other purpose to be kept, got %v", err)
+	}
+}
+
+func TestVerifyOtpExpired(t *testing.T) {
+	service := NewOtpService(fixedOtpCode)
+	otp := service.GenerateOtp(1, PurposeResetPassword)
+	otp.ExpirationTime = time.Now().Add(-time.Second).Unix()
+
+	if err := service.VerifyOtp(1, PurposeResetPassword, "123456"); !errors.Is(err, OtpExpired) {
+		t.Fatalf("expected OtpExpired, got %v", err)
+	}
+	if _, err := service.GetOtp(1, PurposeResetPassword); !errors.Is(err, OtpNotFound) {
+		t.Fatalf("expected the expired code to be dropped, got %v", err)
+	}
+}
+
+func TestVerifyOtpAttemptLimit(t *testing.T) {
+	service := NewOtpService(fixedOtpCode)
+	service.GenerateOtp(1, PurposeResetPassword)
+
+	for attempt := 1; attempt < MaxOtpAttempts; attempt++ {
+		if err := service.VerifyOtp(1, PurposeResetPassword, "000000"); !errors.Is(err, OtpIncorrect) {
+			t.Fatalf("attempt %d: expected OtpIncorrect, got %v", attempt, err)
+		}
+	}
+	if err := service.VerifyOtp(1, PurposeResetPassword, "000000"); !errors.Is(err, OtpAttemptsExceeded) {
+		t.Fatalf("expected OtpAttemptsExceeded, got %v", err)
+	}
+	if err := service.VerifyOtp(1, PurposeResetPassword, "123456"); !errors.Is(err, OtpNotFound) {
+		t.Fatalf("expected the right code to be refused once the OTP is dropped, got %v", err)
+	}
+}
+
+func TestGenerateOtpResetsAttempts(t *testing.T) {
+	service := NewOtpService(fixedOtpCode)
+	service.GenerateOtp(1, PurposeResetPassword)
+	for attempt := 1; attempt < MaxOtpAttempts; attempt++ {
+		_ = service.VerifyOtp(1, PurposeResetPassword, "000000")
+	}
+
+	service.GenerateOtp(1, PurposeResetPassword)
+	if err := service.VerifyOtp(1, PurposeResetPassword, "000000"); !errors.Is(err, OtpIncorrect) {
+		t.Fatalf("expected a new OTP to start over, got %v", err)
+	}
+	if err := service.VerifyOtp(1, PurposeResetPassword, "123456"); err != nil {
+		t.Fatalf("expected the code to match, got %v", err)
+	}
+}
+
+func TestResendOtpKeepsAttempts(t *testing.T) {
+	service := NewOtpService(fixedOtpCode)
+	service.GenerateOtp(1, PurposeLoginEmailOtp)
+	for attempt := 1; attempt < MaxOtpAttempts; attempt++ {
+		_ = service.VerifyOtp(1, PurposeLoginEmailOtp, "000000")
+	}
+
+	if _, err := service.ResendOtp(1, PurposeLoginEmailOtp); err != nil {
+		t.Fatalf("expected the OTP to be sent again, got %v", err)
+	}
+	if err := service.VerifyOtp(1, PurposeLoginEmailOtp, "000000"); !errors.Is(err, OtpAttemptsExceeded) {
+		t.Fatalf("expected the attempts to carry over, got %v", err)
+	}
+	if _, err := service.ResendOtp(1, PurposeLoginEmailOtp); !errors.Is(err, OtpNotFound) {
+		t.Fatalf("expected a dropped OTP not to be sent again, got %v", err)
+	}
+}
+
+func TestResendOtpLimit(t *testing.T) {
+	service := NewOtpService(fixedOtpCode)
+	service.GenerateOtp(1, PurposeLoginEmailOtp)
+
+	for resend := 1; resend <= MaxOtpResends; resend++ {
+		if _, err := service.ResendOtp(1, PurposeLoginEmailOtp); err != nil {
+			t.Fatalf("resend %d: expected the OTP to be sent again, got %v", resend, err)
+		}
+	}
+	if _, err := service.ResendOtp(1, PurposeLoginEmailOtp); !errors.Is(err, OtpResendLimitExceeded) {
+		t.Fatalf("expected OtpResendLimitExceeded, got %v", err)
+	}
+}
@@ -0,0 +1,222 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+)
+
+type HashAlgorithm string
+
+const (
+	HashAlgorithmBcrypt   HashAlgorithm = "bcrypt"
+	HashAlgorithmArgon2id HashAlgorithm = "argon2id"
+)
+
+const (
+	DefaultArgon2Memory      = 64 * 1024
+	DefaultArgon2Iterations  = 3
+	DefaultArgon2Parallelism = 2
+	DefaultArgon2SaltLength  = 16
+	DefaultArgon2KeyLength   = 32
+	// bcryptMaxPasswordBytes is the input limit of bcrypt, longer passwords fail to hash
+	bcryptMaxPasswordBytes = 72
+)
+
+// PasswordHashConfig selects the algorithm for new hashes. Stored hashes describe their own
+// algorithm and parameters, so changing the config only affects users at their next login.
+type PasswordHashConfig struct {
+	Algorithm  HashAlgorithm `yaml:"algorithm" validate:"omitempty,oneof=bcrypt argon2id"`
+	BcryptCost int           `yaml:"bcrypt_cost" validate:"omitempty,min=4,max=31"`
+	// Argon2Memory is in KiB
+	Argon2Memory      uint32 `yaml:"argon2_memory"`
+	Argon2Iterations  uint32 `yaml:"argon2_iterations"`
+	Argon2Parallelism uint8  `yaml:"argon2_parallelism"`
+	Argon2SaltLength  uint32 `yaml:"argon2_salt_length"`
+	Argon2KeyLength   uint32 `yaml:"argon2_key_length"`
+}
+
+func (config *PasswordHashConfig) GetAlgorithm() HashAlgorithm {
+	if config.Algorithm == "" {
+		return HashAlgorithmBcrypt
+	}
+	return config.Algorithm
+}
+
+func (config *PasswordHashConfig) GetBcryptCost() int {
+	return valueOrDefault(config.BcryptCost, bcrypt.DefaultCost)
+}
+
+func (config *PasswordHashConfig) argon2Params() *argon2Params {
+	params := &argon2Params{
+		Memory:      DefaultArgon2Memory,
+		Iterations:  DefaultArgon2Iterations,
+		Parallelism: DefaultArgon2Parallelism,
+		SaltLength:  DefaultArgon2SaltLength,
+		KeyLength:   DefaultArgon2KeyLength,
+	}
+	if config.Argon2Memory > 0 {
+		params.Memory = config.Argon2Memory
+	}
+	if config.Argon2Iterations > 0 {
+		params.Iterations = config.Argon2Iterations
+	}
+	if config.Argon2Parallelism > 0 {
+		params.Parallelism = config.Argon2Parallelism
+	}
+	if config.Argon2SaltLength > 0 {
+		params.SaltLength = config.Argon2SaltLength
+	}
+	if config.Argon2KeyLength > 0 {
+		params.KeyLength = config.Argon2KeyLength
+	}
+	return params
+}
+
+type argon2Params struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+type IPasswordHasher interface {
+	Hash(password string) (string, error)
+	Verify(password string, encodedHash string) (bool, error)
+	NeedsRehash(encodedHash string) bool
+	// MaxPasswordBytes is the longest password in bytes the algorithm hashes, 0 if unlimited
+	MaxPasswordBytes() int
+}
+
+var _ IPasswordHasher = (*PasswordHasher)(nil)
+
+// PasswordHasher writes bcrypt hashes in their usual $2a$ form and argon2id hashes in the
+// PHC string format: $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>.
+type PasswordHasher struct {
+	PasswordHashConfig *PasswordHashConfig
+}
+
+func NewPasswordHasher(passwordHashConfig *PasswordHashConfig) *PasswordHasher {
+	return &PasswordHasher{
+		PasswordHashConfig: passwordHashConfig,
+	}
+}
+
+func (hasher *PasswordHasher) Hash(password string) (string, error) {
+	if hasher.PasswordHashConfig.GetAlgorithm() == HashAlgorithmArgon2id {
+		return hashArgon2id(password, hasher.PasswordHashConfig.argon2Params())
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), hasher.PasswordHashConfig.GetBcryptCost())
+	if err != nil {
+		return "", err
+	}
+	return string(hashedPassword), nil
+}
+
+func (hasher *PasswordHasher) MaxPasswordBytes() int {
+	if hasher.PasswordHashConfig.GetAlgorithm() == HashAlgorithmBcrypt {
+		return bcryptMaxPasswordBytes
+	}
+	return 0
+}
+
+func (hasher *PasswordHasher) Verify(password string, encodedHash string) (bool, error) {
+	if strings.HasPrefix(encodedHash, "$argon2id$") {
+		params, salt, key, err := decodeArgon2id(encodedHash)
+		if err != nil {
+			return false, err
+		}
+		candidate := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+		return subtle.ConstantTimeCompare(candidate, key) == 1, nil
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(encodedHash), []byte(password))
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// NeedsRehash reports hashes made with another algorithm or weaker parameters than configured.
+func (hasher *PasswordHasher) NeedsRehash(encodedHash string) bool {
+	config := hasher.PasswordHashConfig
+	if strings.HasPrefix(encodedHash, "$argon2id$") {
+		if config.GetAlgorithm() != HashAlgorithmArgon2id {
+			return true
+		}
+		params, salt, key, err := decodeArgon2id(encodedHash)
+		if err != nil {
+			return true
+		}
+		wanted := config.argon2Params()
+		return params.Memory != wanted.Memory ||
+			params.Iterations != wanted.Iterations ||
+			params.Parallelism != wanted.Parallelism ||
+			uint32(len(salt)) != wanted.SaltLength ||
+			uint32(len(key)) != wanted.KeyLength
+	}
+
+	if config.GetAlgorithm() != HashAlgorithmBcrypt {
+		return true
+	}
+	cost, err := bcrypt.Cost([]byte(encodedHash))
+	return err != nil || cost != config.GetBcryptCost()
+}
+
+func hashArgon2id(password string, params *argon2Params) (string, error) {
+	salt := make([]byte, params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		params.Memory,
+		params.Iterations,
+		params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func decodeArgon2id(encodedHash string) (*argon2Params, []byte, []byte, error) {
+	parts := strings.Split(encodedHash, "$")
+	if len(parts) != 6 {
+		return nil, nil, nil, PasswordHashUnknownFormat
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return nil, nil, nil, PasswordHashUnknownFormat
+	}
+	if version != argon2.Version {
+		return nil, nil, nil, fmt.Errorf("unsupported argon2 version %d", version)
+	}
+
+	params := &argon2Params{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return nil, nil, nil, PasswordHashUnknownFormat
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, PasswordHashUnknownFormat
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return nil, nil, nil, PasswordHashUnknownFormat
+	}
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+	return params, salt, key, nil
+}
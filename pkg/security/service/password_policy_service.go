@@ -0,0 +1,336 @@
+package service
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"github.com/GolangSpring/gospring/application"
+	. "github.com/GolangSpring/gospring/pkg/security/repository"
+	"github.com/rs/zerolog/log"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	DefaultPasswordMinLength = 8
+	DefaultPasswordMaxLength = 128
+	// userInfoMinLength ignores user name or email parts too short to be meaningful
+	userInfoMinLength = 3
+	hashSearchBlock   = 4096
+)
+
+type PasswordViolationCode string
+
+const (
+	PasswordTooShort         PasswordViolationCode = "too_short"
+	PasswordTooLong          PasswordViolationCode = "too_long"
+	PasswordMissingUpper     PasswordViolationCode = "missing_uppercase"
+	PasswordMissingLower     PasswordViolationCode = "missing_lowercase"
+	PasswordMissingDigit     PasswordViolationCode = "missing_digit"
+	PasswordMissingSymbol    PasswordViolationCode = "missing_symbol"
+	PasswordContainsUserInfo PasswordViolationCode = "contains_user_info"
+	PasswordReused           PasswordViolationCode = "reused"
+	PasswordBreached         PasswordViolationCode = "breached"
+)
+
+type PasswordPolicyConfig struct {
+	MinLength      int  `yaml:"min_length"`
+	MaxLength      int  `yaml:"max_length"`
+	RequireUpper   bool `yaml:"require_upper"`
+	RequireLower   bool `yaml:"require_lower"`
+	RequireDigit   bool `yaml:"require_digit"`
+	RequireSymbol  bool `yaml:"require_symbol"`
+	ForbidUserInfo bool `yaml:"forbid_user_info"`
+	// HistorySize is the number of previous passwords that cannot be reused, the current one included
+	HistorySize int `yaml:"history_size"`
+	// BreachedHashPath is either a file of "SHA1:COUNT" lines sorted by hash, or a directory
+	// of range files "{first 5 hex of SHA1}.txt" holding "SUFFIX:COUNT" lines.
+	BreachedHashPath string `yaml:"breached_hash_path"`
+}
+
+func (config *PasswordPolicyConfig) GetMinLength() int {
+	return valueOrDefault(config.MinLength, DefaultPasswordMinLength)
+}
+
+func (config *PasswordPolicyConfig) GetMaxLength() int {
+	return valueOrDefault(config.MaxLength, DefaultPasswordMaxLength)
+}
+
+type FieldViolation struct {
+	Field   string                `json:"field"`
+	Code    PasswordViolationCode `json:"code"`
+	Message string                `json:"message"`
+}
+
+// PasswordPolicyError lists every rule the password breaks, so clients can show them all at once.
+type PasswordPolicyError struct {
+	Violations []FieldViolation
+}
+
+func (err *PasswordPolicyError) Error() string {
+	messages := make([]string, len(err.Violations))
+	for idx, violation := range err.Violations {
+		messages[idx] = violation.Message
+	}
+	return "PasswordPolicyViolation: " + strings.Join(messages, "; ")
+}
+
+func (err *PasswordPolicyError) add(code PasswordViolationCode, message string) {
+	err.Violations = append(err.Violations, FieldViolation{Field: "password", Code: code, Message: message})
+}
+
+type IPasswordPolicyService interface {
+	Validate(name string, email string, password string) error
+	ValidateChange(user *User, password string) error
+	NextPasswordHistory(user *User) []string
+	IsBreached(password string) (bool, error)
+}
+
+var _ application.IService = (*PasswordPolicyService)(nil)
+var _ IPasswordPolicyService = (*PasswordPolicyService)(nil)
+
+type PasswordPolicyService struct {
+	PasswordHasher       IPasswordHasher
+	PasswordPolicyConfig *PasswordPolicyConfig
+}
+
+func NewPasswordPolicyService(passwordHasher IPasswordHasher, passwordPolicyConfig *PasswordPolicyConfig) *PasswordPolicyService {
+	return &PasswordPolicyService{
+		PasswordHasher:       passwordHasher,
+		PasswordPolicyConfig: passwordPolicyConfig,
+	}
+}
+
+func (service *PasswordPolicyService) PostConstruct() {
+	path := service.PasswordPolicyConfig.BreachedHashPath
+	if path == "" {
+		return
+	}
+	if _, err := os.Stat(path); err != nil {
+		log.Warn().Msgf("Breached password hashes %s are not readable, the check is skipped: %v", path, err)
+	}
+}
+
+func (service *PasswordPolicyService) checkRules(name string, email string, password string, policyErr *PasswordPolicyError) {
+	config := service.PasswordPolicyConfig
+	length := utf8.RuneCountInString(password)
+	if length < config.GetMinLength() {
+		policyErr.add(PasswordTooShort, fmt.Sprintf("password must be at least %d characters", config.GetMinLength()))
+	}
+	maxBytes := service.PasswordHasher.MaxPasswordBytes()
+	if length > config.GetMaxLength() {
+		policyErr.add(PasswordTooLong, fmt.Sprintf("password must be at most %d characters", config.GetMaxLength()))
+	} else if maxBytes > 0 && len(password) > maxBytes {
+		// Characters outside ASCII take several bytes, so a password within the length can still be too long to hash
+		policyErr.add(PasswordTooLong, fmt.Sprintf("password must be at most %d bytes", maxBytes))
+	}
+
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, char := range password {
+		switch {
+		case unicode.IsUpper(char):
+			hasUpper = true
+		case unicode.IsLower(char):
+			hasLower = true
+		case unicode.IsDigit(char):
+			hasDigit = true
+		case unicode.IsPunct(char) || unicode.IsSymbol(char) || unicode.IsSpace(char):
+			hasSymbol = true
+		}
+	}
+	if config.RequireUpper && !hasUpper {
+		policyErr.add(PasswordMissingUpper, "password must contain an uppercase letter")
+	}
+	if config.RequireLower && !hasLower {
+		policyErr.add(PasswordMissingLower, "password must contain a lowercase letter")
+	}
+	if config.RequireDigit && !hasDigit {
+		policyErr.add(PasswordMissingDigit, "password must contain a digit")
+	}
+	if config.RequireSymbol && !hasSymbol {
+		policyErr.add(PasswordMissingSymbol, "password must contain a symbol")
+	}
+
+	if config.ForbidUserInfo {
+		lowerPassword := strings.ToLower(password)
+		localPart, _, _ := strings.Cut(email, "@")
+		for _, info := range []string{name, localPart} {
+			info = strings.ToLower(info)
+			if len(info) >= userInfoMinLength && strings.Contains(lowerPassword, info) {
+				policyErr.add(PasswordContainsUserInfo, "password must not contain the user name or email")
+				break
+			}
+		}
+	}
+}
+
+func (service *PasswordPolicyService) checkBreached(password string, policyErr *PasswordPolicyError) {
+	isBreached, err := service.IsBreached(password)
+	if err != nil {
+		log.Warn().Msgf("Failed to check breached passwords: %v", err)
+		return
+	}
+	if isBreached {
+		policyErr.add(PasswordBreached, "password appears in a known data breach")
+	}
+}
+
+// Validate checks a password for a new account.
+func (service *PasswordPolicyService) Validate(name string, email string, password string) error {
+	policyErr := &PasswordPolicyError{}
+	service.checkRules(name, email, password, policyErr)
+	service.checkBreached(password, policyErr)
+	if len(policyErr.Violations) > 0 {
+		return policyErr
+	}
+	return nil
+}
+
+// ValidateChange checks a new password of an existing user, including reuse of recent passwords.
+func (service *PasswordPolicyService) ValidateChange(user *User, password string) error {
+	policyErr := &PasswordPolicyError{}
+	service.checkRules(user.Name, user.Email, password, policyErr)
+
+	if historySize := service.PasswordPolicyConfig.HistorySize; historySize > 0 {
+		hashes := append([]string{user.Password}, user.PasswordHistory...)
+		for _, hash := range hashes[:min(len(hashes), historySize)] {
+			if isMatched, _ := service.PasswordHasher.Verify(password, hash); isMatched {
+				policyErr.add(PasswordReused, fmt.Sprintf("password must differ from the last %d passwords", historySize))
+				break
+			}
+		}
+	}
+
+	service.checkBreached(password, policyErr)
+	if len(policyErr.Violations) > 0 {
+		return policyErr
+	}
+	return nil
+}
+
+// NextPasswordHistory is the history to store when the current password gets replaced.
+func (service *PasswordPolicyService) NextPasswordHistory(user *User) []string {
+	historySize := service.PasswordPolicyConfig.HistorySize
+	if historySize <= 0 {
+		return nil
+	}
+	history := append([]string{user.Password}, user.PasswordHistory...)
+	// The current password counts as one of the HistorySize, so keep HistorySize-1 previous ones
+	return history[:min(len(history), historySize-1)]
+}
+
+// IsBreached looks the SHA-1 of the password up in the local breached hash list,
+// in the same prefix/suffix layout as the k-anonymity range API.
+func (service *PasswordPolicyService) IsBreached(password string) (bool, error) {
+	path := service.PasswordPolicyConfig.BreachedHashPath
+	if path == "" {
+		return false, nil
+	}
+	digest := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(digest[:]))
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	if info.IsDir() {
+		return searchRangeFile(filepath.Join(path, hash[:5]+".txt"), hash[5:])
+	}
+	return searchSortedHashFile(path, info.Size(), hash)
+}
+
+func hashOfLine(line string) string {
+	hash, _, _ := strings.Cut(strings.TrimSpace(line), ":")
+	return strings.ToUpper(hash)
+}
+
+func searchRangeFile(path string, suffix string) (bool, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if hashOfLine(scanner.Text()) == suffix {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// lineAfter returns the first complete line starting after offset, empty at the end of the file.
+func lineAfter(file *os.File, size int64, offset int64) (string, error) {
+	reader := bufio.NewReader(io.NewSectionReader(file, offset, size-offset))
+	if offset > 0 {
+		if _, err := reader.ReadString('\n'); err != nil {
+			return "", nil
+		}
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return line, nil
+}
+
+// searchSortedHashFile binary searches the sorted file down to a small block, then scans it.
+func searchSortedHashFile(path string, size int64, hash string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	low, high := int64(0), size
+	for high-low > hashSearchBlock {
+		middle := (low + high) / 2
+		line, err := lineAfter(file, size, middle)
+		if err != nil {
+			return false, err
+		}
+		if line != "" && hashOfLine(line) < hash {
+			low = middle
+		} else {
+			high = middle
+		}
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(file, low, size-low))
+	if low > 0 {
+		if _, err := reader.ReadString('\n'); err != nil {
+			return false, nil
+		}
+	}
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			lineHash := hashOfLine(line)
+			if lineHash == hash {
+				return true, nil
+			}
+			if lineHash > hash {
+				return false, nil
+			}
+		}
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
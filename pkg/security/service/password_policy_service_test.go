@@ -0,0 +1,44 @@
+package service
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidatePasswordHashLimit(t *testing.T) {
+	tests := []struct {
+		name      string
+		algorithm HashAlgorithm
+		password  string
+		tooLong   bool
+	}{
+		{"ascii within the bcrypt limit", HashAlgorithmBcrypt, strings.Repeat("a", 72), false},
+		{"ascii over the bcrypt limit", HashAlgorithmBcrypt, strings.Repeat("a", 73), true},
+		// 25 characters of 3 bytes each
+		{"multibyte over the bcrypt limit", HashAlgorithmBcrypt, strings.Repeat("密", 25), true},
+		{"multibyte with argon2id", HashAlgorithmArgon2id, strings.Repeat("密", 25), false},
+		{"over the max length", HashAlgorithmArgon2id, strings.Repeat("a", 129), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hasher := NewPasswordHasher(&PasswordHashConfig{Algorithm: test.algorithm, BcryptCost: 4})
+			service := NewPasswordPolicyService(hasher, &PasswordPolicyConfig{})
+
+			err := service.Validate("alice", "alice@example.com", test.password)
+			var policyErr *PasswordPolicyError
+			if !test.tooLong {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if _, err := hasher.Hash(test.password); err != nil {
+					t.Fatalf("expected an accepted password to hash, got %v", err)
+				}
+				return
+			}
+			if !errors.As(err, &policyErr) || len(policyErr.Violations) != 1 || policyErr.Violations[0].Code != PasswordTooLong {
+				t.Fatalf("expected a single too long violation, got %v", err)
+			}
+		})
+	}
+}
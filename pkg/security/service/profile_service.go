@@ -0,0 +1,388 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/GolangSpring/gospring/application"
+	. "github.com/GolangSpring/gospring/pkg/security/repository"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog/log"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultAvatarMaxKb      = 1024
+	DefaultDeletionGraceDay = 14
+	deletionCheckInterval   = time.Hour
+)
+
+// avatarExtensions maps the accepted image types, sniffed from the content, to their file extension.
+var avatarExtensions = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+type ProfileConfig struct {
+	// AvatarDirectory stores uploaded avatars, uploads are refused when it is empty
+	AvatarDirectory string `yaml:"avatar_directory"`
+	AvatarMaxKb     int    `yaml:"avatar_max_kb"`
+	// DeletionGraceDay is how long a user can still cancel the deletion of their own account
+	DeletionGraceDay int `yaml:"deletion_grace_day"`
+}
+
+func (config *ProfileConfig) AvatarMaxBytes() int64 {
+	return int64(valueOrDefault(config.AvatarMaxKb, DefaultAvatarMaxKb)) * 1024
+}
+
+func (config *ProfileConfig) DeletionGracePeriod() time.Duration {
+	return time.Duration(valueOrDefault(config.DeletionGraceDay, DefaultDeletionGraceDay)) * 24 * time.Hour
+}
+
+type IProfileService interface {
+	GetProfileConfig() *ProfileConfig
+	UpdateName(ctx context.Context, userID uint, name string) (*User, error)
+	UpdateAttributes(ctx context.Context, userID uint, update UserAttributes) (*User, error)
+	ChangePassword(ctx context.Context, userID uint, currentPassword string, newPassword string) error
+	RequestEmailChange(ctx context.Context, userID uint, email string) (string, error)
+	ConfirmEmailChange(ctx context.Context, userID uint, token string, otpCode string) (*User, error)
+	SaveAvatar(ctx context.Context, userID uint, reader io.Reader) (*User, error)
+	AvatarPath(avatarFile string) (string, error)
+	ScheduleDeletion(ctx context.Context, userID uint, password string) (*User, error)
+	CancelDeletion(ctx context.Context, userID uint) (*User, error)
+}
+
+var _ application.IService = (*ProfileService)(nil)
+var _ IProfileService = (*ProfileService)(nil)
+
+// ProfileService holds what a logged-in user changes on their own account. Deletions requested
+// by users are applied as soft deletes once their grace period is over.
+type ProfileService struct {
+	UserService     IUserService
+	AuthService     IAuthService
+	OtpService      IOtpService
+	SmtpService     ISmtpService
+	TemplateService ITemplateService
+	LoginThrottle   ILoginThrottleService
+	ProfileConfig   *ProfileConfig
+
+	cancel context.CancelFunc
+}
+
+func NewProfileService(
+	userService IUserService,
+	authService IAuthService,
+	otpService IOtpService,
+	smtpService ISmtpService,
+	templateService ITemplateService,
+	loginThrottle ILoginThrottleService,
+	profileConfig *ProfileConfig,
+) *ProfileService {
+	return &ProfileService{
+		UserService:     userService,
+		AuthService:     authService,
+		OtpService:      otpService,
+		SmtpService:     smtpService,
+		TemplateService: templateService,
+		LoginThrottle:   loginThrottle,
+		ProfileConfig:   profileConfig,
+	}
+}
+
+func (service *ProfileService) PostConstruct() {
+	if directory := service.ProfileConfig.AvatarDirectory; directory != "" {
+		if err := os.MkdirAll(directory, 0o755); err != nil {
+			log.Fatal().Msgf("Failed to create avatar directory %s: %v", directory, err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	service.cancel = cancel
+	go func() {
+		ticker := time.NewTicker(deletionCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				service.applyScheduledDeletions(ctx)
+			}
+		}
+	}()
+}
+
+func (service *ProfileService) Stop() {
+	if service.cancel != nil {
+		service.cancel()
+	}
+}
+
+func (service *ProfileService) GetProfileConfig() *ProfileConfig {
+	return service.ProfileConfig
+}
+
+func (service *ProfileService) applyScheduledDeletions(ctx context.Context) {
+	users, err := service.UserService.FindDueForDeletion(ctx, time.Now())
+	if err != nil {
+		log.Warn().Msgf("Failed to find users due for deletion: %v", err)
+		return
+	}
+	for _, user := range users {
+		if err := service.UserService.SoftDeleteUser(ctx, user.ID); err != nil {
+			log.Warn().Msgf("Failed to delete user %d: %v", user.ID, err)
+			continue
+		}
+		log.Info().Msgf("Deleted user %d as they requested", user.ID)
+	}
+}
+
+func (service *ProfileService) UpdateName(ctx context.Context, userID uint, name string) (*User, error) {
+	return service.UserService.UpdateProfile(ctx, userID, &UserProfileUpdate{Name: &name})
+}
+
+func (service *ProfileService) UpdateAttributes(ctx context.Context, userID uint, update UserAttributes) (*User, error) {
+	if err := service.UserService.GetAttributeSchema().Validate(update, true); err != nil {
+		return nil, err
+	}
+	return service.UserService.UpdateAttributes(ctx, userID, update)
+}
+
+// verifyCurrentPassword counts wrong passwords like failed logins, so a stolen session cannot
+// be used to guess the password.
+func (service *ProfileService) verifyCurrentPassword(ctx context.Context, user *User, password string) error {
+	if err := service.LoginThrottle.Check(ctx, user, ""); err != nil {
+		return err
+	}
+	if err := service.AuthService.VerifyPassword(password, user.Password); err != nil {
+		service.LoginThrottle.RecordFailure(ctx, user, "")
+		return PasswordIncorrect
+	}
+	service.LoginThrottle.RecordSuccess(ctx, user, "")
+	return nil
+}
+
+func (service *ProfileService) ChangePassword(ctx context.Context, userID uint, currentPassword string, newPassword string) error {
+	user, err := service.UserService.FindUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if err := service.verifyCurrentPassword(ctx, user, currentPassword); err != nil {
+		return err
+	}
+	return service.AuthService.ChangePassword(ctx, user, newPassword)
+}
+
+// emailChangePurpose keys the OTP by the new address, so a code only confirms the address it was sent to.
+func emailChangePurpose(email string) Purpose {
+	return Purpose(string(PurposeEmailChange) + ":" + email)
+}
+
+// RequestEmailChange mails a code to the new address, the returned token carries the address
+// until the code comes back with ConfirmEmailChange.
+func (service *ProfileService) RequestEmailChange(ctx context.Context, userID uint, email string) (string, error) {
+	user, err := service.UserService.FindUser(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+	email = NormalizeEmail(email)
+	if found, err := service.UserService.FindByEmail(ctx, email); err == nil && found.ID != user.ID {
+		return "", &UserExistsError{Field: "email"}
+	}
+
+	otp := service.OtpService.GenerateOtp(user.ID, emailChangePurpose(email))
+	emailTemplate := NewEmailTemplate(user.Name, otp.Code, service.SmtpService.GetSmtpConfig().CompanyName)
+	rendered, err := service.TemplateService.Render(TemplateEmailChange, user.Locale, emailTemplate)
+	if err != nil {
+		return "", err
+	}
+	if err := service.SmtpService.SendEmail(service.SmtpService.CreateRenderedMessage(email, rendered)); err != nil {
+		return "", err
+	}
+
+	claims := jwt.MapClaims{
+		"purpose": string(PurposeEmailChange),
+		"id":      user.ID,
+		"email":   email,
+		"exp":     time.Now().Add(OtpLifetime).Unix(),
+	}
+	return service.AuthService.IssueJsonWebToken(&claims), nil
+}
+
+func (service *ProfileService) parseEmailChangeClaims(token string) (uint, string, error) {
+	_jwt, err := service.AuthService.DecodeJsonWebToken(token)
+	if err != nil {
+		return 0, "", err
+	}
+	claims, ok := _jwt.Claims.(jwt.MapClaims)
+	if !ok || !_jwt.Valid {
+		return 0, "", TokenInvalid
+	}
+	if purpose, _ := claims["purpose"].(string); purpose != string(PurposeEmailChange) {
+		return 0, "", fmt.Errorf("invalid or missing 'purpose' claim, getting %s, expects %v", purpose, PurposeEmailChange)
+	}
+	userID, ok := claims["id"].(float64)
+	if !ok {
+		return 0, "", TokenInvalid
+	}
+	email, ok := claims["email"].(string)
+	if !ok || email == "" {
+		return 0, "", TokenInvalid
+	}
+	return uint(userID), email, nil
+}
+
+// ConfirmEmailChange switches to the new address, which the code proves verified, and tells the
+// previous address about it.
+func (service *ProfileService) ConfirmEmailChange(ctx context.Context, userID uint, token string, otpCode string) (*User, error) {
+	tokenUserID, email, err := service.parseEmailChangeClaims(token)
+	if err != nil {
+		return nil, err
+	}
+	if tokenUserID != userID {
+		return nil, TokenInvalid
+	}
+	if err := service.OtpService.VerifyOtp(userID, emailChangePurpose(email), otpCode); err != nil {
+		return nil, err
+	}
+
+	previous, err := service.UserService.FindUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	user, err := service.UserService.UpdateProfile(ctx, userID, &UserProfileUpdate{Email: &email})
+	if err != nil {
+		return nil, err
+	}
+	if !user.IsVerified {
+		if err := service.UserService.ActivateUser(ctx, user); err != nil {
+			return nil, err
+		}
+		user.IsVerified = true
+	}
+	log.Info().Msgf("User %d changed their email", user.ID)
+	if previous.Email != user.Email {
+		if err := service.sendEmailChangedEmail(previous, user.Email); err != nil {
+			log.Warn().Msgf("Failed to notify the previous email of user %d: %v", user.ID, err)
+		}
+	}
+	return user, nil
+}
+
+func (service *ProfileService) sendEmailChangedEmail(previous *User, email string) error {
+	emailTemplate := &EmailChangedEmailTemplate{
+		UserName:    previous.Name,
+		CompanyName: service.SmtpService.GetSmtpConfig().CompanyName,
+		NewEmail:    email,
+	}
+	rendered, err := service.TemplateService.Render(TemplateEmailChanged, previous.Locale, emailTemplate)
+	if err != nil {
+		return err
+	}
+	return service.SmtpService.SendEmail(service.SmtpService.CreateRenderedMessage(previous.Email, rendered))
+}
+
+// SaveAvatar stores the image under a new random name, so cached copies of the previous one go stale.
+func (service *ProfileService) SaveAvatar(ctx context.Context, userID uint, reader io.Reader) (*User, error) {
+	directory := service.ProfileConfig.AvatarDirectory
+	if directory == "" {
+		return nil, AvatarStorageDisabled
+	}
+	user, err := service.UserService.FindUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	maxBytes := service.ProfileConfig.AvatarMaxBytes()
+	content, err := io.ReadAll(io.LimitReader(reader, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(content)) > maxBytes {
+		return nil, AvatarTooLarge
+	}
+	extension, ok := avatarExtensions[http.DetectContentType(content)]
+	if !ok {
+		return nil, AvatarInvalid
+	}
+
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, err
+	}
+	avatarFile := fmt.Sprintf("%d-%s%s", user.ID, hex.EncodeToString(suffix), extension)
+	if err := writeFileAtomic(filepath.Join(directory, avatarFile), content); err != nil {
+		return nil, err
+	}
+	if err := service.UserService.UpdateUserAvatar(ctx, user, avatarFile); err != nil {
+		return nil, err
+	}
+
+	if previous := user.AvatarFile; previous != "" {
+		if err := os.Remove(filepath.Join(directory, filepath.Base(previous))); err != nil && !os.IsNotExist(err) {
+			log.Warn().Msgf("Failed to remove previous avatar of user %d: %v", user.ID, err)
+		}
+	}
+	user.AvatarFile = avatarFile
+	return user, nil
+}
+
+func writeFileAtomic(path string, content []byte) error {
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, content, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// AvatarPath resolves a stored avatar name, refusing anything that is not a plain file name.
+func (service *ProfileService) AvatarPath(avatarFile string) (string, error) {
+	directory := service.ProfileConfig.AvatarDirectory
+	if directory == "" {
+		return "", AvatarStorageDisabled
+	}
+	if avatarFile == "" || strings.HasPrefix(avatarFile, ".") || strings.ContainsAny(avatarFile, `/\`) {
+		return "", AvatarInvalid
+	}
+	return filepath.Join(directory, avatarFile), nil
+}
+
+func (service *ProfileService) ScheduleDeletion(ctx context.Context, userID uint, password string) (*User, error) {
+	user, err := service.UserService.FindUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := service.verifyCurrentPassword(ctx, user, password); err != nil {
+		return nil, err
+	}
+	scheduledAt := time.Now().Add(service.ProfileConfig.DeletionGracePeriod())
+	if err := service.UserService.UpdateUserDeletionScheduledAt(ctx, user, &scheduledAt); err != nil {
+		return nil, err
+	}
+	user.DeletionScheduledAt = &scheduledAt
+	log.Info().Msgf("User %d scheduled the deletion of their account at %v", user.ID, scheduledAt)
+	return user, nil
+}
+
+func (service *ProfileService) CancelDeletion(ctx context.Context, userID uint) (*User, error) {
+	user, err := service.UserService.FindUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if user.DeletionScheduledAt == nil {
+		return user, nil
+	}
+	if err := service.UserService.UpdateUserDeletionScheduledAt(ctx, user, nil); err != nil {
+		return nil, err
+	}
+	user.DeletionScheduledAt = nil
+	return user, nil
+}
@@ -0,0 +1,105 @@
+package service
+
+import (
+	"context"
+	"errors"
+	. "github.com/GolangSpring/gospring/pkg/security/repository"
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+	"testing"
+	"time"
+)
+
+func TestEmailChangeCodeBoundToAddress(t *testing.T) {
+	authService := &AuthService{Secret: "secret"}
+	otpService := NewOtpService(fixedOtpCode)
+	service := &ProfileService{AuthService: authService, OtpService: otpService}
+
+	// The code was sent to the second address, the token names the first one
+	otp := otpService.GenerateOtp(1, emailChangePurpose("attacker@example.com"))
+	token := authService.IssueJsonWebToken(&jwt.MapClaims{
+		"purpose": string(PurposeEmailChange),
+		"id":      1,
+		"email":   "victim@example.com",
+		"exp":     time.Now().Add(OtpLifetime).Unix(),
+	})
+
+	if _, err := service.ConfirmEmailChange(context.Background(), 1, token, otp.Code); !errors.Is(err, OtpNotFound) {
+		t.Fatalf("expected the code not to confirm another address, got %v", err)
+	}
+	if _, err := otpService.GetOtp(1, emailChangePurpose("attacker@example.com")); err != nil {
+		t.Fatalf("expected the code of the other address to be kept, got %v", err)
+	}
+}
+
+// deletionUserRepository keeps users in memory with the soft delete and scheduled deletion columns.
+type deletionUserRepository struct {
+	IUserRepository
+	users map[uint]*User
+}
+
+func (repo *deletionUserRepository) FindByID(ctx context.Context, id uint) (*User, error) {
+	if user, ok := repo.users[id]; ok && !user.DeletedAt.Valid {
+		copied := *user
+		return &copied, nil
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (repo *deletionUserRepository) FindDeletedByID(ctx context.Context, id uint) (*User, error) {
+	if user, ok := repo.users[id]; ok && user.DeletedAt.Valid {
+		copied := *user
+		return &copied, nil
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (repo *deletionUserRepository) DeleteByID(ctx context.Context, id uint) error {
+	repo.users[id].DeletedAt = gorm.DeletedAt{Time: time.Now(), Valid: true}
+	return nil
+}
+
+func (repo *deletionUserRepository) RestoreByID(ctx context.Context, id uint) error {
+	repo.users[id].DeletedAt = gorm.DeletedAt{}
+	return nil
+}
+
+func (repo *deletionUserRepository) UpdateUserDeletionScheduledAt(ctx context.Context, user *User, scheduledAt *time.Time) error {
+	repo.users[user.ID].DeletionScheduledAt = scheduledAt
+	return nil
+}
+
+func (repo *deletionUserRepository) FindDueForDeletion(ctx context.Context, now time.Time) ([]*User, error) {
+	var users []*User
+	for _, user := range repo.users {
+		if !user.DeletedAt.Valid && user.DeletionScheduledAt != nil && !user.DeletionScheduledAt.After(now) {
+			users = append(users, user)
+		}
+	}
+	return users, nil
+}
+
+func TestRestoredUserIsNotDeletedAgain(t *testing.T) {
+	scheduledAt := time.Now().Add(-time.Minute)
+	repo := &deletionUserRepository{users: map[uint]*User{1: {ID: 1, DeletionScheduledAt: &scheduledAt}}}
+	userService := NewUserService(repo, nil)
+	service := &ProfileService{UserService: userService}
+	ctx := context.Background()
+
+	service.applyScheduledDeletions(ctx)
+	if !repo.users[1].DeletedAt.Valid {
+		t.Fatal("expected the scheduled deletion to delete the user")
+	}
+	user, err := userService.RestoreUser(ctx, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if user.DeletionScheduledAt != nil {
+		t.Fatal("expected the restored user to have no deletion scheduled")
+	}
+
+	service.applyScheduledDeletions(ctx)
+	if repo.users[1].DeletedAt.Valid {
+		t.Fatal("expected the restored user to stay restored")
+	}
+}
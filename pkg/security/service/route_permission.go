@@ -0,0 +1,136 @@
+package service
+
+import (
+	"github.com/GolangSpring/gospring/application"
+	"github.com/go-fuego/fuego"
+	"github.com/rs/zerolog/log"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// RolesExtension is the OpenAPI operation extension holding the roles a route requires.
+const RolesExtension = "x-required-roles"
+
+var routeParamRegex = regexp.MustCompile(`\{[^}]*\}`)
+
+var _ application.IRoutesAwareService = (*CasbinService)(nil)
+
+// RoutePermission is a documented route with the roles it declares, Covered tells whether any
+// permission policy grants the route.
+type RoutePermission struct {
+	Method  string   `json:"method"`
+	Path    string   `json:"path"`
+	Roles   []string `json:"roles"`
+	Covered bool     `json:"covered"`
+}
+
+// RouteObject turns a route path into the anchored policy object matching it, "{id}" matches
+// one segment and "{path...}" the rest of the path.
+func RouteObject(path string) string {
+	var builder strings.Builder
+	builder.WriteString("^")
+	last := 0
+	for _, loc := range routeParamRegex.FindAllStringIndex(path, -1) {
+		builder.WriteString(regexp.QuoteMeta(path[last:loc[0]]))
+		switch param := path[loc[0]:loc[1]]; {
+		case param == "{$}":
+		case strings.HasSuffix(param, "...}"):
+			builder.WriteString(".+")
+		default:
+			builder.WriteString("[^/]+")
+		}
+		last = loc[1]
+	}
+	builder.WriteString(regexp.QuoteMeta(path[last:]))
+	builder.WriteString("$")
+	return builder.String()
+}
+
+// samplePath fills the route parameters with a value most parameter patterns accept.
+func samplePath(path string) string {
+	return routeParamRegex.ReplaceAllStringFunc(path, func(param string) string {
+		if param == "{$}" {
+			return ""
+		}
+		return "1"
+	})
+}
+
+func routeRoles(extensions map[string]any) []string {
+	roles, _ := extensions[RolesExtension].([]string)
+	return roles
+}
+
+// RoutesRegistered merges a policy for every role the documented routes declare, public routes
+// declare CasbinPublicKey. It then warns about the routes no policy grants, they answer 403 to everyone.
+func (service *CasbinService) RoutesRegistered(server *fuego.Server) {
+	var routes []*RoutePermission
+	for path, item := range server.OpenAPI.Description().Paths.Map() {
+		for method, operation := range item.Operations() {
+			routes = append(routes, &RoutePermission{
+				Method: method,
+				Path:   path,
+				Roles:  routeRoles(operation.Extensions),
+			})
+		}
+	}
+	slices.SortFunc(routes, func(a, b *RoutePermission) int {
+		return strings.Compare(a.Path+" "+a.Method, b.Path+" "+b.Method)
+	})
+	service.routes = routes
+
+	for _, route := range routes {
+		for _, role := range route.Roles {
+			policy := &Policy{Subject: role, Object: RouteObject(route.Path), Action: route.Method}
+			added, err := service.mergePolicy(policy)
+			if err != nil {
+				log.Fatal().Msgf("Failed to add route policy %v: %v", policy.rule(service.domains()), err)
+			}
+			if added {
+				log.Info().Msgf("Route policy added: %v", policy.rule(service.domains()))
+			}
+		}
+	}
+
+	permissions, err := service.GetRoutePermissions()
+	if err != nil {
+		log.Warn().Msgf("Failed to check route policies: %v", err)
+		return
+	}
+	for _, permission := range permissions {
+		if !permission.Covered {
+			log.Warn().Msgf("Route %s %s has no casbin policy", permission.Method, permission.Path)
+		}
+	}
+}
+
+// GetRoutePermissions lists the documented routes and whether the current policies grant them.
+func (service *CasbinService) GetRoutePermissions() ([]*RoutePermission, error) {
+	policies, err := service.GetPolicies("")
+	if err != nil {
+		return nil, err
+	}
+	objects := make([]*regexp.Regexp, len(policies))
+	for idx, policy := range policies {
+		// Policies that do not compile never match in casbin either
+		objects[idx], _ = regexp.Compile(policy.Object)
+	}
+
+	permissions := make([]*RoutePermission, len(service.routes))
+	for idx, route := range service.routes {
+		permission := *route
+		path := samplePath(route.Path)
+		for policyIdx, policy := range policies {
+			if objects[policyIdx] == nil || (policy.Action != PolicyActionAny && policy.Action != route.Method) {
+				continue
+			}
+			if objects[policyIdx].MatchString(path) {
+				permission.Covered = true
+				break
+			}
+		}
+		permissions[idx] = &permission
+	}
+	return permissions, nil
+}
@@ -0,0 +1,85 @@
+package service
+
+import (
+	"bytes"
+	"gopkg.in/gomail.v2"
+	"io"
+	"sync"
+)
+
+// MailAttachment is a file part of a message, read from Reader when the message is first
+// serialized. Inline attachments are embedded and referenced from html as cid:{ContentID}.
+type MailAttachment struct {
+	FileName    string
+	ContentType string
+	Reader      io.Reader
+	Inline      bool
+	// ContentID defaults to FileName for inline attachments
+	ContentID string
+}
+
+func NewAttachment(fileName string, contentType string, reader io.Reader) *MailAttachment {
+	return &MailAttachment{
+		FileName:    fileName,
+		ContentType: contentType,
+		Reader:      reader,
+	}
+}
+
+func NewInlineImage(contentID string, fileName string, contentType string, reader io.Reader) *MailAttachment {
+	return &MailAttachment{
+		FileName:    fileName,
+		ContentType: contentType,
+		Reader:      reader,
+		Inline:      true,
+		ContentID:   contentID,
+	}
+}
+
+// copyFunc buffers the reader on first use, so the message can be serialized more than
+// once (e.g. a DKIM signature pass followed by the actual delivery).
+func (attachment *MailAttachment) copyFunc() func(writer io.Writer) error {
+	var once sync.Once
+	var content []byte
+	var readErr error
+	return func(writer io.Writer) error {
+		once.Do(func() {
+			content, readErr = io.ReadAll(attachment.Reader)
+		})
+		if readErr != nil {
+			return readErr
+		}
+		_, err := io.Copy(writer, bytes.NewReader(content))
+		return err
+	}
+}
+
+func (attachment *MailAttachment) settings() []gomail.FileSetting {
+	header := map[string][]string{}
+	if attachment.ContentType != "" {
+		header["Content-Type"] = []string{attachment.ContentType + `; name="` + attachment.FileName + `"`}
+	}
+	if attachment.Inline && attachment.ContentID != "" {
+		header["Content-ID"] = []string{"<" + attachment.ContentID + ">"}
+	}
+	return []gomail.FileSetting{
+		gomail.Rename(attachment.FileName),
+		gomail.SetCopyFunc(attachment.copyFunc()),
+		gomail.SetHeader(header),
+	}
+}
+
+// MailMessage describes an email independently of gomail, SmtpService.BuildMessage turns it
+// into a message ready to send. When both Text and Html are set the html part is an alternative.
+type MailMessage struct {
+	To          []string
+	Cc          []string
+	Bcc         []string
+	ReplyTo     string
+	Subject     string
+	Text        string
+	Html        string
+	Attachments []*MailAttachment
+	// Headers holds extra headers such as List-Unsubscribe
+	Headers map[string][]string
+}
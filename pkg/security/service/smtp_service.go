@@ -1,8 +1,10 @@
 package service
 
 import (
+	"github.com/GolangSpring/gospring/application"
+	"github.com/rs/zerolog/log"
 	"gopkg.in/gomail.v2"
-	"os"
+	"path/filepath"
 )
 
 type ContentType string
@@ -13,59 +15,165 @@ const (
 )
 
 type ISmtpService interface {
-	CreateNewMessage(to string, subject string, body string, contentType ContentType, attachments ...*os.File) *gomail.Message
+	CreateNewMessage(to string, subject string, body string, contentType ContentType, attachments ...*MailAttachment) *gomail.Message
+	BuildMessage(mail *MailMessage) *gomail.Message
+	CreateRenderedMessage(to string, email *RenderedEmail) *gomail.Message
 	SendEmail(message *gomail.Message) error
+	SendRawEmail(from string, to []string, rawMessage []byte) error
 	GetSmtpConfig() *SmtpConfig
 }
 
 type SmtpConfig struct {
 	CompanyName    string `yaml:"company_name" validate:"required"`
-	Host           string `yaml:"host" validate:"required"`
-	Port           int    `yaml:"port" validate:"required"`
+	Host           string `yaml:"host" validate:"required_without=Transport,required_if=Transport smtp"`
+	Port           int    `yaml:"port" validate:"required_without=Transport,required_if=Transport smtp"`
 	SenderEmail    string `yaml:"sender_email" validate:"required"`
-	SenderPassword string `yaml:"sender_password" json:"-" validate:"required"`
+	SenderPassword string `yaml:"sender_password" json:"-" validate:"required_without=Transport,required_if=Transport smtp"`
+
+	// Transport selects how messages leave the application, smtp when empty
+	Transport          MailTransportKind `yaml:"transport" validate:"omitempty,oneof=smtp file memory"`
+	TlsMode            TlsMode           `yaml:"tls_mode" validate:"omitempty,oneof=starttls implicit"`
+	InsecureSkipVerify bool              `yaml:"insecure_skip_verify"`
+	PoolSize           int               `yaml:"pool_size"`
+	FileDirectory      string            `yaml:"file_directory"`
+	FileFormat         MailFileFormat    `yaml:"file_format" validate:"omitempty,oneof=eml maildir"`
+	MemoryCapacity     int               `yaml:"memory_capacity"`
+
+	// Dkim signs every outgoing message when set
+	Dkim *DkimConfig `yaml:"dkim"`
+
+	// Branding shared by the email layout
+	LogoUrl string `yaml:"logo_url"`
+	// LogoFile is embedded in every templated email and takes precedence over LogoUrl
+	LogoFile     string `yaml:"logo_file"`
+	SupportEmail string `yaml:"support_email"`
+	WebsiteUrl   string `yaml:"website_url"`
 }
 
+var _ application.IService = (*SmtpService)(nil)
+var _ application.IStoppableService = (*SmtpService)(nil)
+
 type SmtpService struct {
 	SmtpConfig *SmtpConfig
-	Dialer     *gomail.Dialer
+	Transport  IMailTransport
 }
 
 func (service *SmtpService) PostConstruct() {}
 
+// Stop closes the pooled connections of the transport, the mail queue is stopped before it.
+func (service *SmtpService) Stop() {
+	if err := service.Transport.Close(); err != nil {
+		log.Warn().Msgf("Failed to close the mail transport: %v", err)
+	}
+}
+
 func (service *SmtpService) GetSmtpConfig() *SmtpConfig {
 	return service.SmtpConfig
 }
 
 func NewSmtpService(config *SmtpConfig) *SmtpService {
-	dialer := gomail.NewDialer(
-		config.Host,
-		config.Port,
-		config.SenderEmail,
-		config.SenderPassword,
-	)
+	transport := NewMailTransport(config)
+	if config.Dkim != nil {
+		dkimTransport, err := NewDkimTransport(transport, config.Dkim)
+		if err != nil {
+			log.Fatal().Msgf("Failed to load DKIM signing key: %v", err)
+		}
+		transport = dkimTransport
+	}
 
 	service := &SmtpService{
 		SmtpConfig: config,
-		Dialer:     dialer,
+		Transport:  transport,
 	}
 
 	return service
 }
 
-func (service *SmtpService) CreateNewMessage(to string, subject string, body string, contentType ContentType, attachments ...*os.File) *gomail.Message {
+func (service *SmtpService) CreateNewMessage(to string, subject string, body string, contentType ContentType, attachments ...*MailAttachment) *gomail.Message {
+	mail := &MailMessage{
+		To:          []string{to},
+		Subject:     subject,
+		Attachments: attachments,
+	}
+	if contentType == ContentTypeHtml {
+		mail.Html = body
+	} else {
+		mail.Text = body
+	}
+	return service.BuildMessage(mail)
+}
+
+func (service *SmtpService) BuildMessage(mail *MailMessage) *gomail.Message {
 	message := gomail.NewMessage()
 	message.SetHeader("From", service.SmtpConfig.SenderEmail)
-	message.SetHeader("To", to)
-	message.SetHeader("Subject", subject)
-	message.SetBody(string(contentType), body)
+	message.SetHeader("To", mail.To...)
+	if len(mail.Cc) > 0 {
+		message.SetHeader("Cc", mail.Cc...)
+	}
+	if len(mail.Bcc) > 0 {
+		message.SetHeader("Bcc", mail.Bcc...)
+	}
+	if mail.ReplyTo != "" {
+		message.SetHeader("Reply-To", mail.ReplyTo)
+	}
+	message.SetHeader("Subject", mail.Subject)
+	for field, values := range mail.Headers {
+		message.SetHeader(field, values...)
+	}
+
+	switch {
+	case mail.Text != "" && mail.Html != "":
+		message.SetBody(ContentTypeText, mail.Text)
+		message.AddAlternative(ContentTypeHtml, mail.Html)
+	case mail.Html != "":
+		message.SetBody(ContentTypeHtml, mail.Html)
+	default:
+		message.SetBody(ContentTypeText, mail.Text)
+	}
+
+	for _, attachment := range mail.Attachments {
+		if attachment.Inline {
+			message.Embed(attachment.FileName, attachment.settings()...)
+		} else {
+			message.Attach(attachment.FileName, attachment.settings()...)
+		}
+	}
+	return message
+}
+
+// InlineLogoContentID is the content id the layout references when SmtpConfig.LogoFile is set.
+func (config *SmtpConfig) InlineLogoContentID() string {
+	return "logo" + filepath.Ext(config.LogoFile)
+}
 
-	for _, attachment := range attachments {
-		message.Attach(attachment.Name())
+// CreateRenderedMessage builds a multipart/alternative message with the plain-text part first,
+// so clients that can display html pick the last one.
+func (service *SmtpService) CreateRenderedMessage(to string, email *RenderedEmail) *gomail.Message {
+	message := service.BuildMessage(&MailMessage{
+		To:      []string{to},
+		Subject: email.Subject,
+		Text:    email.Text,
+		Html:    email.Html,
+	})
+	if service.SmtpConfig.LogoFile != "" {
+		message.Embed(service.SmtpConfig.LogoFile, gomail.Rename(service.SmtpConfig.InlineLogoContentID()))
 	}
 	return message
 }
 
 func (service *SmtpService) SendEmail(message *gomail.Message) error {
-	return service.Dialer.DialAndSend(message)
+	from, to, err := messageEnvelope(message)
+	if err != nil {
+		return err
+	}
+	rawMessage, err := writeMessage(message)
+	if err != nil {
+		return err
+	}
+	return service.Transport.Send(from, to, rawMessage)
+}
+
+// SendRawEmail delivers an already serialized MIME message, as stored by the mail queue.
+func (service *SmtpService) SendRawEmail(from string, to []string, rawMessage []byte) error {
+	return service.Transport.Send(from, to, rawMessage)
 }
@@ -0,0 +1,63 @@
+package service
+
+import (
+	"gopkg.in/gomail.v2"
+	"strings"
+	"testing"
+)
+
+type closeCountingTransport struct {
+	MemoryTransport
+	closed int
+}
+
+func (transport *closeCountingTransport) Close() error {
+	transport.closed++
+	return nil
+}
+
+func TestSmtpServiceStopClosesTransport(t *testing.T) {
+	transport := &closeCountingTransport{}
+	service := &SmtpService{SmtpConfig: &SmtpConfig{}, Transport: transport}
+
+	service.Stop()
+	if transport.closed != 1 {
+		t.Fatalf("expected the transport to be closed once, got %d", transport.closed)
+	}
+}
+
+func TestSendEmailStripsIdempotencyKey(t *testing.T) {
+	transport := NewMemoryTransport(1)
+	service := &SmtpService{SmtpConfig: &SmtpConfig{}, Transport: transport}
+
+	message := gomail.NewMessage()
+	message.SetHeader("From", "noreply@example.com")
+	message.SetHeader("To", "alice@example.com")
+	message.SetHeader("Subject", "Welcome")
+	message.SetBody("text/plain", "X-Idempotency-Key: kept in the body")
+	SetIdempotencyKey(message, "invitation:1")
+	if err := service.SendEmail(message); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	mail, err := transport.Get(transport.List()[0].ID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	headers, body, _ := strings.Cut(mail.Raw, "\r\n\r\n")
+	if strings.Contains(headers, MailIdempotencyHeader) {
+		t.Fatalf("expected no idempotency header, got %q", headers)
+	}
+	if !strings.Contains(headers, "Subject: Welcome") || !strings.Contains(body, "X-Idempotency-Key: kept in the body") {
+		t.Fatalf("expected the other headers and the body to be kept, got %q", mail.Raw)
+	}
+}
+
+func TestStripHeaderFoldedLines(t *testing.T) {
+	raw := "Subject: Hi\r\nX-Idempotency-Key: a\r\n b\r\nTo: alice@example.com\r\n\r\nbody"
+
+	stripped := string(stripHeader([]byte(raw), MailIdempotencyHeader))
+	if expected := "Subject: Hi\r\nTo: alice@example.com\r\n\r\nbody"; stripped != expected {
+		t.Fatalf("expected %q, got %q", expected, stripped)
+	}
+}
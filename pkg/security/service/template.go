@@ -14,13 +14,42 @@ func NewEmailTemplate(userName string, otpCode string, companyName string) *Emai
 	}
 }
 
-const RESET_PASSWORD_EMAIL_HTML_TEMPLATE = `
+type InvitationEmailTemplate struct {
+	UserName    string
+	InviteLink  string
+	CompanyName string
+}
+
+func NewInvitationEmailTemplate(userName string, inviteLink string, companyName string) *InvitationEmailTemplate {
+	return &InvitationEmailTemplate{
+		UserName:    userName,
+		InviteLink:  inviteLink,
+		CompanyName: companyName,
+	}
+}
+
+type AccountLockedEmailTemplate struct {
+	UserName    string
+	CompanyName string
+	LockedUntil string
+	IpAddress   string
+}
+
+type EmailChangedEmailTemplate struct {
+	UserName    string
+	CompanyName string
+	NewEmail    string
+}
+
+// EMAIL_LAYOUT_HTML_TEMPLATE is shared by every email, the content templates fill the
+// "title" and "content" blocks while company branding comes from the `brand` function.
+const EMAIL_LAYOUT_HTML_TEMPLATE = `{{define "layout"}}
 <!DOCTYPE html>
 <html lang="en">
 <head>
     <meta charset="UTF-8">
     <meta name="viewport" content="width=device-width, initial-scale=1.0">
-    <title>Password Reset</title>
+    <title>{{template "title" .}}</title>
     <style>
         body {
             font-family: Arial, sans-serif;
@@ -41,6 +70,12 @@ const RESET_PASSWORD_EMAIL_HTML_TEMPLATE = `
             box-shadow: 0 4px 8px rgba(0, 0, 0, 0.3);
         }
 
+        .logo {
+            display: block;
+            max-height: 48px;
+            margin: 0 auto 10px;
+        }
+
         h1 {
             color: #ffffff; /* White text for heading */
             font-size: 24px;
@@ -65,6 +100,19 @@ const RESET_PASSWORD_EMAIL_HTML_TEMPLATE = `
             display: inline-block;
         }
 
+        .invite-link {
+            font-size: 18px;
+            color: #ffcc00; /* Bright accent color */
+            font-weight: bold;
+            margin: 20px 0;
+            text-align: center;
+            background-color: #333; /* Dark button-like background */
+            padding: 10px 20px;
+            border-radius: 4px;
+            text-decoration: none;
+            display: inline-block;
+        }
+
         .footer {
             font-size: 12px;
             color: #888; /* Muted footer text */
@@ -75,177 +123,108 @@ const RESET_PASSWORD_EMAIL_HTML_TEMPLATE = `
 </head>
 <body>
     <div class="container">
-        <h1>Password Reset Request</h1>
-        <p>Hello, {{.UserName}}</p>
-        <p>We received a request to reset your password. Use the code below to complete the reset process:</p>
-        
-        <div class="verification-code">{{.OTPCode}}</div>
-        
-        <p>Please enter this code on the password reset form. This code will expire in 5 minutes.</p>
-        
-        <p>If you did not request a password reset, please ignore this email.</p>
-        <p>Thanks,<br>The {{.CompanyName}} Team</p>
-        
+        {{with brand.LogoUrl}}<img src="{{.}}" alt="{{brand.CompanyName}}" class="logo">{{end}}
+        {{template "content" .}}
+
         <div class="footer">
-            <p>If you have any questions, feel free to contact our support team.</p>
+            {{template "footer" .}}
+            {{with brand.SupportEmail}}<p>If you have any questions, feel free to contact our support team at {{.}}.</p>{{else}}<p>If you have any questions, feel free to contact our support team.</p>{{end}}
+            {{with brand.WebsiteUrl}}<p><a href="{{.}}">{{brand.CompanyName}}</a></p>{{end}}
         </div>
     </div>
 </body>
 </html>
-`
+{{end}}
+{{define "footer"}}{{end}}`
 
-const EMAIL_VERIFICATION_HTML_TEMPLATE = `
-<!DOCTYPE html>
-<html lang="en">
-<head>
-    <meta charset="UTF-8">
-    <meta name="viewport" content="width=device-width, initial-scale=1.0">
-    <title>Email Verification</title>
-    <style>
-        body {
-            font-family: Arial, sans-serif;
-            background-color: #1a1a1a; /* Dark background */
-            color: #e0e0e0; /* Light text */
-            margin: 0;
-            padding: 0;
-        }
-
-        .container {
-            width: 100%;
-            max-width: 600px;
-            margin: 20px auto;
-            background-color: #2a2a2a; /* Dark card background */
-            padding: 20px;
-            border: 1px solid #444; /* Dark border */
-            border-radius: 0.5rem; /* Rounded corners */
-            box-shadow: 0 4px 8px rgba(0, 0, 0, 0.3);
-        }
+const RESET_PASSWORD_EMAIL_HTML_TEMPLATE = `
+{{define "subject"}}Reset Password{{end}}
+{{define "title"}}Password Reset{{end}}
+{{define "content"}}
+        <h1>Password Reset Request</h1>
+        <p>Hello, {{.UserName}}</p>
+        <p>We received a request to reset your password. Use the code below to complete the reset process:</p>
 
-        h1 {
-            color: #ffffff; /* White text for heading */
-            font-size: 24px;
-            text-align: center;
-        }
+        <div class="verification-code">{{.OTPCode}}</div>
 
-        p {
-            line-height: 1.6;
-            font-size: 16px;
-            color: #b0b0b0; /* Muted text */
-        }
+        <p>Please enter this code on the password reset form. This code will expire in 5 minutes.</p>
 
-        .verification-code {
-            font-size: 24px;
-            color: #ffcc00; /* Bright accent color */
-            font-weight: bold;
-            margin: 20px 0;
-            text-align: center;
-            background-color: #333; /* Dark popover background */
-            padding: 10px;
-            border-radius: 4px;
-            display: inline-block;
-        }
+        <p>If you did not request a password reset, please ignore this email.</p>
+        <p>Thanks,<br>The {{.CompanyName}} Team</p>
+{{end}}`
 
-        .footer {
-            font-size: 12px;
-            color: #888; /* Muted footer text */
-            margin-top: 20px;
-            text-align: center;
-        }
-    </style>
-</head>
-<body>
-    <div class="container">
+const EMAIL_VERIFICATION_HTML_TEMPLATE = `
+{{define "subject"}}Email Verification{{end}}
+{{define "title"}}Email Verification{{end}}
+{{define "content"}}
         <h1>Email Verification</h1>
         <p>Hello, {{.UserName}}</p>
         <p>Welcome to {{.CompanyName}}! To complete your registration, please verify your email address using the code below:</p>
-        
+
         <div class="verification-code">{{.OTPCode}}</div>
-        
+
         <p>This code is valid for 5 minutes. If you did not create an account, you can safely ignore this email.</p>
         <p>Thank you for joining us!</p>
-        
-        <div class="footer">
-            <p>If you have any questions, feel free to contact our support team.</p>
-        </div>
-    </div>
-</body>
-</html>
-`
-
-const INVITATION_EMAIL_HTML_TEMPLATE = `
-<!DOCTYPE html>
-<html lang="en">
-<head>
-    <meta charset="UTF-8">
-    <meta name="viewport" content="width=device-width, initial-scale=1.0">
-    <title>Invitation to Join</title>
-    <style>
-        body {
-            font-family: Arial, sans-serif;
-            background-color: #1a1a1a; /* Dark background */
-            color: #e0e0e0; /* Light text */
-            margin: 0;
-            padding: 0;
-        }
-
-        .container {
-            width: 100%;
-            max-width: 600px;
-            margin: 20px auto;
-            background-color: #2a2a2a; /* Dark card background */
-            padding: 20px;
-            border: 1px solid #444; /* Dark border */
-            border-radius: 0.5rem; /* Rounded corners */
-            box-shadow: 0 4px 8px rgba(0, 0, 0, 0.3);
-        }
+{{end}}`
 
-        h1 {
-            color: #ffffff; /* White text for heading */
-            font-size: 24px;
-            text-align: center;
-        }
+const LOGIN_OTP_EMAIL_HTML_TEMPLATE = `
+{{define "subject"}}Sign-in Code{{end}}
+{{define "title"}}Sign-in Code{{end}}
+{{define "content"}}
+        <h1>Sign-in Code</h1>
+        <p>Hello, {{.UserName}}</p>
+        <p>A sign-in to your {{.CompanyName}} account was requested. To finish signing in, please enter the code below:</p>
 
-        p {
-            line-height: 1.6;
-            font-size: 16px;
-            color: #b0b0b0; /* Muted text */
-        }
+        <div class="verification-code">{{.OTPCode}}</div>
 
-        .invite-link {
-            font-size: 18px;
-            color: #ffcc00; /* Bright accent color */
-            font-weight: bold;
-            margin: 20px 0;
-            text-align: center;
-            background-color: #333; /* Dark button-like background */
-            padding: 10px 20px;
-            border-radius: 4px;
-            text-decoration: none;
-            display: inline-block;
-        }
+        <p>This code is valid for 5 minutes. If you did not try to sign in, please change your password as soon as possible.</p>
+{{end}}`
 
-        .footer {
-            font-size: 12px;
-            color: #888; /* Muted footer text */
-            margin-top: 20px;
-            text-align: center;
-        }
-    </style>
-</head>
-<body>
-    <div class="container">
+const INVITATION_EMAIL_HTML_TEMPLATE = `
+{{define "subject"}}You are invited to {{.CompanyName}}{{end}}
+{{define "title"}}Invitation to Join{{end}}
+{{define "content"}}
         <h1>Welcome to {{.CompanyName}}</h1>
         <p>Hello, {{.UserName}}</p>
         <p>We're excited to have you join our platform! To get started, please click the link below to complete your registration:</p>
-        
+
         <a href="{{.InviteLink}}" class="invite-link">Complete Your Registration</a>
-        
-        <p>If you have any questions, feel free to contact our support team.</p>
+
         <p>Thanks,<br>The {{.CompanyName}} Team</p>
-        
-        <div class="footer">
-            <p>If you did not request this invitation, please ignore this email.</p>
-        </div>
-    </div>
-</body>
-</html>`
+{{end}}
+{{define "footer"}}<p>If you did not request this invitation, please ignore this email.</p>{{end}}`
+
+const ACCOUNT_LOCKED_EMAIL_HTML_TEMPLATE = `
+{{define "subject"}}Your {{.CompanyName}} account has been locked{{end}}
+{{define "title"}}Account Locked{{end}}
+{{define "content"}}
+        <h1>Account Locked</h1>
+        <p>Hello, {{.UserName}}</p>
+        <p>We noticed several failed sign-in attempts to your {{.CompanyName}} account{{with .IpAddress}} from {{.}}{{end}}. To protect your account, signing in is blocked until {{.LockedUntil}}.</p>
+
+        <p>If these attempts were not made by you, we recommend resetting your password once the lock expires.</p>
+{{end}}`
+
+const EMAIL_CHANGE_HTML_TEMPLATE = `
+{{define "subject"}}Confirm your new email address{{end}}
+{{define "title"}}Email Change{{end}}
+{{define "content"}}
+        <h1>Confirm Your New Email</h1>
+        <p>Hello, {{.UserName}}</p>
+        <p>You asked to use this address for your {{.CompanyName}} account. Please confirm the change using the code below:</p>
+
+        <div class="verification-code">{{.OTPCode}}</div>
+
+        <p>This code is valid for 5 minutes. If you did not ask for this change, you can safely ignore this email.</p>
+{{end}}`
+
+const EMAIL_CHANGED_HTML_TEMPLATE = `
+{{define "subject"}}Your {{.CompanyName}} email address was changed{{end}}
+{{define "title"}}Email Changed{{end}}
+{{define "content"}}
+        <h1>Email Address Changed</h1>
+        <p>Hello, {{.UserName}}</p>
+        <p>The email address of your {{.CompanyName}} account was changed to {{.NewEmail}}. Emails about your account are no longer sent to this address.</p>
+
+        <p>If you did not make this change, please contact us right away.</p>
+{{end}}`
@@ -0,0 +1,262 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/GolangSpring/gospring/application"
+	"github.com/rs/zerolog/log"
+	"html"
+	"html/template"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	textTemplate "text/template"
+)
+
+type TemplateName string
+
+const (
+	TemplateLayout            TemplateName = "layout"
+	TemplateResetPassword     TemplateName = "reset_password"
+	TemplateEmailVerification TemplateName = "email_verification"
+	TemplateLoginOtp          TemplateName = "login_otp"
+	TemplateInvitation        TemplateName = "invitation"
+	TemplateAccountLocked     TemplateName = "account_locked"
+	TemplateEmailChange       TemplateName = "email_change"
+	TemplateEmailChanged      TemplateName = "email_changed"
+)
+
+var BuiltinTemplates = map[TemplateName]string{
+	TemplateLayout:            EMAIL_LAYOUT_HTML_TEMPLATE,
+	TemplateResetPassword:     RESET_PASSWORD_EMAIL_HTML_TEMPLATE,
+	TemplateEmailVerification: EMAIL_VERIFICATION_HTML_TEMPLATE,
+	TemplateLoginOtp:          LOGIN_OTP_EMAIL_HTML_TEMPLATE,
+	TemplateInvitation:        INVITATION_EMAIL_HTML_TEMPLATE,
+	TemplateAccountLocked:     ACCOUNT_LOCKED_EMAIL_HTML_TEMPLATE,
+	TemplateEmailChange:       EMAIL_CHANGE_HTML_TEMPLATE,
+	TemplateEmailChanged:      EMAIL_CHANGED_HTML_TEMPLATE,
+}
+
+// TemplateConfig points to a directory overriding the built-in templates, laid out as
+//
+//	{directory}/{name}.html          default override
+//	{directory}/{locale}/{name}.html locale variant, e.g. de/reset_password.html
+//	{directory}/{locale}/{name}.txt  optional hand written plain-text part
+//
+// where name is one of the TemplateName values, "layout" included.
+type TemplateConfig struct {
+	Directory     string `yaml:"directory"`
+	DefaultLocale string `yaml:"default_locale"`
+}
+
+type EmailBranding struct {
+	CompanyName  string
+	LogoUrl      template.URL
+	SupportEmail string
+	WebsiteUrl   string
+}
+
+type RenderedEmail struct {
+	Subject string
+	Html    string
+	Text    string
+}
+
+type ITemplateService interface {
+	Render(name TemplateName, locale string, data any) (*RenderedEmail, error)
+}
+
+var _ application.IService = (*TemplateService)(nil)
+var _ ITemplateService = (*TemplateService)(nil)
+
+type TemplateService struct {
+	TemplateConfig *TemplateConfig
+	SmtpConfig     *SmtpConfig
+}
+
+func NewTemplateService(templateConfig *TemplateConfig, smtpConfig *SmtpConfig) *TemplateService {
+	return &TemplateService{
+		TemplateConfig: templateConfig,
+		SmtpConfig:     smtpConfig,
+	}
+}
+
+func (service *TemplateService) PostConstruct() {
+	directory := service.TemplateConfig.Directory
+	if directory == "" {
+		log.Info().Msg("No email template directory configured, using built-in templates")
+		return
+	}
+	if info, err := os.Stat(directory); err != nil || !info.IsDir() {
+		log.Warn().Msgf("Email template directory %s is not readable, using built-in templates", directory)
+	}
+}
+
+func (service *TemplateService) branding() EmailBranding {
+	// The logo url comes from configuration, so cid: references are trusted as well
+	logoUrl := template.URL(service.SmtpConfig.LogoUrl)
+	if service.SmtpConfig.LogoFile != "" {
+		logoUrl = template.URL("cid:" + service.SmtpConfig.InlineLogoContentID())
+	}
+	return EmailBranding{
+		CompanyName:  service.SmtpConfig.CompanyName,
+		LogoUrl:      logoUrl,
+		SupportEmail: service.SmtpConfig.SupportEmail,
+		WebsiteUrl:   service.SmtpConfig.WebsiteUrl,
+	}
+}
+
+// localePattern accepts BCP 47 shaped tags like "de" or "pt-BR", the locale names a directory
+// so anything else, path separators and dots included, is never looked up.
+var localePattern = regexp.MustCompile(`^[A-Za-z]{2,8}(-[A-Za-z0-9]{1,8})*$`)
+
+// candidateLocales lists the lookup order for a locale, e.g. "pt-BR" -> ["pt-BR", "pt", default, ""].
+// Locales that are no BCP 47 tag are skipped.
+func (service *TemplateService) candidateLocales(locale string) []string {
+	var candidates []string
+	appendCandidate := func(candidate string) {
+		for _, existing := range candidates {
+			if strings.EqualFold(existing, candidate) {
+				return
+			}
+		}
+		candidates = append(candidates, candidate)
+	}
+
+	for _, _locale := range []string{locale, service.TemplateConfig.DefaultLocale} {
+		if !localePattern.MatchString(_locale) {
+			continue
+		}
+		appendCandidate(_locale)
+		if base, _, found := strings.Cut(_locale, "-"); found {
+			appendCandidate(base)
+		}
+	}
+	appendCandidate("")
+	return candidates
+}
+
+// lookup finds the most specific override of the file in the template directory.
+func (service *TemplateService) lookup(fileName string, locale string) (string, bool, error) {
+	directory := service.TemplateConfig.Directory
+	if directory == "" {
+		return "", false, nil
+	}
+	for _, candidate := range service.candidateLocales(locale) {
+		content, err := os.ReadFile(filepath.Join(directory, candidate, fileName))
+		if err == nil {
+			return string(content), true, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", false, err
+		}
+	}
+	return "", false, nil
+}
+
+func (service *TemplateService) lookupHtml(name TemplateName, locale string) (string, error) {
+	content, found, err := service.lookup(string(name)+".html", locale)
+	if err != nil {
+		return "", err
+	}
+	if found {
+		return content, nil
+	}
+	builtin, ok := BuiltinTemplates[name]
+	if !ok {
+		return "", fmt.Errorf("email template %s not found", name)
+	}
+	return builtin, nil
+}
+
+func (service *TemplateService) Render(name TemplateName, locale string, data any) (*RenderedEmail, error) {
+	brand := service.branding()
+	funcs := template.FuncMap{"brand": func() EmailBranding { return brand }}
+
+	layout, err := service.lookupHtml(TemplateLayout, locale)
+	if err != nil {
+		return nil, err
+	}
+	content, err := service.lookupHtml(name, locale)
+	if err != nil {
+		return nil, err
+	}
+
+	_template, err := template.New(string(name)).Funcs(funcs).Parse(layout)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := _template.Parse(content); err != nil {
+		return nil, err
+	}
+
+	var htmlBuffer bytes.Buffer
+	if err := _template.ExecuteTemplate(&htmlBuffer, "layout", data); err != nil {
+		return nil, err
+	}
+
+	var subject string
+	if _template.Lookup("subject") != nil {
+		var subjectBuffer bytes.Buffer
+		if err := _template.ExecuteTemplate(&subjectBuffer, "subject", data); err != nil {
+			return nil, err
+		}
+		subject = strings.TrimSpace(html.UnescapeString(subjectBuffer.String()))
+	}
+
+	text, err := service.renderText(name, locale, data, brand, htmlBuffer.String())
+	if err != nil {
+		return nil, err
+	}
+
+	return &RenderedEmail{
+		Subject: subject,
+		Html:    htmlBuffer.String(),
+		Text:    text,
+	}, nil
+}
+
+func (service *TemplateService) renderText(name TemplateName, locale string, data any, brand EmailBranding, renderedHtml string) (string, error) {
+	content, found, err := service.lookup(string(name)+".txt", locale)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return HtmlToText(renderedHtml), nil
+	}
+
+	funcs := textTemplate.FuncMap{"brand": func() EmailBranding { return brand }}
+	_template, err := textTemplate.New(string(name)).Funcs(funcs).Parse(content)
+	if err != nil {
+		return "", err
+	}
+	var buffer bytes.Buffer
+	if err := _template.Execute(&buffer, data); err != nil {
+		return "", err
+	}
+	return buffer.String(), nil
+}
+
+var (
+	htmlHeadPattern       = regexp.MustCompile(`(?is)<head.*?</head>`)
+	htmlLinkPattern       = regexp.MustCompile(`(?is)<a[^>]*href="([^"]*)"[^>]*>(.*?)</a>`)
+	htmlLineBreakPattern  = regexp.MustCompile(`(?i)<br\s*/?>|</(p|div|h[1-6]|li|tr)>`)
+	htmlTagPattern        = regexp.MustCompile(`(?s)<[^>]*>`)
+	blankLinesPattern     = regexp.MustCompile(`\n{3,}`)
+	trailingSpacesPattern = regexp.MustCompile(`(?m)^[ \t]+|[ \t]+$`)
+)
+
+// HtmlToText derives the plain-text alternative part from a rendered html email.
+func HtmlToText(content string) string {
+	text := htmlHeadPattern.ReplaceAllString(content, "")
+	text = htmlLinkPattern.ReplaceAllString(text, "$2: $1")
+	text = htmlLineBreakPattern.ReplaceAllString(text, "\n")
+	text = htmlTagPattern.ReplaceAllString(text, "")
+	text = html.UnescapeString(text)
+	text = trailingSpacesPattern.ReplaceAllString(text, "")
+	text = blankLinesPattern.ReplaceAllString(text, "\n\n")
+	return strings.TrimSpace(text) + "\n"
+}
@@ -0,0 +1,53 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestCandidateLocales(t *testing.T) {
+	service := NewTemplateService(&TemplateConfig{DefaultLocale: "en"}, &SmtpConfig{})
+	tests := map[string][]string{
+		"pt-BR":         {"pt-BR", "pt", "en", ""},
+		"":              {"en", ""},
+		"../../etc":     {"en", ""},
+		"de/../../x":    {"en", ""},
+		`de\..\x`:       {"en", ""},
+		"EN":            {"EN", ""},
+		"zh-Hant-TW":    {"zh-Hant-TW", "zh", "en", ""},
+		"toolonglocale": {"en", ""},
+	}
+	for locale, expected := range tests {
+		if candidates := service.candidateLocales(locale); !slices.Equal(candidates, expected) {
+			t.Errorf("locale %q: expected %v, got %v", locale, expected, candidates)
+		}
+	}
+}
+
+func TestRenderIgnoresLocaleOutsideDirectory(t *testing.T) {
+	root := t.TempDir()
+	directory := filepath.Join(root, "templates")
+	if err := os.MkdirAll(directory, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	// A template the locale "../secret" would reach without the check
+	secret := filepath.Join(root, "secret")
+	if err := os.MkdirAll(secret, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	override := `{{define "subject"}}leaked{{end}}{{define "title"}}{{end}}{{define "content"}}{{end}}`
+	if err := os.WriteFile(filepath.Join(secret, string(TemplateLoginOtp)+".html"), []byte(override), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	service := NewTemplateService(&TemplateConfig{Directory: directory}, &SmtpConfig{})
+	email, err := service.Render(TemplateLoginOtp, "../secret", NewEmailTemplate("user", "123456", "Acme"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if email.Subject == "leaked" {
+		t.Fatal("expected the locale not to leave the template directory")
+	}
+}
@@ -0,0 +1,91 @@
+package service
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+type TenantSource string
+
+const (
+	TenantFromHeader    TenantSource = "header"
+	TenantFromSubdomain TenantSource = "subdomain"
+	TenantFromClaim     TenantSource = "claim"
+
+	DefaultTenantHeader = "X-Tenant-ID"
+)
+
+// TenantConfig tells where the tenant of a request comes from, the sources are tried in order
+// and the first one resolving a tenant wins. Only the token claim is used by default, the header
+// is chosen by the client so it has to be listed explicitly.
+type TenantConfig struct {
+	Sources []TenantSource `yaml:"sources" validate:"dive,oneof=header subdomain claim"`
+	Header  string         `yaml:"header"`
+	// BaseDomain is stripped from the host to find the tenant subdomain, e.g. "example.com"
+	BaseDomain string `yaml:"base_domain"`
+}
+
+func (config *TenantConfig) GetSources() []TenantSource {
+	if len(config.Sources) == 0 {
+		return []TenantSource{TenantFromClaim}
+	}
+	return config.Sources
+}
+
+func (config *TenantConfig) GetHeader() string {
+	if config.Header == "" {
+		return DefaultTenantHeader
+	}
+	return config.Header
+}
+
+// Resolve returns the tenant of the request, empty when no source resolves one. The claims may be nil.
+// A resolved tenant grants nothing by itself, the user still needs roles in it.
+func (config *TenantConfig) Resolve(request *http.Request, claims *UserClaims) string {
+	for _, source := range config.GetSources() {
+		var tenant string
+		switch source {
+		case TenantFromHeader:
+			// A client only picks among the tenants its token lists, others are ignored
+			tenant = strings.TrimSpace(request.Header.Get(config.GetHeader()))
+			if _, ok := claims.tenantRoles()[tenant]; !ok {
+				tenant = ""
+			}
+		case TenantFromSubdomain:
+			tenant = config.subdomain(request.Host)
+		case TenantFromClaim:
+			if claims != nil {
+				tenant = claims.Tenant
+			}
+		}
+		// The "*" domain holds the global policies, it is never a tenant
+		if tenant != "" && tenant != PolicyDomainAny {
+			return tenant
+		}
+	}
+	return ""
+}
+
+// subdomain returns the label right before BaseDomain, "acme" for "acme.example.com".
+func (config *TenantConfig) subdomain(host string) string {
+	if config.BaseDomain == "" {
+		return ""
+	}
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	prefix, ok := strings.CutSuffix(strings.ToLower(host), "."+strings.ToLower(config.BaseDomain))
+	if !ok {
+		return ""
+	}
+	return prefix[strings.LastIndex(prefix, ".")+1:]
+}
+
+// tenantRoles returns the tenants of the token, nil without claims.
+func (claims *UserClaims) tenantRoles() map[string][]string {
+	if claims == nil {
+		return nil
+	}
+	return claims.Tenants
+}
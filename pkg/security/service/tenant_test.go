@@ -0,0 +1,67 @@
+package service
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTenantConfigResolve(t *testing.T) {
+	tests := []struct {
+		name   string
+		config TenantConfig
+		host   string
+		header string
+		claims *UserClaims
+		tenant string
+	}{
+		{"header ignored by default", TenantConfig{}, "example.com", "acme", &UserClaims{Tenant: "other"}, "other"},
+		{"claim", TenantConfig{}, "example.com", "", &UserClaims{Tenant: "other"}, "other"},
+		{
+			"header of a tenant of the user",
+			TenantConfig{Sources: []TenantSource{TenantFromHeader, TenantFromClaim}},
+			"example.com", "acme", &UserClaims{Tenants: map[string][]string{"acme": {"admin"}, "other": {"user"}}}, "acme",
+		},
+		{
+			"header of a foreign tenant",
+			TenantConfig{Sources: []TenantSource{TenantFromHeader, TenantFromClaim}},
+			"example.com", "acme", &UserClaims{Tenant: "other", Tenants: map[string][]string{"other": {"user"}}}, "other",
+		},
+		{
+			"header without claims",
+			TenantConfig{Sources: []TenantSource{TenantFromHeader}},
+			"example.com", "acme", nil, "",
+		},
+		{
+			"global domain is no tenant",
+			TenantConfig{Sources: []TenantSource{TenantFromHeader}},
+			"example.com", PolicyDomainAny, &UserClaims{Tenants: map[string][]string{PolicyDomainAny: {"admin"}}}, "",
+		},
+		{"nothing resolved", TenantConfig{}, "example.com", "", nil, ""},
+		{
+			"subdomain",
+			TenantConfig{Sources: []TenantSource{TenantFromSubdomain}, BaseDomain: "example.com"},
+			"app.acme.example.com:8080", "", nil, "acme",
+		},
+		{
+			"foreign host",
+			TenantConfig{Sources: []TenantSource{TenantFromSubdomain}, BaseDomain: "example.com"},
+			"acme.example.org", "", nil, "",
+		},
+		{
+			"header ignored when not a source",
+			TenantConfig{Sources: []TenantSource{TenantFromClaim}},
+			"example.com", "acme", nil, "",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest("GET", "http://"+test.host+"/", nil)
+			if test.header != "" {
+				request.Header.Set(DefaultTenantHeader, test.header)
+			}
+			if tenant := test.config.Resolve(request, test.claims); tenant != test.tenant {
+				t.Fatalf("expected tenant %q, got %q", test.tenant, tenant)
+			}
+		})
+	}
+}
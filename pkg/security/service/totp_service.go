@@ -0,0 +1,379 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"github.com/GolangSpring/gospring/application"
+	. "github.com/GolangSpring/gospring/pkg/security/repository"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/bcrypt"
+	"image/png"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultTotpIssuer         = "GoSpring"
+	DefaultMfaPendingTokenTTL = 5 * time.Minute
+	DefaultTrustedDeviceDay   = 30
+	DefaultRecoveryCodeCount  = 10
+	recoveryCodeAlphabet      = "abcdefghjkmnpqrstuvwxyz23456789"
+	recoveryCodeHalfLength    = 5
+	totpQRCodeSize            = 256
+	totpPeriodSecond          = 30
+	// totpSkew is the number of steps before and after the current one whose codes are accepted
+	totpSkew = 1
+)
+
+type MfaConfig struct {
+	Issuer string `yaml:"issuer"`
+	// EnforcedRoles lists the roles that must pass a second factor at login,
+	// users holding any of them are forced to enroll before getting a session.
+	EnforcedRoles      []string `yaml:"enforced_roles"`
+	PendingTokenMinute int      `yaml:"pending_token_minute"`
+	RecoveryCodeCount  int      `yaml:"recovery_code_count"`
+	// EmailOtpEnabled allows a code sent by email as second factor, for users who opted in
+	// and for enforced roles without an authenticator app.
+	EmailOtpEnabled  bool `yaml:"email_otp_enabled"`
+	TrustedDeviceDay int  `yaml:"trusted_device_day"`
+}
+
+type MfaMethod string
+
+const (
+	MfaMethodTotp  MfaMethod = "totp"
+	MfaMethodEmail MfaMethod = "email"
+)
+
+func (config *MfaConfig) IsEnforcedFor(roles []string) bool {
+	if config == nil {
+		return false
+	}
+	for _, role := range roles {
+		if slices.Contains(config.EnforcedRoles, role) {
+			return true
+		}
+	}
+	return false
+}
+
+func (config *MfaConfig) PendingTokenDuration() time.Duration {
+	if config == nil || config.PendingTokenMinute <= 0 {
+		return DefaultMfaPendingTokenTTL
+	}
+	return time.Duration(config.PendingTokenMinute) * time.Minute
+}
+
+func (config *MfaConfig) IsEmailOtpEnabled() bool {
+	return config != nil && config.EmailOtpEnabled
+}
+
+func (config *MfaConfig) TrustedDeviceDuration() time.Duration {
+	if config == nil || config.TrustedDeviceDay <= 0 {
+		return DefaultTrustedDeviceDay * 24 * time.Hour
+	}
+	return time.Duration(config.TrustedDeviceDay) * 24 * time.Hour
+}
+
+func (config *MfaConfig) GetIssuer() string {
+	if config == nil || config.Issuer == "" {
+		return DefaultTotpIssuer
+	}
+	return config.Issuer
+}
+
+func (config *MfaConfig) GetRecoveryCodeCount() int {
+	if config == nil || config.RecoveryCodeCount <= 0 {
+		return DefaultRecoveryCodeCount
+	}
+	return config.RecoveryCodeCount
+}
+
+type TotpEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+	QRCode string `json:"qr_code"` // base64 encoded PNG of URI
+}
+
+type ITotpService interface {
+	BeginEnrollment(ctx context.Context, userID uint) (*TotpEnrollment, error)
+	ConfirmEnrollment(ctx context.Context, userID uint, code string) ([]string, error)
+	Disable(ctx context.Context, userID uint, code string) error
+	RegenerateRecoveryCodes(ctx context.Context, userID uint, code string) ([]string, error)
+	VerifyCode(ctx context.Context, user *User, code string) error
+	CompleteLogin(ctx context.Context, mfaToken string, code string) (string, error)
+	CompleteEnrollmentLogin(ctx context.Context, mfaToken string, code string) (string, []string, error)
+}
+
+var _ application.IService = (*TotpService)(nil)
+var _ ITotpService = (*TotpService)(nil)
+
+type TotpService struct {
+	UserService   IUserService
+	AuthService   IAuthService
+	LoginThrottle ILoginThrottleService
+	MfaConfig     *MfaConfig
+}
+
+func NewTotpService(userService IUserService, authService IAuthService, loginThrottle ILoginThrottleService, mfaConfig *MfaConfig) *TotpService {
+	return &TotpService{
+		UserService:   userService,
+		AuthService:   authService,
+		LoginThrottle: loginThrottle,
+		MfaConfig:     mfaConfig,
+	}
+}
+
+func (service *TotpService) PostConstruct() {}
+
+func (service *TotpService) BeginEnrollment(ctx context.Context, userID uint) (*TotpEnrollment, error) {
+	user, err := service.UserService.FindByID(ctx, userID)
+	if err != nil {
+		return nil, UserNotFound
+	}
+	if user.TotpEnabled {
+		return nil, MfaAlreadyEnabled
+	}
+
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      service.MfaConfig.GetIssuer(),
+		AccountName: user.Email,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	image, err := key.Image(totpQRCodeSize, totpQRCodeSize)
+	if err != nil {
+		return nil, err
+	}
+	var buffer bytes.Buffer
+	if err := png.Encode(&buffer, image); err != nil {
+		return nil, err
+	}
+
+	// The secret is stored right away but only takes effect once confirmed with a valid code
+	if err := service.UserService.UpdateUserTotp(ctx, user, key.Secret(), false, nil); err != nil {
+		return nil, err
+	}
+
+	return &TotpEnrollment{
+		Secret: key.Secret(),
+		URI:    key.URL(),
+		QRCode: base64.StdEncoding.EncodeToString(buffer.Bytes()),
+	}, nil
+}
+
+func (service *TotpService) ConfirmEnrollment(ctx context.Context, userID uint, code string) ([]string, error) {
+	user, err := service.UserService.FindByID(ctx, userID)
+	if err != nil {
+		return nil, UserNotFound
+	}
+	if user.TotpEnabled {
+		return nil, MfaAlreadyEnabled
+	}
+	if user.TotpSecret == "" {
+		return nil, MfaEnrollmentNotStarted
+	}
+	if err := service.acceptTotpCode(ctx, user, code); err != nil {
+		return nil, err
+	}
+
+	recoveryCodes, hashedCodes, err := service.generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	if err := service.UserService.UpdateUserTotp(ctx, user, user.TotpSecret, true, hashedCodes); err != nil {
+		return nil, err
+	}
+	log.Info().Msgf("TOTP enrolled for user %d", user.ID)
+	return recoveryCodes, nil
+}
+
+func (service *TotpService) Disable(ctx context.Context, userID uint, code string) error {
+	user, err := service.UserService.FindByID(ctx, userID)
+	if err != nil {
+		return UserNotFound
+	}
+	if !user.TotpEnabled {
+		return MfaNotEnabled
+	}
+	if err := service.VerifyCode(ctx, user, code); err != nil {
+		return err
+	}
+	return service.UserService.UpdateUserTotp(ctx, user, "", false, nil)
+}
+
+func (service *TotpService) RegenerateRecoveryCodes(ctx context.Context, userID uint, code string) ([]string, error) {
+	user, err := service.UserService.FindByID(ctx, userID)
+	if err != nil {
+		return nil, UserNotFound
+	}
+	if !user.TotpEnabled {
+		return nil, MfaNotEnabled
+	}
+	if err := service.acceptTotpCode(ctx, user, code); err != nil {
+		return nil, err
+	}
+
+	recoveryCodes, hashedCodes, err := service.generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	return recoveryCodes, service.UserService.UpdateUserRecoveryCodes(ctx, user, hashedCodes)
+}
+
+// totpCodeStep returns the time step around now whose code matches, the same steps totp.Validate accepts.
+func totpCodeStep(secret string, code string, now time.Time) (int64, bool) {
+	opts := totp.ValidateOpts{Period: totpPeriodSecond, Digits: otp.DigitsSix, Algorithm: otp.AlgorithmSHA1}
+	code = strings.TrimSpace(code)
+	current := now.Unix() / totpPeriodSecond
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		expected, err := totp.GenerateCodeCustom(secret, time.Unix(step*totpPeriodSecond, 0), opts)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// acceptTotpCode accepts a TOTP code once, a code seen before is refused for the rest of its validity.
+func (service *TotpService) acceptTotpCode(ctx context.Context, user *User, code string) error {
+	step, ok := totpCodeStep(user.TotpSecret, code, time.Now())
+	if !ok || step <= user.TotpLastStep {
+		return MfaCodeIncorrect
+	}
+	isAccepted, err := service.UserService.AcceptUserTotpStep(ctx, user, step)
+	if err != nil {
+		return err
+	}
+	if !isAccepted {
+		return MfaCodeIncorrect
+	}
+	return nil
+}
+
+// VerifyCode accepts either a current TOTP code or one of the unused recovery codes,
+// a matched recovery code is consumed.
+func (service *TotpService) VerifyCode(ctx context.Context, user *User, code string) error {
+	if user.TotpSecret != "" {
+		if err := service.acceptTotpCode(ctx, user, code); !errors.Is(err, MfaCodeIncorrect) {
+			return err
+		}
+	}
+
+	for idx, hashedCode := range user.TotpRecoveryCodes {
+		if bcrypt.CompareHashAndPassword([]byte(hashedCode), []byte(code)) != nil {
+			continue
+		}
+		remaining := slices.Delete(slices.Clone(user.TotpRecoveryCodes), idx, idx+1)
+		log.Info().Msgf("Recovery code used by user %d, %d left", user.ID, len(remaining))
+		return service.UserService.UpdateUserRecoveryCodes(ctx, user, remaining)
+	}
+	return MfaCodeIncorrect
+}
+
+func (service *TotpService) CompleteLogin(ctx context.Context, mfaToken string, code string) (string, error) {
+	claims, err := service.AuthService.ParseMfaPendingClaims(mfaToken)
+	if err != nil {
+		return "", err
+	}
+	if claims.Method != MfaMethodTotp {
+		return "", MfaMethodMismatch
+	}
+	user, err := service.UserService.FindByID(ctx, claims.ID)
+	if err != nil {
+		return "", UserNotFound
+	}
+	if !user.TotpEnabled {
+		return "", MfaNotEnabled
+	}
+	// Wrong codes count like failed logins, whoever holds the password cannot guess codes forever
+	if err := service.LoginThrottle.Check(ctx, user, ""); err != nil {
+		return "", err
+	}
+	if err := service.VerifyCode(ctx, user, code); err != nil {
+		service.LoginThrottle.RecordFailure(ctx, user, "")
+		return "", err
+	}
+	service.LoginThrottle.RecordSuccess(ctx, user, "")
+	// The account may have been disabled or locked since the password step
+	if err := CheckAccountStatus(user); err != nil {
+		return "", err
+	}
+	return service.AuthService.IssueLoginToken(user, time.Hour)
+}
+
+// CompleteEnrollmentLogin confirms an enrollment started with an mfa pending token,
+// it is used by users whose roles enforce MFA but have not enrolled yet.
+func (service *TotpService) CompleteEnrollmentLogin(ctx context.Context, mfaToken string, code string) (string, []string, error) {
+	claims, err := service.AuthService.ParseMfaPendingClaims(mfaToken)
+	if err != nil {
+		return "", nil, err
+	}
+	if claims.Method != MfaMethodTotp {
+		return "", nil, MfaMethodMismatch
+	}
+	recoveryCodes, err := service.ConfirmEnrollment(ctx, claims.ID, code)
+	if err != nil {
+		return "", nil, err
+	}
+	user, err := service.UserService.FindByID(ctx, claims.ID)
+	if err != nil {
+		return "", nil, UserNotFound
+	}
+	if err := CheckAccountStatus(user); err != nil {
+		return "", nil, err
+	}
+	token, err := service.AuthService.IssueLoginToken(user, time.Hour)
+	if err != nil {
+		return "", nil, err
+	}
+	return token, recoveryCodes, nil
+}
+
+func (service *TotpService) generateRecoveryCodes() ([]string, []string, error) {
+	count := service.MfaConfig.GetRecoveryCodeCount()
+	recoveryCodes := make([]string, count)
+	hashedCodes := make([]string, count)
+	for idx := 0; idx < count; idx++ {
+		code, err := randomRecoveryCode()
+		if err != nil {
+			return nil, nil, err
+		}
+		hashed, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, nil, err
+		}
+		recoveryCodes[idx] = code
+		hashedCodes[idx] = string(hashed)
+	}
+	return recoveryCodes, hashedCodes, nil
+}
+
+func randomRecoveryCode() (string, error) {
+	alphabetSize := big.NewInt(int64(len(recoveryCodeAlphabet)))
+	code := make([]byte, 0, recoveryCodeHalfLength*2+1)
+	for idx := 0; idx < recoveryCodeHalfLength*2; idx++ {
+		if idx == recoveryCodeHalfLength {
+			code = append(code, '-')
+		}
+		position, err := rand.Int(rand.Reader, alphabetSize)
+		if err != nil {
+			return "", err
+		}
+		code = append(code, recoveryCodeAlphabet[position.Int64()])
+	}
+	return string(code), nil
+}
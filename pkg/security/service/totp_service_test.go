@@ -0,0 +1,76 @@
+package service
+
+import (
+	"context"
+	"errors"
+	. "github.com/GolangSpring/gospring/pkg/security/repository"
+	"github.com/pquerna/otp/totp"
+	"testing"
+	"time"
+)
+
+// totpUserService stores the accepted TOTP steps of the user it holds.
+type totpUserService struct {
+	singleUserService
+}
+
+func (service *totpUserService) AcceptUserTotpStep(ctx context.Context, user *User, step int64) (bool, error) {
+	if step <= service.user.TotpLastStep {
+		return false, nil
+	}
+	service.user.TotpLastStep = step
+	return true, nil
+}
+
+func newTotpUser(t *testing.T) *User {
+	t.Helper()
+	key, err := totp.Generate(totp.GenerateOpts{Issuer: DefaultTotpIssuer, AccountName: "alice@example.com"})
+	if err != nil {
+		t.Fatalf("failed to generate the secret: %v", err)
+	}
+	return &User{ID: 1, Status: AccountStatusActive, TotpSecret: key.Secret(), TotpEnabled: true}
+}
+
+func TestVerifyCodeRefusesReplay(t *testing.T) {
+	user := newTotpUser(t)
+	service := NewTotpService(&totpUserService{singleUserService{user: user}}, nil, nil, &MfaConfig{})
+	ctx := context.Background()
+	code, err := totp.GenerateCode(user.TotpSecret, time.Now())
+	if err != nil {
+		t.Fatalf("failed to generate the code: %v", err)
+	}
+
+	if err := service.VerifyCode(ctx, user, code); err != nil {
+		t.Fatalf("expected the code to be accepted, got %v", err)
+	}
+	if err := service.VerifyCode(ctx, user, code); !errors.Is(err, MfaCodeIncorrect) {
+		t.Fatalf("expected the replayed code to be refused, got %v", err)
+	}
+
+	previous, err := totp.GenerateCode(user.TotpSecret, time.Now().Add(-totpPeriodSecond*time.Second))
+	if err != nil {
+		t.Fatalf("failed to generate the code: %v", err)
+	}
+	if err := service.VerifyCode(ctx, user, previous); !errors.Is(err, MfaCodeIncorrect) {
+		t.Fatalf("expected a code older than the accepted one to be refused, got %v", err)
+	}
+}
+
+func TestCompleteLoginChecksAccountStatus(t *testing.T) {
+	user := newTotpUser(t)
+	user.Status = AccountStatusDisabled
+	authService := &AuthService{Secret: "secret"}
+	service := NewTotpService(&totpUserService{singleUserService{user: user}}, authService, &recordingLoginThrottle{}, &MfaConfig{})
+	token, err := authService.IssueMfaPendingToken(user, MfaMethodTotp)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	code, err := totp.GenerateCode(user.TotpSecret, time.Now())
+	if err != nil {
+		t.Fatalf("failed to generate the code: %v", err)
+	}
+
+	if _, err := service.CompleteLogin(context.Background(), token, code); !errors.Is(err, AccountDisabled) {
+		t.Fatalf("expected AccountDisabled, got %v", err)
+	}
+}
@@ -0,0 +1,179 @@
+package service
+
+import (
+	"fmt"
+	. "github.com/GolangSpring/gospring/pkg/security/repository"
+	"github.com/go-playground/validator/v10"
+	"maps"
+	"slices"
+	"strings"
+)
+
+type UserAttributeType string
+
+const (
+	UserAttributeString UserAttributeType = "string"
+	UserAttributeNumber UserAttributeType = "number"
+	UserAttributeBool   UserAttributeType = "bool"
+)
+
+// UserAttributeField declares one custom user attribute, attributes outside the schema are refused.
+type UserAttributeField struct {
+	Name string            `yaml:"name" validate:"required"`
+	Type UserAttributeType `yaml:"type" validate:"omitempty,oneof=string number bool"`
+	// Validate holds validator tags checked against the value, e.g. "max=64" or "oneof=sales support"
+	Validate string `yaml:"validate"`
+	// InClaims copies the attribute into the login token, keep these few and small
+	InClaims bool `yaml:"in_claims"`
+	// UserEditable lets users change the attribute on their own profile, otherwise only admins can
+	UserEditable bool `yaml:"user_editable"`
+}
+
+func (field *UserAttributeField) GetType() UserAttributeType {
+	if field.Type == "" {
+		return UserAttributeString
+	}
+	return field.Type
+}
+
+type UserAttributeConfig struct {
+	Fields []UserAttributeField `yaml:"fields" validate:"dive"`
+}
+
+type UserAttributeViolation struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// UserAttributeError lists every attribute refused by the schema.
+type UserAttributeError struct {
+	Violations []UserAttributeViolation
+}
+
+func (err *UserAttributeError) Error() string {
+	messages := make([]string, len(err.Violations))
+	for idx, violation := range err.Violations {
+		messages[idx] = violation.Field + " " + violation.Message
+	}
+	return "UserAttributeInvalid: " + strings.Join(messages, "; ")
+}
+
+func (err *UserAttributeError) add(field string, message string) {
+	err.Violations = append(err.Violations, UserAttributeViolation{Field: field, Message: message})
+}
+
+// UserAttributeSchema checks the custom attributes written to users against the configured fields.
+type UserAttributeSchema struct {
+	fields   map[string]*UserAttributeField
+	validate *validator.Validate
+}
+
+// NewUserAttributeSchema refuses fields whose validator tags are unknown or do not fit their type,
+// the validator would panic on them at the first update otherwise.
+func NewUserAttributeSchema(config *UserAttributeConfig) (*UserAttributeSchema, error) {
+	schema := &UserAttributeSchema{
+		fields:   make(map[string]*UserAttributeField, len(config.Fields)),
+		validate: validator.New(),
+	}
+	for idx := range config.Fields {
+		field := &config.Fields[idx]
+		if err := schema.checkTags(field); err != nil {
+			return nil, fmt.Errorf("user attribute %s: %w", field.Name, err)
+		}
+		schema.fields[field.Name] = field
+	}
+	return schema, nil
+}
+
+// attributeSamples are values of each type the validator tags are tried on.
+var attributeSamples = map[UserAttributeType]any{
+	UserAttributeString: "",
+	UserAttributeNumber: float64(0),
+	UserAttributeBool:   false,
+}
+
+func (schema *UserAttributeSchema) checkTags(field *UserAttributeField) (err error) {
+	if field.Validate == "" {
+		return nil
+	}
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("invalid validate tags %q: %v", field.Validate, recovered)
+		}
+	}()
+	// Only a panic matters, the sample may well fail the tags
+	_ = schema.validate.Var(attributeSamples[field.GetType()], field.Validate)
+	return nil
+}
+
+// Validate checks an attribute update, nil values remove the attribute. With byUser, attributes
+// the user may not edit themselves are refused too.
+func (schema *UserAttributeSchema) Validate(update UserAttributes, byUser bool) error {
+	attributeErr := &UserAttributeError{}
+	for _, name := range slices.Sorted(maps.Keys(update)) {
+		value := update[name]
+		field, ok := schema.fields[name]
+		if !ok {
+			attributeErr.add(name, "is not a known attribute")
+			continue
+		}
+		if byUser && !field.UserEditable {
+			attributeErr.add(name, "cannot be changed by the user")
+			continue
+		}
+		if value == nil {
+			continue
+		}
+		if !hasAttributeType(value, field.GetType()) {
+			attributeErr.add(name, fmt.Sprintf("must be a %s", field.GetType()))
+			continue
+		}
+		if field.Validate == "" {
+			continue
+		}
+		if err := schema.validate.Var(value, field.Validate); err != nil {
+			attributeErr.add(name, "fails "+field.Validate)
+		}
+	}
+	if len(attributeErr.Violations) > 0 {
+		return attributeErr
+	}
+	return nil
+}
+
+func hasAttributeType(value any, attributeType UserAttributeType) bool {
+	switch value.(type) {
+	case string:
+		return attributeType == UserAttributeString
+	case bool:
+		return attributeType == UserAttributeBool
+	case float64, float32, int, int32, int64, uint, uint32, uint64:
+		return attributeType == UserAttributeNumber
+	}
+	return false
+}
+
+// Split separates the attributes an update sets from the ones it removes.
+func (schema *UserAttributeSchema) Split(update UserAttributes) (UserAttributes, []string) {
+	set := make(UserAttributes, len(update))
+	removed := []string{}
+	for name, value := range update {
+		if value == nil {
+			removed = append(removed, name)
+			continue
+		}
+		set[name] = value
+	}
+	return set, removed
+}
+
+// ClaimAttributes picks the attributes to carry in the login token.
+func (schema *UserAttributeSchema) ClaimAttributes(attributes UserAttributes) map[string]any {
+	claims := make(map[string]any)
+	for name, value := range attributes {
+		if field, ok := schema.fields[name]; ok && field.InClaims {
+			claims[name] = value
+		}
+	}
+	return claims
+}
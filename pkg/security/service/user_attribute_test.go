@@ -0,0 +1,65 @@
+package service
+
+import (
+	"errors"
+	. "github.com/GolangSpring/gospring/pkg/security/repository"
+	"slices"
+	"testing"
+)
+
+func TestNewUserAttributeSchemaChecksTags(t *testing.T) {
+	tests := []struct {
+		name  string
+		field UserAttributeField
+		valid bool
+	}{
+		{"no tags", UserAttributeField{Name: "team"}, true},
+		{"string tags", UserAttributeField{Name: "team", Validate: "max=64,oneof=sales support"}, true},
+		{"number tags", UserAttributeField{Name: "level", Type: UserAttributeNumber, Validate: "min=1,max=10"}, true},
+		{"unknown tag", UserAttributeField{Name: "team", Validate: "maximum=64"}, false},
+		{"tag not fitting the type", UserAttributeField{Name: "admin", Type: UserAttributeBool, Validate: "min=1"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewUserAttributeSchema(&UserAttributeConfig{Fields: []UserAttributeField{test.field}})
+			if (err == nil) != test.valid {
+				t.Fatalf("expected valid=%v, got %v", test.valid, err)
+			}
+		})
+	}
+}
+
+func TestUserAttributeSchemaValidate(t *testing.T) {
+	schema, err := NewUserAttributeSchema(&UserAttributeConfig{Fields: []UserAttributeField{
+		{Name: "team", Validate: "oneof=sales support", UserEditable: true},
+		{Name: "level", Type: UserAttributeNumber},
+	}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := schema.Validate(UserAttributes{"team": "sales", "level": float64(2)}, false); err != nil {
+		t.Fatalf("expected the update to pass, got %v", err)
+	}
+	err = schema.Validate(UserAttributes{"team": "hr", "level": "high", "other": 1}, false)
+	var attributeErr *UserAttributeError
+	if !errors.As(err, &attributeErr) || len(attributeErr.Violations) != 3 {
+		t.Fatalf("expected three violations, got %v", err)
+	}
+	if err := schema.Validate(UserAttributes{"level": float64(2)}, true); err == nil {
+		t.Fatal("expected the user not to edit an admin attribute")
+	}
+}
+
+func TestUserAttributeSchemaSplit(t *testing.T) {
+	schema, _ := NewUserAttributeSchema(&UserAttributeConfig{})
+	set, removed := schema.Split(UserAttributes{"team": "sales", "level": nil, "region": nil})
+
+	if len(set) != 1 || set["team"] != "sales" {
+		t.Fatalf("expected team to be set, got %v", set)
+	}
+	slices.Sort(removed)
+	if !slices.Equal(removed, []string{"level", "region"}) {
+		t.Fatalf("expected level and region to be removed, got %v", removed)
+	}
+}
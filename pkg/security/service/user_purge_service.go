@@ -0,0 +1,137 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/GolangSpring/gospring/application"
+	. "github.com/GolangSpring/gospring/pkg/security/repository"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"os"
+	"time"
+)
+
+const (
+	DefaultUserPurgeRetentionDay  = 30
+	DefaultUserPurgeIntervalHours = 24
+)
+
+type UserPurgeConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// RetentionDay is how long soft-deleted users can still be restored before they are removed for good
+	RetentionDay  int `yaml:"retention_day"`
+	IntervalHours int `yaml:"interval_hours"`
+}
+
+func (config *UserPurgeConfig) RetentionPeriod() time.Duration {
+	return time.Duration(valueOrDefault(config.RetentionDay, DefaultUserPurgeRetentionDay)) * 24 * time.Hour
+}
+
+func (config *UserPurgeConfig) Interval() time.Duration {
+	return time.Duration(valueOrDefault(config.IntervalHours, DefaultUserPurgeIntervalHours)) * time.Hour
+}
+
+var _ application.IService = (*UserPurgeService)(nil)
+
+// UserPurgeService removes for good the users soft-deleted longer than the retention period, along
+// with their invitations, casbin policies and avatar.
+type UserPurgeService struct {
+	UserService          IUserService
+	InvitationRepository IInvitationRepository
+	CasbinService        *CasbinService
+	ProfileService       IProfileService
+	UserPurgeConfig      *UserPurgeConfig
+
+	cancel context.CancelFunc
+}
+
+func NewUserPurgeService(
+	userService IUserService,
+	invitationRepository IInvitationRepository,
+	casbinService *CasbinService,
+	profileService IProfileService,
+	userPurgeConfig *UserPurgeConfig,
+) *UserPurgeService {
+	return &UserPurgeService{
+		UserService:          userService,
+		InvitationRepository: invitationRepository,
+		CasbinService:        casbinService,
+		ProfileService:       profileService,
+		UserPurgeConfig:      userPurgeConfig,
+	}
+}
+
+func (service *UserPurgeService) PostConstruct() {
+	ctx, cancel := context.WithCancel(context.Background())
+	service.cancel = cancel
+	go func() {
+		ticker := time.NewTicker(service.UserPurgeConfig.Interval())
+		defer ticker.Stop()
+		for {
+			service.Purge(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (service *UserPurgeService) Stop() {
+	if service.cancel != nil {
+		service.cancel()
+	}
+}
+
+func (service *UserPurgeService) Purge(ctx context.Context) {
+	deletedBefore := time.Now().Add(-service.UserPurgeConfig.RetentionPeriod())
+	users, err := service.UserService.FindDeletedBefore(ctx, deletedBefore)
+	if err != nil {
+		log.Warn().Msgf("Failed to find deleted users to purge: %v", err)
+		return
+	}
+	purged := 0
+	for _, user := range users {
+		if err := service.purgeUser(ctx, user); err != nil {
+			log.Warn().Msgf("Failed to purge user %d: %v", user.ID, err)
+			continue
+		}
+		purged++
+	}
+	if purged == 0 {
+		return
+	}
+	if err := service.CasbinService.ReloadPolicy(); err != nil {
+		log.Warn().Msgf("Failed to reload casbin policy after purging users: %v", err)
+	}
+	log.Info().Msgf("Purged %d users deleted before %v", purged, deletedBefore)
+}
+
+// purgeUser removes the user, its invitations and policies in one transaction, the avatar only
+// once they are gone.
+func (service *UserPurgeService) purgeUser(ctx context.Context, user *User) error {
+	err := service.UserService.PurgeWith(ctx, user, func(tx *gorm.DB) error {
+		if err := service.InvitationRepository.DeleteForUserTx(tx, user); err != nil {
+			return err
+		}
+		return service.CasbinService.RemoveSubjectTx(tx, UserSubject(user.ID))
+	})
+	if err != nil {
+		return err
+	}
+	if user.AvatarFile == "" {
+		return nil
+	}
+	path, err := service.ProfileService.AvatarPath(user.AvatarFile)
+	if errors.Is(err, AvatarStorageDisabled) {
+		return nil
+	}
+	if err == nil {
+		err = os.Remove(path)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Warn().Msgf("Failed to remove avatar of purged user %d: %v", user.ID, err)
+	}
+	return nil
+}
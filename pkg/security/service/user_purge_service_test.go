@@ -0,0 +1,94 @@
+package service
+
+import (
+	"context"
+	"errors"
+	. "github.com/GolangSpring/gospring/pkg/security/repository"
+	"github.com/casbin/casbin/v2"
+	"github.com/casbin/casbin/v2/model"
+	fileadapter "github.com/casbin/casbin/v2/persist/file-adapter"
+	"gorm.io/gorm"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// purgeUserService returns the deleted users and fails the purge of failing, the transaction
+// callback is not run as there is no database.
+type purgeUserService struct {
+	IUserService
+	users   []*User
+	failing uint
+	purged  []uint
+}
+
+func (service *purgeUserService) FindDeletedBefore(ctx context.Context, deletedBefore time.Time) ([]*User, error) {
+	return service.users, nil
+}
+
+func (service *purgeUserService) PurgeWith(ctx context.Context, user *User, sync func(tx *gorm.DB) error) error {
+	if user.ID == service.failing {
+		return errors.New("purge failed")
+	}
+	service.purged = append(service.purged, user.ID)
+	return nil
+}
+
+func newPurgeCasbinService(t *testing.T) *CasbinService {
+	t.Helper()
+	policyFile := filepath.Join(t.TempDir(), "policy.csv")
+	if err := os.WriteFile(policyFile, nil, 0o644); err != nil {
+		t.Fatalf("failed to write the policy file: %v", err)
+	}
+	casbinModel, err := model.NewModelFromString(DomainModelString)
+	if err != nil {
+		t.Fatalf("failed to parse the domain model: %v", err)
+	}
+	enforcer, err := casbin.NewSyncedEnforcer(casbinModel, fileadapter.NewAdapter(policyFile))
+	if err != nil {
+		t.Fatalf("failed to create the enforcer: %v", err)
+	}
+	return NewCasbinService(enforcer, nil, &CasbinConfig{Model: CasbinModelDomain})
+}
+
+func TestPurgeRemovesAvatarsOfPurgedUsers(t *testing.T) {
+	directory := t.TempDir()
+	for _, name := range []string{"1-a.png", "2-b.png"} {
+		if err := os.WriteFile(filepath.Join(directory, name), []byte("image"), 0o644); err != nil {
+			t.Fatalf("failed to write the avatar: %v", err)
+		}
+	}
+	userService := &purgeUserService{
+		users: []*User{
+			{ID: 1, AvatarFile: "1-a.png"},
+			{ID: 2, AvatarFile: "2-b.png"},
+			{ID: 3},
+		},
+		failing: 2,
+	}
+	service := NewUserPurgeService(userService, nil, newPurgeCasbinService(t),
+		&ProfileService{ProfileConfig: &ProfileConfig{AvatarDirectory: directory}}, &UserPurgeConfig{})
+
+	service.Purge(context.Background())
+
+	if len(userService.purged) != 2 || userService.purged[0] != 1 || userService.purged[1] != 3 {
+		t.Fatalf("expected users 1 and 3 to be purged, got %v", userService.purged)
+	}
+	if _, err := os.Stat(filepath.Join(directory, "1-a.png")); !os.IsNotExist(err) {
+		t.Fatalf("expected the avatar of the purged user to be removed, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(directory, "2-b.png")); err != nil {
+		t.Fatalf("expected the avatar of the user still stored to be kept, got %v", err)
+	}
+}
+
+func TestPurgeWithoutAvatarStorage(t *testing.T) {
+	userService := &purgeUserService{users: []*User{{ID: 1, AvatarFile: "1-a.png"}}}
+	service := NewUserPurgeService(userService, nil, newPurgeCasbinService(t),
+		&ProfileService{ProfileConfig: &ProfileConfig{}}, &UserPurgeConfig{})
+
+	if err := service.purgeUser(context.Background(), userService.users[0]); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -1,18 +1,18 @@
 package service
 
 import (
-	"bytes"
 	"context"
 	"fmt"
 	"github.com/GolangSpring/gospring/application"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/rs/zerolog/log"
-	"html/template"
 	"time"
 )
 
+// ResetPasswordClaims carry the email asked for rather than the user, so a token for an unknown
+// email looks like any other one.
 type ResetPasswordClaims struct {
-	ID                 uint    `json:"id"`
+	Email              string  `json:"email"`
 	ExpirationDuration float64 `json:"exp"`
 }
 
@@ -26,25 +26,28 @@ func (claims *ResetPasswordClaims) Validate() error {
 var _ application.IService = (*UserResetPasswordService)(nil)
 
 type UserResetPasswordService struct {
-	SmtpService ISmtpService
-	UserService IUserService
-	AuthService IAuthService
-	OtpService  IOtpService
+	SmtpService     ISmtpService
+	TemplateService ITemplateService
+	UserService     IUserService
+	AuthService     IAuthService
+	OtpService      IOtpService
 }
 
 func (service *UserResetPasswordService) PostConstruct() {}
 
 func NewUserResetPasswordService(
 	smtpService ISmtpService,
+	templateService ITemplateService,
 	userService IUserService,
 	authService IAuthService,
 	otpService IOtpService,
 ) *UserResetPasswordService {
 	return &UserResetPasswordService{
-		SmtpService: smtpService,
-		UserService: userService,
-		AuthService: authService,
-		OtpService:  otpService,
+		SmtpService:     smtpService,
+		TemplateService: templateService,
+		UserService:     userService,
+		AuthService:     authService,
+		OtpService:      otpService,
 	}
 
 }
@@ -71,69 +74,55 @@ func (service *UserResetPasswordService) extractResetPasswordClaims(claims *jwt.
 	if !ok || purpose != string(PurposeResetPassword) {
 		return nil, fmt.Errorf("invalid or missing 'purpose' claim, getting %s, expects %v", purpose, PurposeResetPassword)
 	}
-	userID, ok := (*claims)["id"].(float64)
+	email, ok := (*claims)["email"].(string)
 	if !ok {
-		return nil, fmt.Errorf("invalid or missing 'id' claim")
+		return nil, fmt.Errorf("invalid or missing 'email' claim")
 	}
 	expiration, ok := (*claims)["exp"].(float64)
 	if !ok {
 		return nil, fmt.Errorf("invalid or missing 'exp' claim")
 	}
-	resetPasswordClaims.ID = uint(userID)
+	resetPasswordClaims.Email = email
 	resetPasswordClaims.ExpirationDuration = expiration
 	return &resetPasswordClaims, nil
 }
 
-func (service *UserResetPasswordService) doResetPassword(ctx context.Context, userId uint, newPassword string) error {
-	user, err := service.UserService.FindByID(ctx, userId)
-	if err != nil {
-		return UserNotFound
-	}
-	hashedPassword, err := service.AuthService.GenerateHashedPassword(newPassword)
-	if err != nil {
-		return err
-	}
-	if err := service.UserService.ResetUserPassword(ctx, user, hashedPassword); err != nil {
-		return err
-	}
-	return nil
-}
-
 func (service *UserResetPasswordService) ResetPassword(ctx context.Context, token string, otpCode string, newPassword string, confirmedPassword string) error {
 	if newPassword != confirmedPassword {
 		return ResetPasswordNotMatched
 	}
-	log.Info().Msgf("Reset Password: %v", token)
 	claims, err := service.parseResetPasswordClaims(token)
 	if err != nil {
 		log.Warn().Msgf("Failed to parse reset password claims: %v", err)
 		return err
 	}
-
-	log.Info().Msgf("Claims: %v", claims)
-	log.Info().Msgf("Begin to verify OTP: %v", otpCode)
-	if err := service.OtpService.VerifyOtp(claims.ID, PurposeResetPassword, otpCode); err != nil {
-		return err
-	}
-
 	if err := claims.Validate(); err != nil {
 		return err
 	}
-	return service.doResetPassword(ctx, claims.ID, newPassword)
-}
 
-func (service *UserResetPasswordService) IssueResetPasswordToken(ctx context.Context, email string) (string, error) {
-	user, err := service.UserService.FindByEmail(ctx, email)
+	// An unknown email fails like a wrong code, the caller cannot tell them apart
+	user, err := service.UserService.FindByEmail(ctx, claims.Email)
 	if err != nil {
-		return "", err
+		return OtpIncorrect
+	}
+	// The policy is checked first so a refused password does not use up the code
+	if err := service.AuthService.ValidatePassword(user.Name, user.Email, newPassword); err != nil {
+		return err
+	}
+	if err := service.OtpService.VerifyOtp(user.ID, PurposeResetPassword, otpCode); err != nil {
+		return err
 	}
+	return service.AuthService.ChangePassword(ctx, user, newPassword)
+}
 
+// IssueResetPasswordToken answers the same way whether the email belongs to a user or not.
+func (service *UserResetPasswordService) IssueResetPasswordToken(email string) string {
 	claims := jwt.MapClaims{
 		"purpose": string(PurposeResetPassword),
-		"id":      user.ID,
+		"email":   email,
 		"exp":     time.Now().Add(10 * time.Minute).Unix(),
 	}
-	return service.AuthService.IssueJsonWebToken(&claims), nil
+	return service.AuthService.IssueJsonWebToken(&claims)
 }
 
 func (service *UserResetPasswordService) SendResetPasswordEmail(context context.Context, token string) (string, error) {
@@ -143,25 +132,21 @@ func (service *UserResetPasswordService) SendResetPasswordEmail(context context.
 		return "", err
 	}
 
-	user, err := service.UserService.FindByID(context, claims.ID)
+	// Nothing is sent for an unknown email, the answer stays the same
+	user, err := service.UserService.FindByEmail(context, claims.Email)
 	if err != nil {
-		return "", err
+		return token, nil
 	}
 
-	otp := service.OtpService.GenerateOtp(claims.ID, PurposeResetPassword)
+	otp := service.OtpService.GenerateOtp(user.ID, PurposeResetPassword)
 
-	subject := "Reset Password"
-	_template, err := template.New("reset_password_email").Parse(RESET_PASSWORD_EMAIL_HTML_TEMPLATE)
+	emailTemplate := NewEmailTemplate(user.Name, otp.Code, service.SmtpService.GetSmtpConfig().CompanyName)
+	email, err := service.TemplateService.Render(TemplateResetPassword, user.Locale, emailTemplate)
 	if err != nil {
+		log.Warn().Msgf("Failed to render reset password email: %v", err)
 		return "", err
 	}
-	emailTemplate := NewEmailTemplate(user.Name, otp.Code, service.SmtpService.GetSmtpConfig().CompanyName)
-	var buffer bytes.Buffer
-	if err := _template.Execute(&buffer, emailTemplate); err != nil {
-		log.Info().Msgf("Failed to execute template: %v", err)
-	}
-	body := buffer.String()
-	message := service.SmtpService.CreateNewMessage(user.Email, subject, body, ContentTypeHtml)
+	message := service.SmtpService.CreateRenderedMessage(user.Email, email)
 	if err := service.SmtpService.SendEmail(message); err != nil {
 		return "", err
 	}
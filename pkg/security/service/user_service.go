@@ -2,20 +2,113 @@ package service
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/GolangSpring/gospring/application"
 	. "github.com/GolangSpring/gospring/pkg/security/repository"
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/gorm"
+	"strings"
+	"time"
 )
 
+// UserExistsError names the field already taken by another user, it matches UserExists with errors.Is.
+type UserExistsError struct {
+	Field string
+}
+
+func (err *UserExistsError) Error() string {
+	return fmt.Sprintf("%v: %s", UserExists, err.Field)
+}
+
+func (err *UserExistsError) Unwrap() error {
+	return UserExists
+}
+
+// uniqueViolationCode is the Postgres error code of a unique constraint violation.
+const uniqueViolationCode = "23505"
+
+// asUserExists turns the unique violation of a user raced past checkProfileAvailable into a
+// UserExistsError, other errors are returned as they are.
+func asUserExists(err error) error {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) || pgErr.Code != uniqueViolationCode {
+		return err
+	}
+	if pgErr.ConstraintName == UserNameIndex {
+		return &UserExistsError{Field: "user_name"}
+	}
+	return &UserExistsError{Field: "email"}
+}
+
+// AccountStatusError tells why a user may not sign in, it matches AccountDisabled, AccountLocked
+// or AccountPending with errors.Is.
+type AccountStatusError struct {
+	Status AccountStatus
+	Reason string
+}
+
+func (err *AccountStatusError) Error() string {
+	if err.Reason == "" {
+		return err.Unwrap().Error()
+	}
+	return fmt.Sprintf("%v: %s", err.Unwrap(), err.Reason)
+}
+
+func (err *AccountStatusError) Unwrap() error {
+	switch err.Status {
+	case AccountStatusLocked:
+		return AccountLocked
+	case AccountStatusPending:
+		return AccountPending
+	default:
+		return AccountDisabled
+	}
+}
+
+// CheckAccountStatus returns an AccountStatusError unless the user is active.
+func CheckAccountStatus(user *User) error {
+	if user.IsActive() {
+		return nil
+	}
+	return &AccountStatusError{Status: user.Status, Reason: user.StatusReason}
+}
+
+// NormalizeEmail is the form emails are stored and compared in.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// UserProfileUpdate holds the profile fields to change, nil fields keep their value.
+type UserProfileUpdate struct {
+	Name   *string `json:"name" validate:"omitempty,min=3,max=32,printascii,excludesall=@ "`
+	Email  *string `json:"email" validate:"omitempty,email,max=100"`
+	Locale *string `json:"locale" validate:"omitempty,max=16,bcp47_language_tag"`
+}
+
 type IUserService interface {
 	IUserRepository
 	UpdateUserRolesByUserID(ctx context.Context, userID uint, roles []string) (*User, error)
 	AddUser(ctx context.Context, user *User) error
+	AddUserWith(ctx context.Context, user *User, sync func(tx *gorm.DB) error) error
 	ResetUserPassword(ctx context.Context, user *User, password string) error
+	UpdateUserEmailOtpByUserID(ctx context.Context, userID uint, enabled bool) error
+
+	FindUser(ctx context.Context, userID uint) (*User, error)
+	FindUsers(ctx context.Context, query *UserQuery) ([]*User, int64, error)
+	UpdateProfile(ctx context.Context, userID uint, update *UserProfileUpdate) (*User, error)
+	SetUserStatus(ctx context.Context, userID uint, status AccountStatus, reason string) (*User, error)
+	SoftDeleteUser(ctx context.Context, userID uint) error
+	RestoreUser(ctx context.Context, userID uint) (*User, error)
+
+	GetAttributeSchema() *UserAttributeSchema
+	UpdateAttributes(ctx context.Context, userID uint, update UserAttributes) (*User, error)
 }
 
-func NewUserService(repository IUserRepository) *UserService {
+func NewUserService(repository IUserRepository, attributeSchema *UserAttributeSchema) *UserService {
 	return &UserService{
 		IUserRepository: repository,
+		AttributeSchema: attributeSchema,
 	}
 }
 
@@ -24,6 +117,7 @@ var _ IUserService = (*UserService)(nil)
 
 type UserService struct {
 	IUserRepository
+	AttributeSchema *UserAttributeSchema
 }
 
 func (service *UserService) ResetUserPassword(ctx context.Context, user *User, password string) error {
@@ -40,18 +134,148 @@ func (service *UserService) UpdateUserPasswordByUserID(ctx context.Context, user
 	return service.IUserRepository.UpdateUserPassword(ctx, user, password)
 }
 
+// AddUser refuses an email or user name already taken, compared case-insensitively.
 func (service *UserService) AddUser(ctx context.Context, user *User) error {
-	userFound, err := service.FindByID(ctx, user.ID)
-	if err == nil && userFound != nil {
-		return UserExists
+	user.Email = NormalizeEmail(user.Email)
+	if err := service.checkProfileAvailable(ctx, user.ID, user.Name, user.Email); err != nil {
+		return err
 	}
 
-	if err = service.Save(ctx, user); err != nil {
+	return asUserExists(service.Save(ctx, user))
+}
+
+// AddUserWith adds the user and runs sync in the same transaction, nothing is stored when sync fails.
+func (service *UserService) AddUserWith(ctx context.Context, user *User, sync func(tx *gorm.DB) error) error {
+	user.Email = NormalizeEmail(user.Email)
+	if err := service.checkProfileAvailable(ctx, user.ID, user.Name, user.Email); err != nil {
 		return err
 	}
+	return asUserExists(service.SaveWith(ctx, user, sync))
+}
+
+// checkProfileAvailable refuses an email or name held by another user, soft-deleted users keep
+// theirs so they can still be restored.
+func (service *UserService) checkProfileAvailable(ctx context.Context, userID uint, name string, email string) error {
+	users, err := service.FindConflicting(ctx, email, name)
+	if err != nil {
+		return err
+	}
+	for _, found := range users {
+		if found.ID == userID {
+			continue
+		}
+		if strings.EqualFold(found.Email, email) {
+			return &UserExistsError{Field: "email"}
+		}
+		return &UserExistsError{Field: "user_name"}
+	}
 	return nil
 }
 
+func (service *UserService) FindUser(ctx context.Context, userID uint) (*User, error) {
+	user, err := service.FindByID(ctx, userID)
+	if err != nil {
+		return nil, UserNotFound
+	}
+	return user, nil
+}
+
+func (service *UserService) FindUsers(ctx context.Context, query *UserQuery) ([]*User, int64, error) {
+	return service.FindPage(ctx, query)
+}
+
+func (service *UserService) UpdateProfile(ctx context.Context, userID uint, update *UserProfileUpdate) (*User, error) {
+	user, err := service.FindUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	name, email, locale := user.Name, user.Email, user.Locale
+	if update.Name != nil {
+		name = *update.Name
+	}
+	if update.Email != nil {
+		email = NormalizeEmail(*update.Email)
+	}
+	if update.Locale != nil {
+		locale = *update.Locale
+	}
+	if err := service.checkProfileAvailable(ctx, user.ID, name, email); err != nil {
+		return nil, err
+	}
+
+	// A new address is unverified until its owner proves it
+	isVerified := user.IsVerified && email == user.Email
+	if err := service.UpdateUserProfile(ctx, user, name, email, locale, isVerified); err != nil {
+		return nil, asUserExists(err)
+	}
+	user.Name, user.Email, user.Locale, user.IsVerified = name, email, locale, isVerified
+	return user, nil
+}
+
+// SetUserStatus changes whether the user may sign in, the reason is shown to them when they may not.
+func (service *UserService) SetUserStatus(ctx context.Context, userID uint, status AccountStatus, reason string) (*User, error) {
+	user, err := service.FindUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := service.UpdateUserStatus(ctx, user, status, reason); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	user.Status, user.StatusReason, user.StatusChangedAt = status, reason, &now
+	return user, nil
+}
+
+// SoftDeleteUser hides the user from listings and login, it can be brought back with RestoreUser
+// until the purge removes it for good.
+func (service *UserService) SoftDeleteUser(ctx context.Context, userID uint) error {
+	if _, err := service.FindUser(ctx, userID); err != nil {
+		return err
+	}
+	return service.DeleteByID(ctx, userID)
+}
+
+func (service *UserService) RestoreUser(ctx context.Context, userID uint) (*User, error) {
+	if _, err := service.FindDeletedByID(ctx, userID); err != nil {
+		return nil, UserNotFound
+	}
+	if err := service.RestoreByID(ctx, userID); err != nil {
+		return nil, err
+	}
+	user, err := service.FindUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	// A deletion the user scheduled is done, left in place it would delete them again
+	if user.DeletionScheduledAt != nil {
+		if err := service.UpdateUserDeletionScheduledAt(ctx, user, nil); err != nil {
+			return nil, err
+		}
+		user.DeletionScheduledAt = nil
+	}
+	return user, nil
+}
+
+func (service *UserService) GetAttributeSchema() *UserAttributeSchema {
+	return service.AttributeSchema
+}
+
+// UpdateAttributes merges the update into the custom attributes of the user, nil values remove them.
+func (service *UserService) UpdateAttributes(ctx context.Context, userID uint, update UserAttributes) (*User, error) {
+	if err := service.AttributeSchema.Validate(update, false); err != nil {
+		return nil, err
+	}
+	user, err := service.FindUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	set, removed := service.AttributeSchema.Split(update)
+	if err := service.MergeUserAttributes(ctx, user, set, removed); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
 func (service *UserService) UpdateUserRolesByUserID(ctx context.Context, userID uint, roles []string) (*User, error) {
 	user, err := service.FindByID(ctx, userID)
 	if err != nil {
@@ -62,4 +286,12 @@ func (service *UserService) UpdateUserRolesByUserID(ctx context.Context, userID
 	return user, service.UpdateUserRoles(ctx, user, roles)
 }
 
+func (service *UserService) UpdateUserEmailOtpByUserID(ctx context.Context, userID uint, enabled bool) error {
+	user, err := service.FindByID(ctx, userID)
+	if err != nil {
+		return UserNotFound
+	}
+	return service.UpdateUserEmailOtp(ctx, user, enabled)
+}
+
 func (service *UserService) PostConstruct() {}
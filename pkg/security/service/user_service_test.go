@@ -0,0 +1,108 @@
+package service
+
+import (
+	"context"
+	"errors"
+	. "github.com/GolangSpring/gospring/pkg/security/repository"
+	"github.com/jackc/pgx/v5/pgconn"
+	"testing"
+)
+
+// racedUserRepository finds no conflicting user, as when a concurrent registration commits
+// in between, and fails the save with the given error.
+type racedUserRepository struct {
+	IUserRepository
+	saveErr error
+}
+
+func (repo *racedUserRepository) FindConflicting(ctx context.Context, email string, name string) ([]*User, error) {
+	return nil, nil
+}
+
+func (repo *racedUserRepository) Save(ctx context.Context, user *User) error {
+	return repo.saveErr
+}
+
+func TestAddUserUniqueViolation(t *testing.T) {
+	tests := []struct {
+		name     string
+		saveErr  error
+		expected string
+	}{
+		{"email index", &pgconn.PgError{Code: uniqueViolationCode, ConstraintName: UserEmailIndex}, "email"},
+		{"email column constraint", &pgconn.PgError{Code: uniqueViolationCode, ConstraintName: "uni_users_email"}, "email"},
+		{"name index", &pgconn.PgError{Code: uniqueViolationCode, ConstraintName: UserNameIndex}, "user_name"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			service := NewUserService(&racedUserRepository{saveErr: test.saveErr}, nil)
+
+			err := service.AddUser(context.Background(), &User{Name: "alice", Email: "alice@example.com"})
+			var existsErr *UserExistsError
+			if !errors.As(err, &existsErr) {
+				t.Fatalf("expected UserExistsError, got %v", err)
+			}
+			if existsErr.Field != test.expected {
+				t.Fatalf("expected field %s, got %s", test.expected, existsErr.Field)
+			}
+		})
+	}
+}
+
+func TestAddUserOtherErrors(t *testing.T) {
+	saveErr := &pgconn.PgError{Code: "23502", ConstraintName: UserNameIndex}
+	service := NewUserService(&racedUserRepository{saveErr: saveErr}, nil)
+
+	err := service.AddUser(context.Background(), &User{Name: "alice", Email: "alice@example.com"})
+	if errors.Is(err, UserExists) || !errors.Is(err, saveErr) {
+		t.Fatalf("expected the save error, got %v", err)
+	}
+}
+
+// profileUserRepository holds one user and records the verified flag of the last profile update.
+type profileUserRepository struct {
+	IUserRepository
+	user       *User
+	isVerified *bool
+}
+
+func (repo *profileUserRepository) FindByID(ctx context.Context, id uint) (*User, error) {
+	user := *repo.user
+	return &user, nil
+}
+
+func (repo *profileUserRepository) FindConflicting(ctx context.Context, email string, name string) ([]*User, error) {
+	return nil, nil
+}
+
+func (repo *profileUserRepository) UpdateUserProfile(ctx context.Context, user *User, name string, email string, locale string, isVerified bool) error {
+	repo.isVerified = &isVerified
+	return nil
+}
+
+func TestUpdateProfileEmailVerification(t *testing.T) {
+	name, sameEmail, newEmail := "bob", "Alice@Example.com", "new@example.com"
+	tests := []struct {
+		name     string
+		update   *UserProfileUpdate
+		expected bool
+	}{
+		{"name change keeps the verification", &UserProfileUpdate{Name: &name}, true},
+		{"same email keeps the verification", &UserProfileUpdate{Email: &sameEmail}, true},
+		{"new email clears the verification", &UserProfileUpdate{Email: &newEmail}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			repo := &profileUserRepository{user: &User{ID: 1, Name: "alice", Email: "alice@example.com", IsVerified: true}}
+			service := NewUserService(repo, nil)
+
+			user, err := service.UpdateProfile(context.Background(), 1, test.update)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if user.IsVerified != test.expected || *repo.isVerified != test.expected {
+				t.Fatalf("expected verified %v, got %v and stored %v", test.expected, user.IsVerified, *repo.isVerified)
+			}
+		})
+	}
+}
@@ -1,44 +1,62 @@
 package service
 
 import (
-	"bytes"
 	"context"
 	"fmt"
+	"github.com/GolangSpring/gospring/application"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/rs/zerolog/log"
 	"github.com/ugurcsen/gods-generic/sets/hashset"
-	"text/template"
 	"time"
 )
 
+// VerificationConfig decides whether registration sends the verification email by itself and
+// whether unverified users are refused on every route but AllowedRoutes and the built-in ones.
+type VerificationConfig struct {
+	SendOnRegister  bool `yaml:"send_on_register"`
+	RequireVerified bool `yaml:"require_verified"`
+	// AllowedRoutes are path patterns unverified users may still reach
+	AllowedRoutes []string `yaml:"allowed_routes"`
+}
+
 type UserVerificationClaims struct {
 	ID                 uint    `json:"id"`
 	ExpirationDuration float64 `json:"exp"`
 }
 
+var _ application.IService = (*UserVerificationService)(nil)
+
 type UserVerificationService struct {
 	SmtpService                       ISmtpService
+	TemplateService                   ITemplateService
 	UserService                       IUserService
 	AuthService                       IAuthService
 	OtpService                        IOtpService
+	VerificationConfig                *VerificationConfig
 	AdminPushedEmailVerificationCache *hashset.Set[uint]
 }
 
 func NewUserVerificationService(
 	smtpService ISmtpService,
+	templateService ITemplateService,
 	userService IUserService,
 	authService IAuthService,
 	otpService IOtpService,
+	verificationConfig *VerificationConfig,
 ) *UserVerificationService {
 	return &UserVerificationService{
 		SmtpService:                       smtpService,
+		TemplateService:                   templateService,
 		UserService:                       userService,
 		AuthService:                       authService,
 		OtpService:                        otpService,
+		VerificationConfig:                verificationConfig,
 		AdminPushedEmailVerificationCache: hashset.New[uint](),
 	}
 }
 
+func (service *UserVerificationService) PostConstruct() {}
+
 func (service *UserVerificationService) IssueVerificationToken(ctx context.Context, userID uint) (string, error) {
 	user, err := service.UserService.FindByID(ctx, userID)
 	if err != nil {
@@ -79,25 +97,41 @@ func (service *UserVerificationService) SendVerificationEmailByUserID(ctx contex
 		service.AdminPushedEmailVerificationCache.Add(user.ID)
 	}
 
-	_template, err := template.New("email_verification").Parse(EMAIL_VERIFICATION_HTML_TEMPLATE)
-	if err != nil {
-		return err
-	}
 	otp := service.OtpService.GenerateOtp(user.ID, PurposeGuestEmailVerification)
 
-	var buffer bytes.Buffer
 	emailTemplate := NewEmailTemplate(user.Name, otp.Code, service.SmtpService.GetSmtpConfig().CompanyName)
-	if err := _template.Execute(&buffer, emailTemplate); err != nil {
+	email, err := service.TemplateService.Render(TemplateEmailVerification, user.Locale, emailTemplate)
+	if err != nil {
 		return err
 	}
 
-	emailContent := buffer.String()
-
-	message := service.SmtpService.CreateNewMessage(user.Email, "Email Verification", emailContent, ContentTypeHtml)
+	message := service.SmtpService.CreateRenderedMessage(user.Email, email)
 
 	return service.SmtpService.SendEmail(message)
 }
 
+// StartVerification issues the verification token and emails the code, the token goes back to
+// the client to be submitted with the code.
+func (service *UserVerificationService) StartVerification(ctx context.Context, userID uint) (string, error) {
+	token, err := service.IssueVerificationToken(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+	if err := service.SendVerificationEmailByToken(ctx, token); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// SendRegistrationVerification starts the verification of a new user when SendOnRegister is set,
+// the token is empty otherwise.
+func (service *UserVerificationService) SendRegistrationVerification(ctx context.Context, userID uint) (string, error) {
+	if !service.VerificationConfig.SendOnRegister {
+		return "", nil
+	}
+	return service.StartVerification(ctx, userID)
+}
+
 func (service *UserVerificationService) SendVerificationEmailByToken(ctx context.Context, token string) error {
 	claims, err := service.parseVerificationClaims(token)
 	if err != nil {